@@ -262,6 +262,7 @@ type MknodResponse LookupResponse
 // A `rename` request is a request to rename a file.
 
 type RenameRequest struct {
+	Inode       uint64 // inode of the directory holding OldName
 	NewDirInode uint64
 	OldName     string
 	NewName     string
@@ -308,6 +309,7 @@ type WriteResponse struct {
 // A `setattr` request asks to change one or more attributes associated with a file, as indicated by Valid.
 
 type SetattrRequest struct {
+	Inode  uint64
 	Valid  fuse.SetattrValid
 	Handle uint64
 	Size   uint64
@@ -0,0 +1,62 @@
+package boltfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// ---------------------------------------------------------------------------
+// 请求签名，见 QBOLT.md 的“请求签名”一节。
+
+const (
+	SignScheme     = "QBolt-HMAC-SHA256 "
+	LegacyScheme   = "QBolt "
+	IdentityHeader = "X-Qbolt-Identity"
+	SignDateHeader = "X-Qbolt-Date"
+)
+
+// EncodeIdentity 返回 base64(<Uid/Gid/Pid:uint32>)。
+//
+func EncodeIdentity(uid, gid, pid uint32) string {
+
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[:], uid)
+	binary.LittleEndian.PutUint32(b[4:], gid)
+	binary.LittleEndian.PutUint32(b[8:], pid)
+	return base64.URLEncoding.EncodeToString(b[:])
+}
+
+func DecodeIdentity(s string) (uid, gid, pid uint32, ok bool) {
+
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil || len(b) != 12 {
+		return
+	}
+	uid = binary.LittleEndian.Uint32(b)
+	gid = binary.LittleEndian.Uint32(b[4:])
+	pid = binary.LittleEndian.Uint32(b[8:])
+	return uid, gid, pid, true
+}
+
+// StringToSign 返回待签名的内容，bodyHash 为 sha256(Body)：
+//
+//	<Method>\n<Path>\n<Reqid>\n<Identity>\n<Date>\n<hex(sha256(Body))>
+//
+func StringToSign(method, path, reqid, identity, date string, bodyHash []byte) string {
+
+	return method + "\n" + path + "\n" + reqid + "\n" + identity + "\n" + date + "\n" + hex.EncodeToString(bodyHash)
+}
+
+// Sign 返回 base64(hmac-sha256(secret, stringToSign))。
+//
+func Sign(secret []byte, stringToSign string) string {
+
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(stringToSign))
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+
+	"qbox.us/cc/config"
+
+	"github.com/qiniu/log.v1"
+
+	"qiniu.com/boltfsd.v1"
+	"qiniu.com/mac.v1"
+	"qiniu.com/peercred.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+type Config struct {
+	Bolt boltfsd.Config `json:"bolt"`
+
+	// 不为空时校验请求的 Qiniu MAC token。
+	//
+	Auth *mac.Config `json:"auth"`
+
+	// 监听地址。"unix:/path/to/qbolt.sock" 表示监听 unix socket。
+	//
+	BindHost   string `json:"bind_host"`
+	MaxProcs   int    `json:"max_procs"`
+	DebugLevel int    `json:"debug_level"`
+}
+
+func main() {
+
+	// Load Config
+
+	config.Init("f", "qiniu", "boltfsd.conf")
+
+	var conf Config
+	if err := config.Load(&conf); err != nil {
+		log.Fatal("config.Load failed:", err)
+	}
+	log.Info("config:", conf)
+
+	// General Settings
+
+	runtime.GOMAXPROCS(conf.MaxProcs)
+	log.SetOutputLevel(conf.DebugLevel)
+
+	// new Service
+
+	service, err := boltfsd.New(&conf.Bolt)
+	if err != nil {
+		log.Fatal("boltfsd.New failed:", err)
+	}
+
+	// run Service
+
+	var handler http.Handler = service
+	if conf.Auth != nil {
+		// QBolt 的 Authorization 头用于传递调用者身份，token 默认改由 X-Qiniu-Authorization 携带
+		if conf.Auth.Header == "" {
+			conf.Auth.Header = "X-Qiniu-Authorization"
+		}
+		handler = mac.New(conf.Auth, nil).Handler(handler)
+	}
+	log.Info("Starting boltfsd ...")
+	err = peercred.ListenAndServe(conf.BindHost, handler)
+	log.Fatal("peercred.ListenAndServe(boltfsd):", err)
+}
+
+// ---------------------------------------------------------------------------
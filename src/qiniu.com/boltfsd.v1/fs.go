@@ -0,0 +1,951 @@
+package boltfsd
+
+import (
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+const rootIno = uint64(fuse.RootID)
+
+const supportedInitFlags = fuse.InitAsyncRead | fuse.InitBigWrites
+
+const (
+	xattrCreate  = 1 // XATTR_CREATE
+	xattrReplace = 2 // XATTR_REPLACE
+)
+
+type node struct {
+	attr    Attr
+	parent  uint64            // 仅目录
+	entries map[string]uint64 // 仅目录
+	target  string            // 仅软链接
+	data    fileData          // 仅普通文件
+	xattrs  map[string][]byte
+	nlookup uint64 // 内核持有的 lookup 计数
+	nopen   int    // 打开的 handle 数
+}
+
+type handle struct {
+	ino     uint64
+	flags   fuse.OpenFlags
+	dir     bool
+	dirents []byte // readdir 快照，在 Offset == 0 时生成
+}
+
+func now() Time {
+
+	return Time(time.Now().UnixNano())
+}
+
+func newNode(ino uint64, mode os.FileMode, uid, gid uint32) *node {
+
+	t := now()
+	n := &node{
+		attr: Attr{
+			Inode: ino,
+			Mode:  mode,
+			Nlink: 1,
+			Uid:   uid,
+			Gid:   gid,
+			Atime: t, Mtime: t, Ctime: t, Crtime: t,
+		},
+	}
+	if mode.IsDir() {
+		n.entries = make(map[string]uint64)
+	}
+	return n
+}
+
+func (n *node) setSize(size uint64) {
+
+	n.data.truncate(size)
+	n.attr.Size = size
+	n.attr.Blocks = (size + 511) / 512 // st_blocks 以 512 字节为单位
+}
+
+// ---------------------------------------------------------------------------
+
+const chunkSize = 64 * 1024
+
+// fileData 以 chunkSize 为单位稀疏地保存普通文件的内容。空洞不占用内存，读出为 0，
+// 因此 truncate 到很大的尺寸或在很大的偏移处写入只分配实际写入的块。
+//
+type fileData struct {
+	size   uint64
+	chunks map[uint64][]byte // 块号 => 内容，长度总是 chunkSize
+}
+
+func (d *fileData) truncate(size uint64) {
+
+	if size < d.size {
+		for idx := range d.chunks {
+			if idx*chunkSize >= size {
+				delete(d.chunks, idx)
+			}
+		}
+		// 截断点所在块的尾部清零，以免再次扩展时读到旧数据
+		if c, ok := d.chunks[size/chunkSize]; ok {
+			tail := c[size%chunkSize:]
+			for i := range tail {
+				tail[i] = 0
+			}
+		}
+	}
+	d.size = size
+}
+
+func (d *fileData) readAt(off int64, size int) []byte {
+
+	if off < 0 || uint64(off) >= d.size || size <= 0 {
+		return nil
+	}
+	if uint64(size) > d.size-uint64(off) {
+		size = int(d.size - uint64(off))
+	}
+	b := make([]byte, size)
+	for pos := 0; pos < size; {
+		abs := uint64(off) + uint64(pos)
+		idx, coff := abs/chunkSize, int(abs%chunkSize)
+		n := chunkSize - coff
+		if n > size-pos {
+			n = size - pos
+		}
+		if c, ok := d.chunks[idx]; ok {
+			copy(b[pos:pos+n], c[coff:])
+		}
+		pos += n
+	}
+	return b
+}
+
+func (d *fileData) writeAt(off uint64, data []byte) {
+
+	if d.chunks == nil {
+		d.chunks = make(map[uint64][]byte)
+	}
+	for pos := 0; pos < len(data); {
+		abs := off + uint64(pos)
+		idx, coff := abs/chunkSize, int(abs%chunkSize)
+		c, ok := d.chunks[idx]
+		if !ok {
+			c = make([]byte, chunkSize)
+			d.chunks[idx] = c
+		}
+		pos += copy(c[coff:], data[pos:])
+	}
+	if end := off + uint64(len(data)); end > d.size {
+		d.size = end
+	}
+}
+
+func direntTypeOf(mode os.FileMode) fuse.DirentType {
+
+	switch {
+	case mode.IsDir():
+		return fuse.DT_Dir
+	case mode&os.ModeSymlink != 0:
+		return fuse.DT_Link
+	case mode&os.ModeNamedPipe != 0:
+		return fuse.DT_FIFO
+	case mode&os.ModeSocket != 0:
+		return fuse.DT_Socket
+	case mode&os.ModeCharDevice != 0:
+		return fuse.DT_Char
+	case mode&os.ModeDevice != 0:
+		return fuse.DT_Block
+	}
+	return fuse.DT_File
+}
+
+// ---------------------------------------------------------------------------
+
+// 调用者须持有 p.mutex。
+
+func (p *Service) getNode(ino uint64) (n *node, err error) {
+
+	n, ok := p.nodes[ino]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return n, nil
+}
+
+func (p *Service) getDir(ino uint64) (n *node, err error) {
+
+	n, err = p.getNode(ino)
+	if err != nil {
+		return
+	}
+	if !n.attr.Mode.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	return
+}
+
+func (p *Service) getHandle(fh uint64) (h *handle, n *node, err error) {
+
+	h, ok := p.handles[fh]
+	if !ok {
+		return nil, nil, syscall.EBADF
+	}
+	n, err = p.getNode(h.ino)
+	return
+}
+
+func (p *Service) attrOf(n *node) Attr {
+
+	attr := n.attr
+	attr.Valid = p.attrValid
+	return attr
+}
+
+func (p *Service) entryOf(n *node) LookupResponse {
+
+	n.nlookup++
+	return LookupResponse{
+		Inode:      n.attr.Inode,
+		EntryValid: p.entryValid,
+		Attr:       p.attrOf(n),
+	}
+}
+
+func (p *Service) allocNode(mode os.FileMode, env *Env) (n *node, err error) {
+
+	if uint64(len(p.nodes)) >= p.MaxFiles {
+		return nil, syscall.ENOSPC
+	}
+	ino := p.nextIno
+	p.nextIno++
+	n = newNode(ino, mode, env.Uid, env.Gid)
+	p.nodes[ino] = n
+	return
+}
+
+func checkName(name string) error {
+
+	if name == "" || name == "." || name == ".." {
+		return syscall.EINVAL
+	}
+	if len(name) > nameLen {
+		return syscall.ENAMETOOLONG
+	}
+	return nil
+}
+
+func (p *Service) addEntry(dir *node, name string, mode os.FileMode, env *Env) (n *node, err error) {
+
+	if err = checkName(name); err != nil {
+		return
+	}
+	if _, ok := dir.entries[name]; ok {
+		return nil, syscall.EEXIST
+	}
+	n, err = p.allocNode(mode, env)
+	if err != nil {
+		return
+	}
+	if mode.IsDir() {
+		n.parent = dir.attr.Inode
+		n.attr.Nlink = 2
+		dir.attr.Nlink++
+	}
+	dir.entries[name] = n.attr.Inode
+	dir.attr.Mtime = n.attr.Ctime
+	dir.attr.Ctime = n.attr.Ctime
+	return
+}
+
+// tryFree 在节点不再被任何目录项、内核引用及 handle 使用时释放它。
+//
+func (p *Service) tryFree(n *node) {
+
+	if n.attr.Inode == rootIno || n.attr.Nlink > 0 || n.nlookup > 0 || n.nopen > 0 {
+		return
+	}
+	delete(p.nodes, n.attr.Inode)
+}
+
+// unlink 删除 dir 中的目录项 name，对应节点为 n。
+//
+func (p *Service) unlink(dir *node, name string, n *node) {
+
+	delete(dir.entries, name)
+	t := now()
+	dir.attr.Mtime, dir.attr.Ctime = t, t
+	n.attr.Ctime = t
+	if n.attr.Mode.IsDir() {
+		n.attr.Nlink = 0
+		dir.attr.Nlink--
+	} else {
+		n.attr.Nlink--
+	}
+	p.tryFree(n)
+}
+
+// isAncestor 判断目录 a 是否为目录 b 自身或其祖先。
+//
+func (p *Service) isAncestor(a, b uint64) bool {
+
+	for {
+		if a == b {
+			return true
+		}
+		if b == rootIno {
+			return false
+		}
+		n, ok := p.nodes[b]
+		if !ok {
+			return false
+		}
+		b = n.parent
+	}
+}
+
+// ---------------------------------------------------------------------------
+
+func (p *Service) PostAccess(args *AccessRequest, env *Env) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.getNode(args.Inode)
+	if err != nil {
+		return
+	}
+	if env.Uid == 0 {
+		return nil
+	}
+	perm := uint32(n.attr.Mode.Perm())
+	switch {
+	case env.Uid == n.attr.Uid:
+		perm >>= 6
+	case env.Gid == n.attr.Gid:
+		perm >>= 3
+	}
+	if args.Mask&^perm&7 != 0 {
+		return syscall.EACCES
+	}
+	return nil
+}
+
+func (p *Service) PostGetattr(args *GetattrRequest, env *Env) (ret *GetattrResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.getNode(args.Inode)
+	if err != nil {
+		return
+	}
+	return &GetattrResponse{Attr: p.attrOf(n)}, nil
+}
+
+func (p *Service) PostSetattr(args *SetattrRequest, env *Env) (ret *SetattrResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var n *node
+	if args.Valid.Handle() {
+		_, n, err = p.getHandle(args.Handle)
+	} else {
+		n, err = p.getNode(args.Inode)
+	}
+	if err != nil {
+		return
+	}
+
+	valid := args.Valid
+	if valid.Size() {
+		if n.attr.Mode.IsDir() {
+			return nil, syscall.EISDIR
+		}
+		if !n.attr.Mode.IsRegular() {
+			return nil, syscall.EINVAL
+		}
+		if args.Size > p.Capacity {
+			return nil, syscall.EFBIG
+		}
+		n.setSize(args.Size)
+		n.attr.Mtime = now()
+	}
+	if valid.Mode() {
+		n.attr.Mode = n.attr.Mode&os.ModeType | args.Mode&^os.ModeType
+	}
+	if valid.Uid() {
+		n.attr.Uid = args.Uid
+	}
+	if valid.Gid() {
+		n.attr.Gid = args.Gid
+	}
+	if valid.AtimeNow() {
+		n.attr.Atime = now()
+	} else if valid.Atime() {
+		n.attr.Atime = args.Atime
+	}
+	if valid.MtimeNow() {
+		n.attr.Mtime = now()
+	} else if valid.Mtime() {
+		n.attr.Mtime = args.Mtime
+	}
+	if valid.Crtime() {
+		n.attr.Crtime = args.Crtime
+	}
+	if valid.Flags() {
+		n.attr.Flags = args.Flags
+	}
+	n.attr.Ctime = now()
+	return &SetattrResponse{Attr: p.attrOf(n)}, nil
+}
+
+// ---------------------------------------------------------------------------
+
+func (p *Service) PostListxattr(args *ListxattrRequest, env *Env) (ret *ListxattrResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.getNode(args.Inode)
+	if err != nil {
+		return
+	}
+	names := make([]string, 0, len(n.xattrs))
+	for name := range n.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b []byte
+	for _, name := range names {
+		b = append(b, name...)
+		b = append(b, 0)
+	}
+	if args.Size != 0 && uint32(len(b)) > args.Size {
+		return nil, syscall.ERANGE
+	}
+	return &ListxattrResponse{XattrNames: b}, nil
+}
+
+func (p *Service) PostGetxattr(args *GetxattrRequest, env *Env) (ret *GetxattrResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.getNode(args.Inode)
+	if err != nil {
+		return
+	}
+	v, ok := n.xattrs[args.Name]
+	if !ok {
+		return nil, syscall.ENODATA
+	}
+	if args.Size != 0 && uint32(len(v)) > args.Size {
+		return nil, syscall.ERANGE
+	}
+	return &GetxattrResponse{Xattr: v}, nil
+}
+
+func (p *Service) PostSetxattr(args *SetxattrRequest, env *Env) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.getNode(args.Inode)
+	if err != nil {
+		return
+	}
+	_, ok := n.xattrs[args.Name]
+	if ok && args.Flags&xattrCreate != 0 {
+		return syscall.EEXIST
+	}
+	if !ok && args.Flags&xattrReplace != 0 {
+		return syscall.ENODATA
+	}
+	if n.xattrs == nil {
+		n.xattrs = make(map[string][]byte)
+	}
+	n.xattrs[args.Name] = append([]byte(nil), args.Xattr...)
+	n.attr.Ctime = now()
+	return nil
+}
+
+func (p *Service) PostRemovexattr(args *RemovexattrRequest, env *Env) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.getNode(args.Inode)
+	if err != nil {
+		return
+	}
+	if _, ok := n.xattrs[args.Name]; !ok {
+		return syscall.ENODATA
+	}
+	delete(n.xattrs, args.Name)
+	n.attr.Ctime = now()
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+
+func (p *Service) PostLookup(args *LookupRequest, env *Env) (ret *LookupResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dir, err := p.getDir(args.Inode)
+	if err != nil {
+		return
+	}
+	var ino uint64
+	switch args.Name {
+	case ".":
+		ino = dir.attr.Inode
+	case "..":
+		ino = dir.parent
+	default:
+		var ok bool
+		if ino, ok = dir.entries[args.Name]; !ok {
+			return nil, syscall.ENOENT
+		}
+	}
+	n, err := p.getNode(ino)
+	if err != nil {
+		return
+	}
+	entry := p.entryOf(n)
+	return &entry, nil
+}
+
+func (p *Service) PostForget(args *ForgetRequest, env *Env) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, ok := p.nodes[args.Inode]
+	if !ok {
+		return nil
+	}
+	if args.LookupReqid >= n.nlookup {
+		n.nlookup = 0
+	} else {
+		n.nlookup -= args.LookupReqid
+	}
+	p.tryFree(n)
+	return nil
+}
+
+func (p *Service) PostMkdir(args *MkdirRequest, env *Env) (ret *MkdirResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dir, err := p.getDir(args.Inode)
+	if err != nil {
+		return
+	}
+	n, err := p.addEntry(dir, args.Name, os.ModeDir|args.Mode.Perm(), env)
+	if err != nil {
+		return
+	}
+	entry := MkdirResponse(p.entryOf(n))
+	return &entry, nil
+}
+
+func (p *Service) PostSymlink(args *SymlinkRequest, env *Env) (ret *SymlinkResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dir, err := p.getDir(args.Inode)
+	if err != nil {
+		return
+	}
+	n, err := p.addEntry(dir, args.NewName, os.ModeSymlink|0777, env)
+	if err != nil {
+		return
+	}
+	n.target = args.Target
+	n.attr.Size = uint64(len(args.Target))
+	entry := SymlinkResponse(p.entryOf(n))
+	return &entry, nil
+}
+
+func (p *Service) PostReadlink(args *ReadlinkRequest, env *Env) (ret *ReadlinkResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.getNode(args.Inode)
+	if err != nil {
+		return
+	}
+	if n.attr.Mode&os.ModeSymlink == 0 {
+		return nil, syscall.EINVAL
+	}
+	return &ReadlinkResponse{Target: n.target}, nil
+}
+
+func (p *Service) PostMknod(args *MknodRequest, env *Env) (ret *MknodResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if args.Mode.IsDir() || args.Mode&os.ModeSymlink != 0 {
+		return nil, syscall.EINVAL
+	}
+	dir, err := p.getDir(args.Inode)
+	if err != nil {
+		return
+	}
+	n, err := p.addEntry(dir, args.Name, args.Mode, env)
+	if err != nil {
+		return
+	}
+	n.attr.Rdev = args.Rdev
+	entry := MknodResponse(p.entryOf(n))
+	return &entry, nil
+}
+
+func (p *Service) PostLink(args *LinkRequest, env *Env) (ret *LinkResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dir, err := p.getDir(args.Inode)
+	if err != nil {
+		return
+	}
+	n, err := p.getNode(args.OldInode)
+	if err != nil {
+		return
+	}
+	if n.attr.Mode.IsDir() {
+		return nil, syscall.EPERM
+	}
+	if err = checkName(args.NewName); err != nil {
+		return
+	}
+	if _, ok := dir.entries[args.NewName]; ok {
+		return nil, syscall.EEXIST
+	}
+	dir.entries[args.NewName] = n.attr.Inode
+	t := now()
+	dir.attr.Mtime, dir.attr.Ctime = t, t
+	n.attr.Nlink++
+	n.attr.Ctime = t
+	entry := LinkResponse(p.entryOf(n))
+	return &entry, nil
+}
+
+func (p *Service) PostRename(args *RenameRequest, env *Env) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	olddir, err := p.getDir(args.Inode)
+	if err != nil {
+		return
+	}
+	newdir, err := p.getDir(args.NewDirInode)
+	if err != nil {
+		return
+	}
+	if err = checkName(args.NewName); err != nil {
+		return
+	}
+	ino, ok := olddir.entries[args.OldName]
+	if !ok {
+		return syscall.ENOENT
+	}
+	n, err := p.getNode(ino)
+	if err != nil {
+		return
+	}
+	isDir := n.attr.Mode.IsDir()
+	if isDir && p.isAncestor(ino, newdir.attr.Inode) {
+		return syscall.EINVAL
+	}
+
+	if oldIno, ok := newdir.entries[args.NewName]; ok {
+		if oldIno == ino {
+			return nil
+		}
+		old, err := p.getNode(oldIno)
+		if err != nil {
+			return err
+		}
+		switch {
+		case old.attr.Mode.IsDir() && !isDir:
+			return syscall.EISDIR
+		case !old.attr.Mode.IsDir() && isDir:
+			return syscall.ENOTDIR
+		case old.attr.Mode.IsDir() && len(old.entries) != 0:
+			return syscall.ENOTEMPTY
+		}
+		p.unlink(newdir, args.NewName, old)
+	}
+
+	delete(olddir.entries, args.OldName)
+	newdir.entries[args.NewName] = ino
+	if isDir && olddir != newdir {
+		n.parent = newdir.attr.Inode
+		olddir.attr.Nlink--
+		newdir.attr.Nlink++
+	}
+	t := now()
+	olddir.attr.Mtime, olddir.attr.Ctime = t, t
+	newdir.attr.Mtime, newdir.attr.Ctime = t, t
+	n.attr.Ctime = t
+	return nil
+}
+
+func (p *Service) PostRemove(args *RemoveRequest, env *Env) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dir, err := p.getDir(args.Inode)
+	if err != nil {
+		return
+	}
+	ino, ok := dir.entries[args.Name]
+	if !ok {
+		return syscall.ENOENT
+	}
+	n, err := p.getNode(ino)
+	if err != nil {
+		return
+	}
+	if args.Dir {
+		if !n.attr.Mode.IsDir() {
+			return syscall.ENOTDIR
+		}
+		if len(n.entries) != 0 {
+			return syscall.ENOTEMPTY
+		}
+	} else if n.attr.Mode.IsDir() {
+		return syscall.EISDIR
+	}
+	p.unlink(dir, args.Name, n)
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+
+func (p *Service) openNode(n *node, flags fuse.OpenFlags, dir bool) (fh uint64, err error) {
+
+	if dir != n.attr.Mode.IsDir() {
+		if dir {
+			return 0, syscall.ENOTDIR
+		}
+		return 0, syscall.EISDIR
+	}
+	fh = p.nextFh
+	p.nextFh++
+	p.handles[fh] = &handle{ino: n.attr.Inode, flags: flags, dir: dir}
+	n.nopen++
+	return
+}
+
+func (p *Service) PostOpen(args *OpenRequest, env *Env) (ret *OpenResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.getNode(args.Inode)
+	if err != nil {
+		return
+	}
+	fh, err := p.openNode(n, args.Flags, args.Dir)
+	if err != nil {
+		return
+	}
+	if args.Flags&fuse.OpenTruncate != 0 && !args.Dir && !args.Flags.IsReadOnly() {
+		n.setSize(0)
+		n.attr.Mtime = now()
+		n.attr.Ctime = n.attr.Mtime
+	}
+	return &OpenResponse{Handle: fh}, nil
+}
+
+func (p *Service) PostCreate(args *CreateRequest, env *Env) (ret *CreateResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dir, err := p.getDir(args.Inode)
+	if err != nil {
+		return
+	}
+	if ino, ok := dir.entries[args.Name]; ok {
+		if args.Flags&fuse.OpenExclusive != 0 {
+			return nil, syscall.EEXIST
+		}
+		n, err := p.getNode(ino)
+		if err != nil {
+			return nil, err
+		}
+		fh, err := p.openNode(n, args.Flags, false)
+		if err != nil {
+			return nil, err
+		}
+		if args.Flags&fuse.OpenTruncate != 0 {
+			n.setSize(0)
+			n.attr.Mtime = now()
+			n.attr.Ctime = n.attr.Mtime
+		}
+		ret = &CreateResponse{LookupResponse: p.entryOf(n)}
+		ret.Handle = fh
+		return ret, nil
+	}
+
+	n, err := p.addEntry(dir, args.Name, args.Mode&^os.ModeType, env)
+	if err != nil {
+		return
+	}
+	fh, err := p.openNode(n, args.Flags, false)
+	if err != nil {
+		return
+	}
+	ret = &CreateResponse{LookupResponse: p.entryOf(n)}
+	ret.Handle = fh
+	return
+}
+
+func (p *Service) PostRelease(args *ReleaseRequest, env *Env) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	h, ok := p.handles[args.Handle]
+	if !ok {
+		return syscall.EBADF
+	}
+	delete(p.handles, args.Handle)
+	if n, ok := p.nodes[h.ino]; ok {
+		n.nopen--
+		p.tryFree(n)
+	}
+	return nil
+}
+
+func (p *Service) PostFlush(args *FlushRequest, env *Env) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, _, err = p.getHandle(args.Handle)
+	return
+}
+
+func (p *Service) PostFsync(args *FsyncRequest, env *Env) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, _, err = p.getHandle(args.Handle)
+	return
+}
+
+func (p *Service) readdir(n *node) []byte {
+
+	names := make([]string, 0, len(n.entries))
+	for name := range n.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := fuse.AppendDirent(nil, fuse.Dirent{Inode: n.attr.Inode, Type: fuse.DT_Dir, Name: "."})
+	data = fuse.AppendDirent(data, fuse.Dirent{Inode: n.parent, Type: fuse.DT_Dir, Name: ".."})
+	for _, name := range names {
+		ino := n.entries[name]
+		typ := fuse.DT_Unknown
+		if child, ok := p.nodes[ino]; ok {
+			typ = direntTypeOf(child.attr.Mode)
+		}
+		data = fuse.AppendDirent(data, fuse.Dirent{Inode: ino, Type: typ, Name: name})
+	}
+	return data
+}
+
+func sliceAt(data []byte, off int64, size int) []byte {
+
+	if off < 0 || off >= int64(len(data)) {
+		return nil
+	}
+	data = data[off:]
+	if len(data) > size {
+		data = data[:size]
+	}
+	return data
+}
+
+func (p *Service) PostRead(args *ReadRequest, env *Env) (ret *ReadResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	h, n, err := p.getHandle(args.Handle)
+	if err != nil {
+		return
+	}
+	if args.Dir != h.dir {
+		return nil, syscall.EBADF
+	}
+	if h.dir {
+		if args.Offset == 0 || h.dirents == nil {
+			h.dirents = p.readdir(n)
+		}
+		data := sliceAt(h.dirents, args.Offset, args.Size)
+		return &ReadResponse{Data: append([]byte(nil), data...)}, nil
+	}
+	if h.flags.IsWriteOnly() {
+		return nil, syscall.EBADF
+	}
+	data := n.data.readAt(args.Offset, args.Size)
+	n.attr.Atime = now()
+	return &ReadResponse{Data: data}, nil
+}
+
+func (p *Service) PostWrite(args *WriteRequest, env *Env) (ret *WriteResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	h, n, err := p.getHandle(args.Handle)
+	if err != nil {
+		return
+	}
+	if h.dir || h.flags.IsReadOnly() {
+		return nil, syscall.EBADF
+	}
+	if args.Offset < 0 {
+		return nil, syscall.EINVAL
+	}
+	off := args.Offset
+	if h.flags&fuse.OpenAppend != 0 {
+		off = int64(n.data.size)
+	}
+	end := uint64(off) + uint64(len(args.Data))
+	if end > p.Capacity {
+		return nil, syscall.EFBIG
+	}
+	n.data.writeAt(uint64(off), args.Data)
+	if end > n.attr.Size {
+		n.setSize(end)
+	}
+	t := now()
+	n.attr.Mtime, n.attr.Ctime = t, t
+	return &WriteResponse{Size: len(args.Data)}, nil
+}
+
+// ---------------------------------------------------------------------------
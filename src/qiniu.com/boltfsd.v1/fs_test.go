@@ -0,0 +1,275 @@
+package boltfsd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"qiniupkg.com/x/rpc.v7"
+	"qiniupkg.com/x/rpc.v7/gob"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+// identityTransport 同 qfusegate 发往服务端的请求一样带上调用者身份与 X-Reqid。
+//
+type identityTransport struct {
+	reqid uint64
+}
+
+func (p *identityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	req.Header.Set("Authorization", LegacyScheme+EncodeIdentity(1000, 1000, 1))
+	req.Header.Set("X-Reqid", strconv.FormatUint(atomic.AddUint64(&p.reqid, 1), 36))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+type testClient struct {
+	t      *testing.T
+	host   string
+	client gob.Client
+}
+
+func newTestClient(t *testing.T, cfg *Config) (c *testClient, close func()) {
+
+	svc, err := New(cfg)
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	ts := httptest.NewServer(svc)
+	c = &testClient{
+		t:      t,
+		host:   ts.URL,
+		client: gob.Client{rpc.Client{&http.Client{Transport: new(identityTransport)}}},
+	}
+	return c, ts.Close
+}
+
+func (c *testClient) call(op string, args, ret interface{}) error {
+
+	return c.client.CallWithGob(context.Background(), ret, "POST", c.host+"/v1/"+op, args)
+}
+
+func (c *testClient) mustCall(op string, args, ret interface{}) {
+
+	if err := c.call(op, args, ret); err != nil {
+		c.t.Fatal(op, args, err)
+	}
+}
+
+func errnoOf(err error) syscall.Errno {
+
+	if e, ok := err.(*rpc.ErrorInfo); ok {
+		return syscall.Errno(e.Errno)
+	}
+	return 0
+}
+
+// ---------------------------------------------------------------------------
+
+func TestLookupCreate(t *testing.T) {
+
+	c, close := newTestClient(t, &Config{})
+	defer close()
+
+	err := c.call("lookup", &LookupRequest{Inode: rootIno, Name: "a"}, new(LookupResponse))
+	if errnoOf(err) != syscall.ENOENT {
+		t.Fatal("lookup missing:", err)
+	}
+
+	var cr CreateResponse
+	c.mustCall("create", &CreateRequest{Inode: rootIno, Flags: fuse.OpenReadWrite, Mode: 0644, Name: "a"}, &cr)
+	if cr.Attr.Uid != 1000 || cr.Attr.Gid != 1000 || !cr.Attr.Mode.IsRegular() {
+		t.Fatal("create attr:", cr.Attr)
+	}
+
+	var lr LookupResponse
+	c.mustCall("lookup", &LookupRequest{Inode: rootIno, Name: "a"}, &lr)
+	if lr.Inode != cr.Inode {
+		t.Fatal("lookup:", lr.Inode, cr.Inode)
+	}
+
+	err = c.call("create", &CreateRequest{Inode: rootIno, Flags: fuse.OpenExclusive, Mode: 0644, Name: "a"}, new(CreateResponse))
+	if errnoOf(err) != syscall.EEXIST {
+		t.Fatal("create exclusive:", err)
+	}
+}
+
+func TestWriteReadHoles(t *testing.T) {
+
+	c, close := newTestClient(t, &Config{})
+	defer close()
+
+	var cr CreateResponse
+	c.mustCall("create", &CreateRequest{Inode: rootIno, Flags: fuse.OpenReadWrite, Mode: 0644, Name: "f"}, &cr)
+
+	const far = 3*chunkSize + 100
+	for _, w := range []WriteRequest{
+		{Handle: cr.Handle, Offset: 0, Data: []byte("hello")},
+		{Handle: cr.Handle, Offset: far, Data: []byte("world")},
+	} {
+		var wr WriteResponse
+		c.mustCall("write", &w, &wr)
+		if wr.Size != len(w.Data) {
+			t.Fatal("write size:", wr.Size)
+		}
+	}
+
+	cases := []struct {
+		off  int64
+		size int
+		want []byte
+	}{
+		{0, 5, []byte("hello")},
+		{3, 6, []byte("lo\x00\x00\x00\x00")},
+		{chunkSize, 10, make([]byte, 10)}, // 未写入的块
+		{far - 2, 100, []byte("\x00\x00world")},
+		{far + 5, 10, nil}, // EOF
+	}
+	for _, tc := range cases {
+		var rr ReadResponse
+		c.mustCall("read", &ReadRequest{Handle: cr.Handle, Offset: tc.off, Size: tc.size}, &rr)
+		if !bytes.Equal(rr.Data, tc.want) {
+			t.Fatalf("read(%d, %d): %q, want %q", tc.off, tc.size, rr.Data, tc.want)
+		}
+	}
+
+	var gr GetattrResponse
+	c.mustCall("getattr", &GetattrRequest{Inode: cr.Inode}, &gr)
+	if gr.Attr.Size != far+5 || gr.Attr.Blocks != (far+5+511)/512 {
+		t.Fatal("getattr:", gr.Attr.Size, gr.Attr.Blocks)
+	}
+
+	// 截断后再扩展，截断掉的内容读出为 0
+	c.mustCall("setattr", &SetattrRequest{Inode: cr.Inode, Valid: fuse.SetattrSize, Size: 2}, new(SetattrResponse))
+	c.mustCall("setattr", &SetattrRequest{Inode: cr.Inode, Valid: fuse.SetattrSize, Size: 10}, new(SetattrResponse))
+	var rr ReadResponse
+	c.mustCall("read", &ReadRequest{Handle: cr.Handle, Offset: 0, Size: 10}, &rr)
+	if !bytes.Equal(rr.Data, []byte("he\x00\x00\x00\x00\x00\x00\x00\x00")) {
+		t.Fatalf("read after truncate: %q", rr.Data)
+	}
+}
+
+func TestCreateTruncate(t *testing.T) {
+
+	c, close := newTestClient(t, &Config{})
+	defer close()
+
+	var cr CreateResponse
+	c.mustCall("create", &CreateRequest{Inode: rootIno, Flags: fuse.OpenReadWrite, Mode: 0644, Name: "f"}, &cr)
+	c.mustCall("write", &WriteRequest{Handle: cr.Handle, Data: []byte("hello")}, new(WriteResponse))
+	var sr SetattrResponse
+	c.mustCall("setattr", &SetattrRequest{Inode: cr.Inode, Valid: fuse.SetattrMtime, Mtime: 1}, &sr)
+
+	// 对已存在的文件 create 并截断，需要更新 mtime 与 ctime
+	var cr2 CreateResponse
+	c.mustCall("create", &CreateRequest{Inode: rootIno, Flags: fuse.OpenReadWrite | fuse.OpenTruncate, Mode: 0644, Name: "f"}, &cr2)
+	if cr2.Inode != cr.Inode || cr2.Attr.Size != 0 {
+		t.Fatal("create:", cr2.Inode, cr2.Attr.Size)
+	}
+	if cr2.Attr.Mtime <= 1 || cr2.Attr.Ctime < sr.Attr.Ctime || cr2.Attr.Ctime != cr2.Attr.Mtime {
+		t.Fatal("create times:", cr2.Attr.Mtime, cr2.Attr.Ctime, sr.Attr.Ctime)
+	}
+}
+
+func TestTruncateBeyondCapacity(t *testing.T) {
+
+	c, close := newTestClient(t, &Config{Capacity: 1 << 20})
+	defer close()
+
+	var cr CreateResponse
+	c.mustCall("create", &CreateRequest{Inode: rootIno, Flags: fuse.OpenReadWrite, Mode: 0644, Name: "f"}, &cr)
+
+	err := c.call("setattr", &SetattrRequest{Inode: cr.Inode, Valid: fuse.SetattrSize, Size: 100 << 30}, new(SetattrResponse))
+	if errnoOf(err) != syscall.EFBIG {
+		t.Fatal("truncate:", err)
+	}
+	err = c.call("write", &WriteRequest{Handle: cr.Handle, Offset: 1 << 20, Data: []byte("x")}, new(WriteResponse))
+	if errnoOf(err) != syscall.EFBIG {
+		t.Fatal("write:", err)
+	}
+
+	// 容量之内的大文件只占用写入的块
+	c.mustCall("setattr", &SetattrRequest{Inode: cr.Inode, Valid: fuse.SetattrSize, Size: 1 << 20}, new(SetattrResponse))
+	var gr GetattrResponse
+	c.mustCall("getattr", &GetattrRequest{Inode: cr.Inode}, &gr)
+	if gr.Attr.Size != 1<<20 {
+		t.Fatal("getattr:", gr.Attr.Size)
+	}
+}
+
+func TestRename(t *testing.T) {
+
+	c, close := newTestClient(t, &Config{})
+	defer close()
+
+	var dir MkdirResponse
+	c.mustCall("mkdir", &MkdirRequest{Inode: rootIno, Mode: os.ModeDir | 0755, Name: "d"}, &dir)
+	var cr CreateResponse
+	c.mustCall("create", &CreateRequest{Inode: rootIno, Flags: fuse.OpenReadWrite, Mode: 0644, Name: "a"}, &cr)
+
+	c.mustCall("rename", &RenameRequest{Inode: rootIno, NewDirInode: dir.Inode, OldName: "a", NewName: "b"}, nil)
+
+	err := c.call("lookup", &LookupRequest{Inode: rootIno, Name: "a"}, new(LookupResponse))
+	if errnoOf(err) != syscall.ENOENT {
+		t.Fatal("lookup old name:", err)
+	}
+	var lr LookupResponse
+	c.mustCall("lookup", &LookupRequest{Inode: dir.Inode, Name: "b"}, &lr)
+	if lr.Inode != cr.Inode {
+		t.Fatal("lookup new name:", lr.Inode, cr.Inode)
+	}
+
+	err = c.call("rename", &RenameRequest{Inode: rootIno, NewDirInode: dir.Inode, OldName: "a", NewName: "c"}, nil)
+	if errnoOf(err) != syscall.ENOENT {
+		t.Fatal("rename missing:", err)
+	}
+}
+
+func TestRemoveErrno(t *testing.T) {
+
+	c, close := newTestClient(t, &Config{})
+	defer close()
+
+	var dir MkdirResponse
+	c.mustCall("mkdir", &MkdirRequest{Inode: rootIno, Mode: os.ModeDir | 0755, Name: "d"}, &dir)
+	c.mustCall("create", &CreateRequest{Inode: dir.Inode, Flags: fuse.OpenReadWrite, Mode: 0644, Name: "f"}, new(CreateResponse))
+
+	cases := []struct {
+		req   RemoveRequest
+		errno syscall.Errno
+	}{
+		{RemoveRequest{Inode: rootIno, Name: "none"}, syscall.ENOENT},
+		{RemoveRequest{Inode: rootIno, Name: "d"}, syscall.EISDIR},
+		{RemoveRequest{Inode: dir.Inode, Name: "f", Dir: true}, syscall.ENOTDIR},
+		{RemoveRequest{Inode: rootIno, Name: "d", Dir: true}, syscall.ENOTEMPTY},
+		{RemoveRequest{Inode: dir.Inode, Name: "f"}, 0},
+		{RemoveRequest{Inode: rootIno, Name: "d", Dir: true}, 0},
+	}
+	for _, tc := range cases {
+		err := c.call("remove", &tc.req, nil)
+		if tc.errno == 0 {
+			if err != nil {
+				t.Fatal("remove:", tc.req, err)
+			}
+			continue
+		}
+		if errnoOf(err) != tc.errno {
+			t.Fatal("remove:", tc.req, err, "want", tc.errno)
+		}
+		if e := err.(*rpc.ErrorInfo); e.Code != httpCodeOf(tc.errno) {
+			t.Fatal("remove http code:", tc.req, e.Code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,243 @@
+package boltfsd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"qiniu.com/peercred.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+// Env carries the caller identity of a QBolt request:
+//
+//	Authorization: QBolt base64(<Uid/Gid/Pid:uint32>)
+//	X-Reqid: <Prefix>.base36(<Reqid:uint64>)
+//
+// or, for signed requests (see authenticate):
+//
+//	Authorization: QBolt-HMAC-SHA256 <KeyId>:<Signature>
+//	X-Qbolt-Identity: base64(<Uid/Gid/Pid:uint32>)
+//	X-Qbolt-Date: <UnixSeconds>
+//	X-Reqid: <Prefix>.base36(<Reqid:uint64>)
+//
+type Env struct {
+	Uid   uint32
+	Gid   uint32
+	Pid   uint32
+	Reqid string
+
+	// 经 unix socket 访问时为对端(qfusegate)进程的身份，否则为 nil。
+	//
+	Peer *peercred.Cred
+
+	W   http.ResponseWriter
+	Req *http.Request
+}
+
+// ---------------------------------------------------------------------------
+
+// A route binds /v1/<name> to a Service method PostXxx, in the style of
+// restrpc. Accepted method signatures are:
+//
+//	func (p *Service) PostXxx(args *XxxRequest, env *Env) (ret *XxxResponse, err error)
+//	func (p *Service) PostXxx(args *XxxRequest, env *Env) (err error)
+//	func (p *Service) PostXxx(env *Env) (ret *XxxResponse, err error)
+//	func (p *Service) PostXxx(env *Env) (err error)
+//
+type route struct {
+	method reflect.Value
+	args   reflect.Type // nil if the request has no body
+}
+
+var (
+	typeOfEnv   = reflect.TypeOf((*Env)(nil))
+	typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+func routesOf(rcvr interface{}) map[string]*route {
+
+	routes := make(map[string]*route)
+
+	v := reflect.ValueOf(rcvr)
+	t := v.Type()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !strings.HasPrefix(m.Name, "Post") {
+			continue
+		}
+		mt := m.Type
+		nin, nout := mt.NumIn(), mt.NumOut()
+		if nin < 2 || nin > 3 || mt.In(nin-1) != typeOfEnv {
+			continue
+		}
+		if nout < 1 || nout > 2 || mt.Out(nout-1) != typeOfError {
+			continue
+		}
+		r := &route{method: v.Method(i)}
+		if nin == 3 {
+			if mt.In(1).Kind() != reflect.Ptr {
+				continue
+			}
+			r.args = mt.In(1).Elem()
+		}
+		routes["/v1/"+strings.ToLower(m.Name[4:])] = r
+	}
+	return routes
+}
+
+// ---------------------------------------------------------------------------
+
+func (p *Service) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	r, ok := p.routes[req.URL.Path]
+	if !ok {
+		replyError(w, http.StatusNotFound, syscall.ENOSYS)
+		return
+	}
+	if req.Method != "POST" {
+		replyError(w, http.StatusMethodNotAllowed, syscall.EINVAL)
+		return
+	}
+
+	peer, _ := peercred.FromRequest(req)
+	if !p.allowPeer(peer) {
+		replyError(w, http.StatusForbidden, syscall.EACCES)
+		return
+	}
+
+	uid, gid, pid, ok := p.authenticate(req)
+	if !ok {
+		replyError(w, http.StatusUnauthorized, syscall.EACCES)
+		return
+	}
+	env := &Env{
+		Uid: uid, Gid: gid, Pid: pid,
+		Reqid: req.Header.Get("X-Reqid"),
+		Peer:  peer,
+		W:     w,
+		Req:   req,
+	}
+	if env.Reqid != "" {
+		w.Header().Set("X-Reqid", env.Reqid)
+	}
+
+	p.dedup(w, req, env, func(w http.ResponseWriter) {
+		r.serve(w, req, env)
+	})
+}
+
+func (r *route) serve(w http.ResponseWriter, req *http.Request, env *Env) {
+
+	in := make([]reflect.Value, 0, 2)
+	if r.args != nil {
+		args := reflect.New(r.args)
+		err := gob.NewDecoder(req.Body).Decode(args.Interface())
+		if err != nil {
+			replyError(w, http.StatusBadRequest, syscall.EINVAL)
+			return
+		}
+		in = append(in, args)
+	}
+	in = append(in, reflect.ValueOf(env))
+
+	out := r.method.Call(in)
+	if err, _ := out[len(out)-1].Interface().(error); err != nil {
+		replyError(w, httpCodeOf(err), err)
+		return
+	}
+	if len(out) == 1 {
+		w.WriteHeader(200)
+		return
+	}
+	replyGob(w, out[0].Interface())
+}
+
+// allowPeer 检查对端身份。配置了 PeerUids 时，只接受经 unix socket 访问且 uid 在其中的对端。
+//
+func (p *Service) allowPeer(peer *peercred.Cred) bool {
+
+	if len(p.PeerUids) == 0 {
+		return true
+	}
+	if peer == nil {
+		return false
+	}
+	for _, uid := range p.PeerUids {
+		if peer.Uid == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func replyGob(w http.ResponseWriter, ret interface{}) {
+
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(ret)
+	if err != nil {
+		replyError(w, http.StatusInternalServerError, syscall.EIO)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/gob")
+	h.Set("Content-Length", strconv.Itoa(b.Len()))
+	w.WriteHeader(200)
+	w.Write(b.Bytes())
+}
+
+// ---------------------------------------------------------------------------
+
+type errorRet struct {
+	Err   string `json:"error"`
+	Errno int    `json:"errno"`
+}
+
+// replyError 按 QBOLT 协议返回出错包：
+//
+//	X-Err: <ErrorMessage>
+//	X-Errno: <Errno>
+//
+// 同时以 {"error": <ErrorMessage>, "errno": <Errno>} 作为包体，以便 rpc.ErrorInfo 取到 Errno。
+//
+func replyError(w http.ResponseWriter, code int, err error) {
+
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		errno = syscall.EIO
+	}
+	msg := err.Error()
+	b, _ := json.Marshal(&errorRet{Err: msg, Errno: int(errno)})
+
+	h := w.Header()
+	h.Set("X-Err", msg)
+	h.Set("X-Errno", strconv.Itoa(int(errno)))
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func httpCodeOf(err error) int {
+
+	switch err {
+	case syscall.ENOENT, syscall.ENODATA:
+		return http.StatusNotFound
+	case syscall.EEXIST, syscall.ENOTEMPTY:
+		return http.StatusConflict
+	case syscall.EACCES, syscall.EPERM:
+		return http.StatusForbidden
+	}
+	if _, ok := err.(syscall.Errno); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,173 @@
+package boltfsd
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+type Config struct {
+	// 容量(字节)，用于 statfs 返回，也是单个文件大小的上限。为 0 表示使用 DefaultCapacity。
+	//
+	Capacity uint64 `json:"capacity"`
+
+	// 最大文件数，仅用于 statfs 返回。为 0 表示使用 DefaultMaxFiles。
+	//
+	MaxFiles uint64 `json:"max_files"`
+
+	// 属性/目录项在内核中的缓存时间(毫秒)。
+	//
+	AttrValidMs  int `json:"attr_valid_ms"`
+	EntryValidMs int `json:"entry_valid_ms"`
+
+	// 不为空时只接受经 unix socket 访问、且对端进程 uid(SO_PEERCRED)在其中的请求，
+	// 用于确认对端确实是本机的 qfusegate。
+	//
+	PeerUids []uint32 `json:"peer_uids"`
+
+	// 按 X-Reqid 去重的修改请求回复缓存的条目数，0 表示 DefaultReplyCacheSize，小于 0 表示不去重。
+	// 去重时 init 的回复带有 ReqidDedupHeader，qfusegate 据此放心重试修改请求。
+	//
+	ReplyCacheSize int `json:"reply_cache_size"`
+
+	// 请求签名的密钥 KeyId => Secret(见 QBOLT.md)。不为空时只接受签名正确、且 X-Qbolt-Date 与本机时间
+	// 相差不超过 MaxSignSkewS 秒(0 表示 DefaultMaxSignSkewS)的请求。
+	//
+	SignKeys     SignKeys `json:"sign_keys"`
+	MaxSignSkewS int      `json:"max_sign_skew_s"`
+
+	// 兼容未配置签名的 qfusegate：配置了 SignKeys 时仍接受不签名的 "Authorization: QBolt" 请求。
+	//
+	AllowUnsigned int `json:"allow_unsigned"`
+}
+
+const (
+	DefaultCapacity = 1 << 40
+	DefaultMaxFiles = 1 << 20
+)
+
+const (
+	blockSize = 4096
+	maxWrite  = 128 * 1024
+	nameLen   = 255
+)
+
+// Service is a reference QBolt server keeping the whole file system in memory.
+// It implements http.Handler, so it can be served directly or via httptest.
+//
+type Service struct {
+	Config
+
+	nodes   map[uint64]*node
+	handles map[uint64]*handle
+	nextIno uint64
+	nextFh  uint64
+	mutex   sync.Mutex
+
+	routes  map[string]*route
+	replies *replyCache // nil 表示不去重
+
+	attrValid  time.Duration
+	entryValid time.Duration
+}
+
+func New(cfg *Config) (p *Service, err error) {
+
+	p = &Service{
+		Config:     *cfg,
+		nodes:      make(map[uint64]*node),
+		handles:    make(map[uint64]*handle),
+		nextIno:    rootIno + 1,
+		nextFh:     1,
+		attrValid:  time.Duration(cfg.AttrValidMs) * time.Millisecond,
+		entryValid: time.Duration(cfg.EntryValidMs) * time.Millisecond,
+	}
+	if p.Capacity == 0 {
+		p.Capacity = DefaultCapacity
+	}
+	if p.MaxFiles == 0 {
+		p.MaxFiles = DefaultMaxFiles
+	}
+
+	root := newNode(rootIno, os.ModeDir|0755, 0, 0)
+	root.parent = rootIno
+	root.attr.Nlink = 2
+	p.nodes[rootIno] = root
+
+	if p.MaxSignSkewS == 0 {
+		p.MaxSignSkewS = DefaultMaxSignSkewS
+	}
+	if p.ReplyCacheSize == 0 {
+		p.ReplyCacheSize = DefaultReplyCacheSize
+	}
+	if p.ReplyCacheSize > 0 {
+		p.replies = newReplyCache(p.ReplyCacheSize)
+	}
+
+	p.routes = routesOf(p)
+	return
+}
+
+// ---------------------------------------------------------------------------
+
+func (p *Service) PostInit(args *InitRequest, env *Env) (ret *InitResponse, err error) {
+
+	ret = &InitResponse{
+		MaxReadahead: args.MaxReadahead,
+		Flags:        args.Flags & supportedInitFlags,
+		MaxWrite:     maxWrite,
+	}
+	if p.replies != nil {
+		env.W.Header().Set(ReqidDedupHeader, "1")
+	}
+	return
+}
+
+func (p *Service) PostDestroy(env *Env) (err error) {
+
+	return nil
+}
+
+func (p *Service) PostStatfs(env *Env) (ret *StatfsResponse, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var used uint64
+	for _, n := range p.nodes {
+		used += n.attr.Blocks * 512
+	}
+	used = (used + blockSize - 1) / blockSize
+	blocks := p.Capacity / blockSize
+	bfree := uint64(0)
+	if used < blocks {
+		bfree = blocks - used
+	}
+	ffree := uint64(0)
+	if files := uint64(len(p.nodes)); files < p.MaxFiles {
+		ffree = p.MaxFiles - files
+	}
+	ret = &StatfsResponse{
+		Blocks:  blocks,
+		Bfree:   bfree,
+		Bavail:  bfree,
+		Files:   p.MaxFiles,
+		Ffree:   ffree,
+		Bsize:   blockSize,
+		Namelen: nameLen,
+		Frsize:  blockSize,
+	}
+	return
+}
+
+func (p *Service) PostInterrupt(args *InterruptRequest, env *Env) (err error) {
+
+	// 所有请求都在持锁期间同步完成，没有可以打断的服务端工作。
+	return nil
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,237 @@
+package boltfsd
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"qiniu.com/mac.v1"
+	"qiniu.com/peercred.v1"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+const DefaultReplyCacheSize = 4096
+
+// ReqidDedupHeader 出现在 /v1/init 的回复中，表示服务端按 X-Reqid 对修改请求去重。见 QBOLT.md。
+//
+const ReqidDedupHeader = "X-Qbolt-Reqid-Dedup"
+
+// readOnlyOps 重复执行不改变文件系统，不需要去重。read 的回复较大，也不适合缓存。
+// lookup 会增加 lookup 计数，重复执行会使之后的 forget 对不上，因此仍需去重。
+//
+var readOnlyOps = map[string]bool{
+	"/v1/init":      true,
+	"/v1/access":    true,
+	"/v1/getattr":   true,
+	"/v1/statfs":    true,
+	"/v1/readlink":  true,
+	"/v1/getxattr":  true,
+	"/v1/listxattr": true,
+	"/v1/read":      true,
+	"/v1/interrupt": true,
+}
+
+// reply 是一个修改请求的回复。done 关闭前请求仍在处理中，重复的请求等待其完成后重放回复。
+//
+type reply struct {
+	key    string
+	digest [sha1.Size]byte
+	elem   *list.Element
+
+	done   chan struct{}
+	code   int
+	header http.Header
+	body   []byte
+}
+
+// replyCache 是按 (qfusegate 身份, X-Reqid) 索引的回复缓存，最多保存 size 个回复，超出时淘汰最久未用的。
+//
+// FUSE 的请求 id 只在一个挂载内唯一，qfusegate 因此在 X-Reqid 中带上每次挂载随机的前缀。不带前缀的旧 qfusegate
+// 的多个挂载、或重启后的 qfusegate 可能复用 X-Reqid，因此还比较请求的 op、调用者身份与包体，不一致时视为新的请求。
+//
+type replyCache struct {
+	size    int
+	replies map[string]*reply
+	lru     *list.List
+	mutex   sync.Mutex
+}
+
+func newReplyCache(size int) *replyCache {
+
+	return &replyCache{
+		size:    size,
+		replies: make(map[string]*reply),
+		lru:     list.New(),
+	}
+}
+
+// start 查找请求的回复。dup 为 true 时 e 是首次请求的回复(可能仍在处理中)，否则 e 是新加入的回复，
+// 调用者处理完请求后须调用 finish。
+//
+func (p *replyCache) start(key string, digest [sha1.Size]byte) (e *reply, dup bool) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if e, ok := p.replies[key]; ok {
+		if e.digest == digest {
+			p.lru.MoveToFront(e.elem)
+			return e, true
+		}
+		p.remove(e)
+	}
+	e = &reply{key: key, digest: digest, done: make(chan struct{})}
+	e.elem = p.lru.PushFront(e)
+	p.replies[key] = e
+	for p.lru.Len() > p.size {
+		p.remove(p.lru.Back().Value.(*reply))
+	}
+	return e, false
+}
+
+func (p *replyCache) remove(e *reply) {
+
+	p.lru.Remove(e.elem)
+	delete(p.replies, e.key)
+}
+
+// finish 记录 rec 的回复并唤醒等待的重复请求。rec 为 nil(如处理时 panic)时从缓存中去掉该回复，
+// 等待的请求随之按新请求处理。
+//
+func (p *replyCache) finish(e *reply, rec *replyRecorder) {
+
+	if rec != nil {
+		if rec.header == nil {
+			rec.WriteHeader(200)
+		}
+		e.code, e.header, e.body = rec.code, rec.header, rec.body.Bytes()
+	} else {
+		p.mutex.Lock()
+		if p.replies[e.key] == e {
+			p.remove(e)
+		}
+		p.mutex.Unlock()
+	}
+	close(e.done)
+}
+
+// ---------------------------------------------------------------------------
+
+// replyRecorder 在写出回复的同时记录下来。
+//
+type replyRecorder struct {
+	http.ResponseWriter
+	code   int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (p *replyRecorder) WriteHeader(code int) {
+
+	if p.header != nil {
+		return
+	}
+	p.code = code
+	p.header = make(http.Header)
+	for k, v := range p.ResponseWriter.Header() {
+		p.header[k] = v
+	}
+	p.ResponseWriter.WriteHeader(code)
+}
+
+func (p *replyRecorder) Write(b []byte) (int, error) {
+
+	if p.header == nil {
+		p.WriteHeader(200)
+	}
+	p.body.Write(b)
+	return p.ResponseWriter.Write(b)
+}
+
+func (p *reply) replay(w http.ResponseWriter) {
+
+	h := w.Header()
+	for k, v := range p.header {
+		h[k] = v
+	}
+	w.WriteHeader(p.code)
+	w.Write(p.body)
+}
+
+// ---------------------------------------------------------------------------
+
+// gatewayOf 返回发出请求的 qfusegate 的身份：MAC AccessKey(如果有)，加上对端进程 pid(经 unix socket 访问时)
+// 或对端 IP。
+//
+func gatewayOf(req *http.Request, peer *peercred.Cred) string {
+
+	id, _ := mac.AccessKeyOf(req)
+	if peer != nil {
+		return id + "@pid:" + strconv.FormatUint(uint64(peer.Pid), 10)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return id + "@" + host
+}
+
+// dedup 对带 X-Reqid 的修改请求去重：重复的请求直接重放首次处理的回复；否则调用 serve 处理并记录其回复。
+//
+func (p *Service) dedup(w http.ResponseWriter, req *http.Request, env *Env, serve func(w http.ResponseWriter)) {
+
+	if p.replies == nil || env.Reqid == "" || readOnlyOps[req.URL.Path] {
+		serve(w)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, syscall.EINVAL)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	h := sha1.New()
+	h.Write([]byte(req.URL.Path + "\n" + EncodeIdentity(env.Uid, env.Gid, env.Pid) + "\n"))
+	h.Write(body)
+	var digest [sha1.Size]byte
+	copy(digest[:], h.Sum(nil))
+
+	key := gatewayOf(req, env.Peer) + "\n" + env.Reqid
+	for {
+		e, dup := p.replies.start(key, digest)
+		if !dup {
+			var rec *replyRecorder
+			defer func() {
+				p.replies.finish(e, rec)
+			}()
+			r := &replyRecorder{ResponseWriter: w}
+			env.W = r
+			serve(r)
+			rec = r
+			return
+		}
+		select {
+		case <-e.done:
+		case <-req.Context().Done():
+			return
+		}
+		if e.header != nil {
+			e.replay(w)
+			return
+		}
+		// 首次请求未能完成，作为新请求处理
+	}
+}
+
+// ---------------------------------------------------------------------------
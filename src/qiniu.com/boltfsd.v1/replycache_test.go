@@ -0,0 +1,259 @@
+package boltfsd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"qiniupkg.com/x/rpc.v7"
+	rpcgob "qiniupkg.com/x/rpc.v7/gob"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+// fixedTransport 以固定的 X-Reqid 与调用者身份发请求，模拟 qfusegate 重试同一请求。
+//
+type fixedTransport struct {
+	reqid string
+	uid   uint32
+}
+
+func (p *fixedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	req.Header.Set("Authorization", LegacyScheme+EncodeIdentity(p.uid, 1000, 1))
+	req.Header.Set("X-Reqid", p.reqid)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (c *testClient) callAs(reqid string, uid uint32, op string, args, ret interface{}) error {
+
+	client := rpcgob.Client{rpc.Client{&http.Client{Transport: &fixedTransport{reqid: reqid, uid: uid}}}}
+	return client.CallWithGob(context.Background(), ret, "POST", c.host+"/v1/"+op, args)
+}
+
+// dedupCall 直接调用 dedup，serve 代替实际的处理。
+//
+func dedupCall(p *Service, reqid, body string, serve func(w http.ResponseWriter)) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest("POST", "/v1/create", strings.NewReader(body))
+	env := &Env{Uid: 1000, Gid: 1000, Pid: 1, Reqid: reqid}
+	w := httptest.NewRecorder()
+	p.dedup(w, req, env, serve)
+	return w
+}
+
+func newDedupService(t *testing.T) *Service {
+
+	p, err := New(&Config{})
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	return p
+}
+
+// ---------------------------------------------------------------------------
+
+func TestDedupReplay(t *testing.T) {
+
+	c, close := newTestClient(t, &Config{})
+	defer close()
+
+	create := &CreateRequest{Inode: rootIno, Flags: fuse.OpenReadWrite | fuse.OpenExclusive, Mode: 0644, Name: "a"}
+	var cr1, cr2 CreateResponse
+	if err := c.callAs("r1", 1000, "create", create, &cr1); err != nil {
+		t.Fatal("create:", err)
+	}
+	// 重复的 create 重放首次的回复，而不是因 O_EXCL 返回 EEXIST 或打开新的句柄
+	if err := c.callAs("r1", 1000, "create", create, &cr2); err != nil {
+		t.Fatal("duplicate create:", err)
+	}
+	if cr1.Inode != cr2.Inode || cr1.Handle != cr2.Handle {
+		t.Fatal("duplicate create reply:", cr1, cr2)
+	}
+
+	rename := &RenameRequest{Inode: rootIno, NewDirInode: rootIno, OldName: "a", NewName: "b"}
+	for i := 0; i < 2; i++ {
+		if err := c.callAs("r2", 1000, "rename", rename, nil); err != nil {
+			t.Fatal("rename:", i, err)
+		}
+	}
+	var lr LookupResponse
+	c.mustCall("lookup", &LookupRequest{Inode: rootIno, Name: "b"}, &lr)
+	if lr.Inode != cr1.Inode {
+		t.Fatal("lookup renamed:", lr.Inode, cr1.Inode)
+	}
+}
+
+func TestDedupMismatch(t *testing.T) {
+
+	c, close := newTestClient(t, &Config{})
+	defer close()
+
+	create := func(uid uint32, name string) error {
+		args := &CreateRequest{Inode: rootIno, Flags: fuse.OpenReadWrite | fuse.OpenExclusive, Mode: 0644, Name: name}
+		return c.callAs("r1", uid, "create", args, new(CreateResponse))
+	}
+	if err := create(1000, "a"); err != nil {
+		t.Fatal("create:", err)
+	}
+	// 同一 X-Reqid、不同的包体按新请求处理
+	if err := create(1000, "b"); err != nil {
+		t.Fatal("create with another body:", err)
+	}
+	c.mustCall("lookup", &LookupRequest{Inode: rootIno, Name: "b"}, new(LookupResponse))
+
+	// 同一 X-Reqid 与包体、不同的调用者身份也按新请求处理，因此 O_EXCL 生效
+	if err := create(1001, "b"); errnoOf(err) != syscall.EEXIST {
+		t.Fatal("create as another caller:", err)
+	}
+}
+
+func TestDedupWait(t *testing.T) {
+
+	p := newDedupService(t)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		first <- dedupCall(p, "r1", "body", func(w http.ResponseWriter) {
+			close(started)
+			<-release
+			w.Write([]byte("first"))
+		})
+	}()
+	<-started
+
+	second := make(chan *httptest.ResponseRecorder)
+	go func() {
+		second <- dedupCall(p, "r1", "body", func(w http.ResponseWriter) {
+			t.Error("duplicate request should not be served")
+		})
+	}()
+	select {
+	case <-second:
+		t.Fatal("duplicate request should wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if w := <-first; w.Body.String() != "first" {
+		t.Fatal("first:", w.Body.String())
+	}
+	if w := <-second; w.Code != 200 || w.Body.String() != "first" {
+		t.Fatal("replay:", w.Code, w.Body.String())
+	}
+}
+
+func TestDedupPanic(t *testing.T) {
+
+	p := newDedupService(t)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan interface{})
+	go func() {
+		defer func() {
+			done <- recover()
+		}()
+		dedupCall(p, "r1", "body", func(w http.ResponseWriter) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	served := make(chan bool, 1)
+	second := make(chan *httptest.ResponseRecorder)
+	go func() {
+		second <- dedupCall(p, "r1", "body", func(w http.ResponseWriter) {
+			served <- true
+			w.Write([]byte("second"))
+		})
+	}()
+	time.Sleep(20 * time.Millisecond) // 让重复的请求进入等待
+
+	close(release)
+	if r := <-done; r != "boom" {
+		t.Fatal("recover:", r)
+	}
+	// 首次请求未能完成，等待的请求按新请求处理
+	if w := <-second; w.Body.String() != "second" || len(served) != 1 {
+		t.Fatal("waiter:", w.Body.String())
+	}
+}
+
+func TestReplyCacheEvict(t *testing.T) {
+
+	p := newReplyCache(2)
+	var digest [20]byte
+	start := func(key string) bool {
+		e, dup := p.start(key, digest)
+		if !dup {
+			p.finish(e, &replyRecorder{ResponseWriter: httptest.NewRecorder()})
+		}
+		return dup
+	}
+
+	start("k1")
+	start("k2")
+	if !start("k1") { // k1 变为最近使用
+		t.Fatal("k1 should be cached")
+	}
+	start("k3") // 淘汰最久未用的 k2
+	if p.lru.Len() != 2 || len(p.replies) != 2 {
+		t.Fatal("size:", p.lru.Len(), len(p.replies))
+	}
+	if _, ok := p.replies["k2"]; ok {
+		t.Fatal("k2 should be evicted")
+	}
+	if !start("k1") || !start("k3") {
+		t.Fatal("k1 and k3 should be cached")
+	}
+	if start("k2") {
+		t.Fatal("evicted k2 should be a new request")
+	}
+}
+
+func TestInitDedupHeader(t *testing.T) {
+
+	cases := []struct {
+		size int
+		want string
+	}{
+		{0, "1"},
+		{-1, ""},
+	}
+	for _, tc := range cases {
+		svc, err := New(&Config{ReplyCacheSize: tc.size})
+		if err != nil {
+			t.Fatal("New:", err)
+		}
+		ts := httptest.NewServer(svc)
+
+		var body bytes.Buffer
+		gob.NewEncoder(&body).Encode(&InitRequest{Major: 7, Minor: 12})
+		req, _ := http.NewRequest("POST", ts.URL+"/v1/init", &body)
+		req.Header.Set("Authorization", LegacyScheme+EncodeIdentity(0, 0, 1))
+		req.Header.Set("Content-Type", "application/gob")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("init:", err)
+		}
+		resp.Body.Close()
+		ts.Close()
+		if resp.StatusCode != 200 || resp.Header.Get(ReqidDedupHeader) != tc.want {
+			t.Fatal("init:", tc.size, resp.StatusCode, resp.Header)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
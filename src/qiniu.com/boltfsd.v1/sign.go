@@ -0,0 +1,94 @@
+package boltfsd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+const DefaultMaxSignSkewS = 300
+
+// SignKeys 是签名密钥 KeyId => Secret。打印时只输出 KeyId，以免密钥随配置进入日志。
+//
+type SignKeys map[string]string
+
+func (p SignKeys) String() string {
+
+	keyIds := make([]string, 0, len(p))
+	for keyId := range p {
+		keyIds = append(keyIds, keyId+":***")
+	}
+	sort.Strings(keyIds)
+	return "map[" + strings.Join(keyIds, " ") + "]"
+}
+
+// authenticate 校验请求的签名并返回调用者身份。未配置 SignKeys 时接受旧的不签名格式；
+// 配置了 SignKeys 时只有 AllowUnsigned 不为 0 才接受。签名请求的 KeyId 必须在 SignKeys 中。
+//
+func (p *Service) authenticate(req *http.Request) (uid, gid, pid uint32, ok bool) {
+
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, LegacyScheme) {
+		if len(p.SignKeys) != 0 && p.AllowUnsigned == 0 {
+			return
+		}
+		return DecodeIdentity(auth[len(LegacyScheme):])
+	}
+	if !strings.HasPrefix(auth, SignScheme) {
+		return
+	}
+
+	keyId, sig := auth[len(SignScheme):], ""
+	if pos := strings.IndexByte(keyId, ':'); pos >= 0 {
+		keyId, sig = keyId[:pos], keyId[pos+1:]
+	}
+	secret, exists := p.SignKeys[keyId]
+	if !exists || sig == "" {
+		return
+	}
+
+	date := req.Header.Get(SignDateHeader)
+	t, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return
+	}
+	skew := time.Since(time.Unix(t, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > time.Duration(p.MaxSignSkewS)*time.Second {
+		return
+	}
+
+	var bodyHash [sha256.Size]byte
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		bodyHash = sha256.Sum256(body)
+	} else {
+		bodyHash = sha256.Sum256(nil)
+	}
+
+	identity := req.Header.Get(IdentityHeader)
+	reqid := req.Header.Get("X-Reqid")
+	expected := Sign([]byte(secret), StringToSign(req.Method, req.URL.Path, reqid, identity, date, bodyHash[:]))
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return
+	}
+	return DecodeIdentity(identity)
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,343 @@
+package mac
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+
+var testMac = &Mac{AccessKey: "ak", SecretKey: []byte("sk")}
+
+func newTestVerifier(now time.Time) *Verifier {
+
+	v := New(&Config{Keys: map[string]string{"ak": "sk"}}, nil)
+	v.now = func() time.Time { return now }
+	return v
+}
+
+func newSignedRequest(t *testing.T, body string, now time.Time) *http.Request {
+
+	req, err := http.NewRequest("POST", "http://127.0.0.1:7779/v1/volumes?x=1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token, err := testMac.SignRequest(req, "Authorization", now)
+	if err != nil {
+		t.Fatal("SignRequest:", err)
+	}
+	req.Header.Set("Authorization", TokenPrefix+token)
+	return req
+}
+
+func cloneRequest(req *http.Request, body string) *http.Request {
+
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.Header = make(http.Header)
+	for k, v := range req.Header {
+		req2.Header[k] = v
+	}
+	req2.Body = ioutil.NopCloser(strings.NewReader(body))
+	return req2
+}
+
+func TestVerify(t *testing.T) {
+
+	now := time.Now()
+	v := newTestVerifier(now)
+
+	req := newSignedRequest(t, `{"title":"a"}`, now)
+	ak, err := v.Verify(req)
+	if err != nil || ak != "ak" {
+		t.Fatal("Verify:", ak, err)
+	}
+	b, _ := ioutil.ReadAll(req.Body)
+	if string(b) != `{"title":"a"}` {
+		t.Fatal("body not restored:", string(b))
+	}
+}
+
+func TestReplay(t *testing.T) {
+
+	now := time.Now()
+	v := newTestVerifier(now)
+
+	req := newSignedRequest(t, `{"title":"a"}`, now)
+	replayed := cloneRequest(req, `{"title":"a"}`)
+
+	if _, err := v.Verify(req); err != nil {
+		t.Fatal("Verify:", err)
+	}
+	if _, err := v.Verify(replayed); err != ErrReplayed {
+		t.Fatal("Verify replayed:", err)
+	}
+
+	// 窗口过去后签名已过期，仍然因时间偏差被拒绝
+	v.now = func() time.Time { return now.Add(DefaultMaxSkew + time.Second) }
+	if _, err := v.Verify(cloneRequest(req, `{"title":"a"}`)); err != ErrClockSkew {
+		t.Fatal("Verify expired:", err)
+	}
+
+	// 重新签名的同样请求可以通过
+	v.now = func() time.Time { return now }
+	if _, err := v.Verify(newSignedRequest(t, `{"title":"a"}`, now.Add(time.Second))); err != nil {
+		t.Fatal("Verify resigned:", err)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+
+	now := time.Now()
+	v := newTestVerifier(now)
+
+	cases := []struct {
+		signed time.Time
+		err    error
+	}{
+		{now.Add(-DefaultMaxSkew + time.Second), nil},
+		{now.Add(DefaultMaxSkew - time.Second), nil},
+		{now.Add(-DefaultMaxSkew - time.Second), ErrClockSkew},
+		{now.Add(DefaultMaxSkew + time.Second), ErrClockSkew},
+	}
+	for i, c := range cases {
+		_, err := v.Verify(newSignedRequest(t, "{}", c.signed))
+		if err != c.err {
+			t.Fatal("case", i, "Verify:", err)
+		}
+	}
+
+	// 去掉 X-Qiniu-Date 的请求被拒绝；即使接受不带时间的 token，签名也随之失效
+	req := newSignedRequest(t, "{}", now)
+	req.Header.Del(DateHeader)
+	if _, err := v.Verify(cloneRequest(req, "{}")); err != ErrNoDate {
+		t.Fatal("Verify with date removed:", err)
+	}
+	v.AllowNoDate = true
+	if _, err := v.Verify(cloneRequest(req, "{}")); err != ErrBadSignature {
+		t.Fatal("Verify with date removed when allowed:", err)
+	}
+	v.AllowNoDate = false
+
+	// 修改 X-Qiniu-Date 会使签名失效
+	req = newSignedRequest(t, "{}", now.Add(-time.Hour))
+	req.Header.Set(DateHeader, now.UTC().Format(DateFormat))
+	if _, err := v.Verify(req); err != ErrBadSignature {
+		t.Fatal("Verify with forged date:", err)
+	}
+}
+
+// sdkToken 按七牛 SDK 的算法独立计算 token，用于校验 signingString 与之兼容：
+// 包体只在 Content-Type 不为空且不是 application/octet-stream 时参与签名。
+//
+func sdkToken(ak, sk string, req *http.Request, body []byte) string {
+
+	u := req.URL
+	s := req.Method + " " + u.Path
+	if u.RawQuery != "" {
+		s += "?" + u.RawQuery
+	}
+	host := req.Host
+	if host == "" {
+		host = u.Host
+	}
+	s += "\nHost: " + host
+	ct := req.Header.Get("Content-Type")
+	if ct != "" {
+		s += "\nContent-Type: " + ct
+	}
+	var keys []string
+	for k := range req.Header {
+		if strings.HasPrefix(k, "X-Qiniu-") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s += "\n" + k + ": " + req.Header.Get(k)
+	}
+	s += "\n\n"
+	if len(body) > 0 && ct != "" && ct != "application/octet-stream" {
+		s += string(body)
+	}
+
+	h := hmac.New(sha1.New, []byte(sk))
+	h.Write([]byte(s))
+	return ak + ":" + base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// newSDKRequest 同标准的七牛 SDK 一样签名，不带 X-Qiniu-Date 与 X-Qiniu-Nonce。
+//
+func newSDKRequest(t *testing.T, contentType, body string) *http.Request {
+
+	req, err := http.NewRequest("POST", "http://127.0.0.1:7779/v1/volumes?x=1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("X-Qiniu-Meta", "m")
+	req.Header.Set("Authorization", TokenPrefix+sdkToken("ak", "sk", req, []byte(body)))
+	return req
+}
+
+func TestSDKToken(t *testing.T) {
+
+	v := newTestVerifier(time.Now())
+	v.AllowNoDate = true
+
+	cases := []struct {
+		contentType string
+		bodySigned  bool
+	}{
+		{"application/json", true},
+		{"application/gob", true},
+		{"application/octet-stream", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		req := newSDKRequest(t, tc.contentType, `{"title":"a"}`)
+		if ak, err := v.Verify(cloneRequest(req, `{"title":"a"}`)); err != nil || ak != "ak" {
+			t.Fatal("Verify SDK token:", tc.contentType, ak, err)
+		}
+		// 包体不参与签名时，改动包体不影响校验
+		_, err := v.Verify(cloneRequest(req, `{"title":"b"}`))
+		if tc.bodySigned && err != ErrBadSignature || !tc.bodySigned && err != nil {
+			t.Fatal("Verify SDK token with another body:", tc.contentType, err)
+		}
+	}
+}
+
+func TestUnsignedBody(t *testing.T) {
+
+	v := newTestVerifier(time.Now())
+	v.AllowNoDate = true
+	v.MaxBodySize = 4
+
+	// 不参与签名的包体不受 MaxBodySize 限制，也不被读取
+	req := newSDKRequest(t, "application/octet-stream", "0123456789")
+	if _, err := v.Verify(req); err != nil {
+		t.Fatal("Verify octet-stream:", err)
+	}
+	b, _ := ioutil.ReadAll(req.Body)
+	if string(b) != "0123456789" {
+		t.Fatal("body:", string(b))
+	}
+
+	req = newSDKRequest(t, "application/json", "0123456789")
+	if _, err := v.Verify(req); err != ErrBodyTooLarge {
+		t.Fatal("Verify large json:", err)
+	}
+}
+
+func TestWithoutDate(t *testing.T) {
+
+	now := time.Now()
+	v := newTestVerifier(now)
+
+	// 默认拒绝不带时间的 token
+	req := newSDKRequest(t, "application/json", `{"title":"a"}`)
+	if _, err := v.Verify(cloneRequest(req, `{"title":"a"}`)); err != ErrNoDate {
+		t.Fatal("Verify without date:", err)
+	}
+
+	// 兼容七牛 SDK 时接受，但不做时间与重放检查
+	v = New(&Config{Keys: map[string]string{"ak": "sk"}, AllowNoDate: 1}, nil)
+	for i := 0; i < 2; i++ {
+		if ak, err := v.Verify(cloneRequest(req, `{"title":"a"}`)); err != nil || ak != "ak" {
+			t.Fatal("Verify without date when allowed:", i, ak, err)
+		}
+	}
+	if len(v.seen) != 0 {
+		t.Fatal("signature without date recorded:", v.seen)
+	}
+	if _, err := v.Verify(cloneRequest(req, `{"title":"b"}`)); err != ErrBadSignature {
+		t.Fatal("Verify tampered without date:", err)
+	}
+	if _, err := v.Verify(newSignedRequest(t, "{}", now)); err != nil {
+		t.Fatal("Verify with date when allowed:", err)
+	}
+}
+
+func TestTampered(t *testing.T) {
+
+	now := time.Now()
+	v := newTestVerifier(now)
+
+	req := newSignedRequest(t, `{"size":1}`, now)
+	if _, err := v.Verify(cloneRequest(req, `{"size":2}`)); err != ErrBadSignature {
+		t.Fatal("Verify tampered body:", err)
+	}
+
+	req = newSignedRequest(t, `{"size":1}`, now)
+	req.Header.Set("Content-Type", "application/gob")
+	if _, err := v.Verify(req); err != ErrBadSignature {
+		t.Fatal("Verify tampered content-type:", err)
+	}
+
+	req = newSignedRequest(t, `{"size":1}`, now)
+	req.URL.Path = "/v1/volumes/x"
+	if _, err := v.Verify(req); err != ErrBadSignature {
+		t.Fatal("Verify tampered path:", err)
+	}
+
+	req = newSignedRequest(t, `{"size":1}`, now)
+	req.Method = "PUT"
+	if _, err := v.Verify(req); err != ErrBadSignature {
+		t.Fatal("Verify tampered method:", err)
+	}
+
+	req = newSignedRequest(t, `{"size":1}`, now)
+	req.Header.Set("Authorization", TokenPrefix+"nokey:"+strings.SplitN(req.Header.Get("Authorization"), ":", 2)[1])
+	if _, err := v.Verify(req); err != ErrNoSuchKey {
+		t.Fatal("Verify unknown key:", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+
+	v := New(&Config{Keys: map[string]string{"ak": "sk"}, Header: "X-Qiniu-Authorization"}, nil)
+	ts := httptest.NewServer(v.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ak, _ := AccessKeyOf(req)
+		b, _ := ioutil.ReadAll(req.Body)
+		w.Write([]byte(ak + " " + string(b)))
+	})))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/v1/init", "application/gob", bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 || resp.Header.Get("X-Errno") != "13" {
+		t.Fatal("unsigned request:", resp.StatusCode, resp.Header)
+	}
+
+	tr := NewTransport(testMac, nil)
+	tr.Header = "X-Qiniu-Authorization"
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 2; i++ { // 每次发送都重新签名，不会被当作重放
+		resp, err = client.Post(ts.URL+"/v1/init", "application/gob", bytes.NewReader([]byte("hello")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || string(b) != "ak hello" {
+			t.Fatal("signed request:", i, resp.StatusCode, string(b))
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,254 @@
+package mac
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrNoToken      = errors.New("mac: no token")
+	ErrBadToken     = errors.New("mac: malformed token")
+	ErrNoSuchKey    = errors.New("mac: unknown access key")
+	ErrBadSignature = errors.New("mac: signature mismatch")
+	ErrNoDate       = errors.New("mac: missing X-Qiniu-Date")
+	ErrClockSkew    = errors.New("mac: request time out of window")
+	ErrReplayed     = errors.New("mac: token replayed")
+	ErrBodyTooLarge = errors.New("mac: body too large to sign")
+)
+
+const (
+	DefaultMaxSkew     = 15 * time.Minute
+	DefaultMaxBodySize = 64 << 20
+)
+
+// ---------------------------------------------------------------------------
+
+// KeyStore 根据 AccessKey 查找 SecretKey。找不到时返回 ErrNoSuchKey。
+//
+type KeyStore interface {
+	SecretKey(accessKey string) (secretKey []byte, err error)
+}
+
+// StaticKeys 是配置文件中给出的 AccessKey => SecretKey 表。
+//
+type StaticKeys map[string]string
+
+func (p StaticKeys) SecretKey(accessKey string) (secretKey []byte, err error) {
+
+	sk, ok := p[accessKey]
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	return []byte(sk), nil
+}
+
+// ---------------------------------------------------------------------------
+
+type Config struct {
+	// AccessKey => SecretKey。仅在 New 未指定 KeyStore 时使用。
+	//
+	Keys map[string]string `json:"keys"`
+
+	// 携带 token 的头，默认为 Authorization。
+	// QBolt 协议的 Authorization 头已用于传递调用者身份，此时可配置为 X-Qiniu-Authorization。
+	//
+	Header string `json:"header"`
+
+	// 允许的 X-Qiniu-Date 与本机时间之差，0 表示 DefaultMaxSkew。
+	//
+	MaxSkewS int `json:"max_skew_s"`
+
+	// 默认拒绝没有 X-Qiniu-Date 的 token(ErrNoDate)，即只接受 SignRequest 这样带时间的签名。
+	// 不为 0 时兼容标准的七牛 SDK，接受没有 X-Qiniu-Date 的 token，但它们没有有效期、也无法做重放检查，
+	// 截获的 token 可以被无限次重放，只应在可信的网络中开启。
+	//
+	AllowNoDate int `json:"allow_no_date"`
+
+	// 参与签名的包体上限，0 表示 DefaultMaxBodySize。
+	//
+	MaxBodySize int64 `json:"max_body_size"`
+}
+
+// Verifier 校验请求的 MAC token。
+//
+// token 带有 X-Qiniu-Date 时，为防止重放，它必须落在本机时间 ±MaxSkew 之内，且窗口内同一签名只能使用一次。
+// 因此同一请求的重试须重新签名；SignRequest 每次生成新的 X-Qiniu-Nonce，Transport 每次发送都会重新签名。
+// 没有 X-Qiniu-Date 的 token(如标准的七牛 SDK 签发的)无法限定有效期，默认拒绝；AllowNoDate 为 true 时照常接受，
+// 不做上述检查。
+//
+type Verifier struct {
+	Keys        KeyStore
+	Header      string
+	MaxSkew     time.Duration
+	MaxBodySize int64
+	AllowNoDate bool
+
+	now   func() time.Time
+	seen  map[string]time.Time // signature => 过期时间
+	purge time.Time
+	mutex sync.Mutex
+}
+
+// New 创建 Verifier。keys 为 nil 时使用 cfg.Keys。
+//
+func New(cfg *Config, keys KeyStore) *Verifier {
+
+	if keys == nil {
+		keys = StaticKeys(cfg.Keys)
+	}
+	p := &Verifier{
+		Keys:        keys,
+		Header:      cfg.Header,
+		MaxSkew:     time.Duration(cfg.MaxSkewS) * time.Second,
+		MaxBodySize: cfg.MaxBodySize,
+		AllowNoDate: cfg.AllowNoDate != 0,
+		now:         time.Now,
+		seen:        make(map[string]time.Time),
+	}
+	if p.Header == "" {
+		p.Header = "Authorization"
+	}
+	if p.MaxSkew <= 0 {
+		p.MaxSkew = DefaultMaxSkew
+	}
+	if p.MaxBodySize <= 0 {
+		p.MaxBodySize = DefaultMaxBodySize
+	}
+	return p
+}
+
+// Verify 校验 req 并返回调用者的 AccessKey。校验后 req.Body 仍可读取。
+//
+func (p *Verifier) Verify(req *http.Request) (accessKey string, err error) {
+
+	auth := req.Header.Get(p.Header)
+	if auth == "" {
+		return "", ErrNoToken
+	}
+	if !strings.HasPrefix(auth, TokenPrefix) {
+		return "", ErrBadToken
+	}
+	token := auth[len(TokenPrefix):]
+	pos := strings.LastIndex(token, ":")
+	if pos <= 0 || pos == len(token)-1 {
+		return "", ErrBadToken
+	}
+	accessKey, sign := token[:pos], token[pos+1:]
+
+	var t time.Time
+	now := p.now()
+	date := req.Header.Get(DateHeader)
+	if date != "" {
+		t, err = time.Parse(DateFormat, date)
+		if err != nil {
+			return "", ErrBadToken
+		}
+		if d := now.Sub(t); d > p.MaxSkew || d < -p.MaxSkew {
+			return "", ErrClockSkew
+		}
+	} else if !p.AllowNoDate {
+		return "", ErrNoDate
+	}
+
+	sk, err := p.Keys.SecretKey(accessKey)
+	if err != nil {
+		return
+	}
+	body, err := readBody(req, p.MaxBodySize)
+	if err != nil {
+		return
+	}
+	mac := &Mac{AccessKey: accessKey, SecretKey: sk}
+	expected := mac.sign(signingString(req, body, p.Header))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sign)) != 1 {
+		return "", ErrBadSignature
+	}
+
+	// 只记录通过校验的签名，伪造的请求不能占用缓存。没有时间的签名无法过期，不记录
+	if date != "" {
+		err = p.checkReplay(sign, t.Add(p.MaxSkew), now)
+		if err != nil {
+			return
+		}
+	}
+	return accessKey, nil
+}
+
+func (p *Verifier) checkReplay(sign string, expire, now time.Time) error {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if now.After(p.purge) {
+		for k, e := range p.seen {
+			if now.After(e) {
+				delete(p.seen, k)
+			}
+		}
+		p.purge = now.Add(p.MaxSkew / 4)
+	}
+	if e, ok := p.seen[sign]; ok && !now.After(e) {
+		return ErrReplayed
+	}
+	p.seen[sign] = expire
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+
+type accessKeyCtxKey struct{}
+
+// AccessKeyOf 返回 Handler 校验通过的调用者 AccessKey。
+//
+func AccessKeyOf(req *http.Request) (accessKey string, ok bool) {
+
+	accessKey, ok = req.Context().Value(accessKeyCtxKey{}).(string)
+	return
+}
+
+// Handler 返回校验 MAC token 后再交给 h 处理的 http.Handler。
+// 校验失败时回复 401，包体过大时回复 413。错误同时以 X-Errno: EACCES 返回，以便 QBolt 客户端映射为 errno。
+//
+func (p *Verifier) Handler(h http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		accessKey, err := p.Verify(req)
+		if err != nil {
+			code := 401
+			if err == ErrBodyTooLarge {
+				code = 413
+			}
+			replyError(w, code, err)
+			return
+		}
+		ctx := context.WithValue(req.Context(), accessKeyCtxKey{}, accessKey)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+const errnoEACCES = 13
+
+func replyError(w http.ResponseWriter, code int, err error) {
+
+	msg, _ := json.Marshal(map[string]interface{}{
+		"error": err.Error(),
+		"errno": errnoEACCES,
+	})
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", strconv.Itoa(len(msg)))
+	h.Set("X-Err", err.Error())
+	h.Set("X-Errno", strconv.Itoa(errnoEACCES))
+	w.WriteHeader(code)
+	w.Write(msg)
+}
+
+// ---------------------------------------------------------------------------
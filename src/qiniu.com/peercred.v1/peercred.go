@@ -0,0 +1,112 @@
+package peercred
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/qiniu/errors"
+	"golang.org/x/net/context"
+)
+
+// ---------------------------------------------------------------------------
+
+// Cred 是 unix socket 对端进程的身份，取自 SO_PEERCRED，由内核保证不可伪造。
+//
+type Cred struct {
+	Pid int32  `json:"pid"`
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+}
+
+// SplitAddr 解析监听/连接地址。"unix:/path"、"unix:///path" 为 unix socket，其余为 TCP 地址。
+//
+func SplitAddr(addr string) (network, address string) {
+
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr[5:], "//")
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// Listen 在 addr 上监听。unix socket 的残留文件(上次进程未清理)会被先删除。
+//
+func Listen(addr string) (l net.Listener, err error) {
+
+	return ListenMode(addr, 0)
+}
+
+// ListenMode 同 Listen，但 mode 不为 0 时把 unix socket 文件的权限改为 mode。
+// connect(2) 需要 socket 文件的写权限，按 umask 创建的 socket 往往只有属主能连接；
+// 以 FromRequest 的对端身份做访问控制时，可以用 0666 让其他用户也能连接。
+//
+func ListenMode(addr string, mode os.FileMode) (l net.Listener, err error) {
+
+	network, address := SplitAddr(addr)
+	if network == "unix" {
+		if fi, err2 := os.Lstat(address); err2 == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	l, err = net.Listen(network, address)
+	if err != nil {
+		return nil, errors.Info(err, "net.Listen:", network, address).Detail(err)
+	}
+	if network == "unix" && mode != 0 {
+		err = os.Chmod(address, mode)
+		if err != nil {
+			l.Close()
+			return nil, errors.Info(err, "os.Chmod:", address, mode).Detail(err)
+		}
+	}
+	return
+}
+
+// ListenAndServe 与 http.ListenAndServe 相同，但 addr 可以是 unix socket，
+// 此时 handler 可以通过 FromRequest 取得对端身份。
+//
+func ListenAndServe(addr string, handler http.Handler) error {
+
+	return ListenAndServeMode(addr, 0, handler)
+}
+
+// ListenAndServeMode 同 ListenAndServe，unix socket 文件的权限见 ListenMode。
+//
+func ListenAndServeMode(addr string, mode os.FileMode, handler http.Handler) error {
+
+	l, err := ListenMode(addr, mode)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: handler, ConnContext: ConnContext}
+	return srv.Serve(l)
+}
+
+type credCtxKey struct{}
+
+// ConnContext 可用作 http.Server.ConnContext，为 unix socket 连接记录对端身份。
+//
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := Get(uc)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, credCtxKey{}, cred)
+}
+
+// FromRequest 返回请求所在连接的对端身份。非 unix socket 连接返回 false。
+//
+func FromRequest(req *http.Request) (cred *Cred, ok bool) {
+
+	cred, ok = req.Context().Value(credCtxKey{}).(*Cred)
+	return
+}
+
+// ---------------------------------------------------------------------------
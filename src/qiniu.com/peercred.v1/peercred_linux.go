@@ -0,0 +1,28 @@
+package peercred
+
+import (
+	"net"
+	"syscall"
+)
+
+// Get 读取 unix socket 连接的 SO_PEERCRED。
+//
+func Get(c *net.UnixConn) (cred *Cred, err error) {
+
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	var uc *syscall.Ucred
+	var err2 error
+	err = raw.Control(func(fd uintptr) {
+		uc, err2 = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return
+	}
+	return &Cred{Pid: uc.Pid, Uid: uc.Uid, Gid: uc.Gid}, nil
+}
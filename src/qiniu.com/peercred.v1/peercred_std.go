@@ -0,0 +1,15 @@
+// +build !linux
+
+package peercred
+
+import (
+	"net"
+	"syscall"
+)
+
+// Get 在不支持 SO_PEERCRED 的系统上总是失败。
+//
+func Get(c *net.UnixConn) (cred *Cred, err error) {
+
+	return nil, syscall.ENOTSUP
+}
@@ -0,0 +1,460 @@
+package qbs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qiniu/errors"
+	"github.com/qiniu/http/httputil.v1"
+	"qiniupkg.com/x/log.v7"
+
+	"qiniu.com/qbsdata.v1"
+	"qiniu.com/qbsmeta.v1"
+)
+
+var (
+	ErrInvalidTitle    = httputil.NewError(400, "invalid argument `title`")
+	ErrInvalidType     = httputil.NewError(400, "invalid argument `type`: unsupported disk type")
+	ErrInvalidSize     = httputil.NewError(400, "invalid argument `size`: must be positive")
+	ErrNoSuchVolume    = httputil.NewError(404, "no such volume")
+	ErrVolumeAttached  = httputil.NewError(409, "volume is attached")
+	ErrAlreadyAttached = httputil.NewError(409, "volume is already attached")
+	ErrNotAttached     = httputil.NewError(409, "volume is not attached")
+	ErrInvalidLimit    = httputil.NewError(400, "invalid argument `limit`")
+)
+
+// ---------------------------------------------------------------------------
+
+type Config struct {
+	// 卷注册表的保存位置。
+	//
+	SaveToFile string `json:"save_to"`
+
+	// 元数据根目录，即 $ssd。每个卷的元数据位于 $ssd/<VolumeId>/。
+	//
+	SsdDir string `json:"ssd"`
+
+	// 数据文件目录，即 $datavolume。
+	//
+	DataDir string `json:"datavolume"`
+
+	// 支持的磁盘类型。为空表示不限制。
+	//
+	DiskTypes []string `json:"disk_types"`
+
+	Meta qbsmeta.Config `json:"meta"`
+}
+
+type Volume struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	Ctime int64  `json:"ctime"` // 创建时间(UnixNano)
+
+	// 挂接者，为空表示未挂接。
+	//
+	AttachedTo string `json:"attached_to,omitempty"`
+}
+
+type Service struct {
+	Config
+
+	volumes map[string]*Volume // id => volume
+	mutex   sync.Mutex
+}
+
+func New(cfg *Config) (p *Service, err error) {
+
+	p = &Service{
+		Config:  *cfg,
+		volumes: make(map[string]*Volume),
+	}
+
+	f, err := os.Open(cfg.SaveToFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			err = errors.Info(err, "os.Open:", cfg.SaveToFile).Detail(err)
+			return nil, err
+		}
+		return p, nil
+	}
+	defer f.Close()
+
+	var volumes []*Volume
+	err = json.NewDecoder(f).Decode(&volumes)
+	if err != nil {
+		err = errors.Info(err, "json.Decode:", cfg.SaveToFile).Detail(err)
+		return nil, err
+	}
+	for _, v := range volumes {
+		p.volumes[v.Id] = v
+	}
+	return p, nil
+}
+
+// save 原子地重写卷注册表：先写临时文件并 fsync，再 rename 覆盖。调用者须持有 p.mutex。
+//
+func (p *Service) save() (err error) {
+
+	volumes := make([]*Volume, 0, len(p.volumes))
+	for _, v := range p.volumes {
+		volumes = append(volumes, v)
+	}
+
+	tmpFile := p.SaveToFile + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return errors.Info(err, "os.Create:", tmpFile).Detail(err)
+	}
+	err = json.NewEncoder(f).Encode(volumes)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFile)
+		return errors.Info(err, "qbs.save:", tmpFile).Detail(err)
+	}
+
+	err = os.Rename(tmpFile, p.SaveToFile)
+	if err != nil {
+		os.Remove(tmpFile)
+		return errors.Info(err, "os.Rename:", tmpFile, p.SaveToFile).Detail(err)
+	}
+	return nil
+}
+
+func (p *Service) volumeDir(id string) string {
+
+	return filepath.Join(p.SsdDir, id)
+}
+
+func (p *Service) dataConfig(id string) *qbsdata.Config {
+
+	return &qbsdata.Config{
+		DataDir: p.DataDir,
+		FidMap:  filepath.Join(p.volumeDir(id), ".fids"),
+	}
+}
+
+func (p *Service) validType(typ string) bool {
+
+	if len(p.DiskTypes) == 0 {
+		return typ != ""
+	}
+	for _, t := range p.DiskTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func newVolumeId() (id string, err error) {
+
+	var b [8]byte
+	_, err = io.ReadFull(rand.Reader, b[:])
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// ---------------------------------------------------------------------------
+
+type cmdArgs struct {
+	CmdArgs []string
+}
+
+type createVolumeArgs struct {
+	Title string `json:"title"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+}
+
+type createVolumeRet struct {
+	Id string `json:"id"`
+}
+
+/*
+POST /v1/volumes
+Content-Type: application/json
+
+{
+	"title": <VolumeTitle>,
+	"type": <DiskType>,
+	"size": <DiskSize>
+}
+*/
+func (p *Service) PostVolumes(args *createVolumeArgs) (ret *createVolumeRet, err error) {
+
+	if args.Title == "" {
+		return nil, ErrInvalidTitle
+	}
+	if !p.validType(args.Type) {
+		return nil, ErrInvalidType
+	}
+	if args.Size <= 0 {
+		return nil, ErrInvalidSize
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	id, err := newVolumeId()
+	if err != nil {
+		return
+	}
+	if _, ok := p.volumes[id]; ok {
+		return nil, errors.Info(os.ErrExist, "qbs.PostVolumes: volume id conflict", id)
+	}
+
+	dir := p.volumeDir(id)
+	meta, err := qbsmeta.Open(dir, &p.Meta)
+	if err != nil {
+		err = errors.Info(err, "qbsmeta.Open:", dir).Detail(err)
+		return
+	}
+	meta.Close()
+
+	p.volumes[id] = &Volume{
+		Id:    id,
+		Title: args.Title,
+		Type:  args.Type,
+		Size:  args.Size,
+		Ctime: time.Now().UnixNano(),
+	}
+	err = p.save()
+	if err != nil {
+		delete(p.volumes, id)
+		os.RemoveAll(dir)
+		return
+	}
+	log.Info("qbs: volume created:", id, args.Title, args.Type, args.Size)
+	return &createVolumeRet{Id: id}, nil
+}
+
+/*
+DELETE /v1/volumes/<VolumeId>
+*/
+func (p *Service) DeleteVolumes_(args *cmdArgs) (err error) {
+
+	id := args.CmdArgs[0]
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	v, ok := p.volumes[id]
+	if !ok {
+		return ErrNoSuchVolume
+	}
+	if v.AttachedTo != "" {
+		return ErrVolumeAttached
+	}
+
+	delete(p.volumes, id)
+	err = p.save()
+	if err != nil {
+		p.volumes[id] = v
+		return
+	}
+
+	// 注册表已更新，其后的清理失败只留下孤儿文件，不影响卷已删除的结果
+	data, err := qbsdata.Open(p.dataConfig(id))
+	if err == nil {
+		err = data.RemoveAll()
+	}
+	if err != nil {
+		log.Warn("qbs: remove data of volume failed:", id, err)
+	}
+	err = os.RemoveAll(p.volumeDir(id))
+	if err != nil {
+		log.Warn("qbs: remove metadata of volume failed:", id, err)
+	}
+	log.Info("qbs: volume deleted:", id)
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+
+type attachArgs struct {
+	CmdArgs []string
+	Host    string `json:"host"`
+}
+
+/*
+POST /v1/volumes/<VolumeId>/attach
+Content-Type: application/json
+
+{
+	"host": <Host>
+}
+*/
+func (p *Service) PostVolumes_Attach(args *attachArgs) (err error) {
+
+	if args.Host == "" {
+		return httputil.NewError(400, "invalid argument `host`")
+	}
+	return p.setAttached(args.CmdArgs[0], args.Host)
+}
+
+/*
+POST /v1/volumes/<VolumeId>/detach
+*/
+func (p *Service) PostVolumes_Detach(args *cmdArgs) (err error) {
+
+	return p.setAttached(args.CmdArgs[0], "")
+}
+
+func (p *Service) setAttached(id, host string) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	v, ok := p.volumes[id]
+	if !ok {
+		return ErrNoSuchVolume
+	}
+	switch {
+	case host != "" && v.AttachedTo != "":
+		return ErrAlreadyAttached
+	case host == "" && v.AttachedTo == "":
+		return ErrNotAttached
+	}
+
+	old := v.AttachedTo
+	v.AttachedTo = host
+	err = p.save()
+	if err != nil {
+		v.AttachedTo = old
+	}
+	return
+}
+
+// ---------------------------------------------------------------------------
+
+type volumeInfo struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	Ctime int64  `json:"ctime"`
+
+	// 用量取自卷元数据快照(.metadata)的文件头，最多落后一个 Checkpoint 周期。
+	//
+	Used   uint64 `json:"used"`
+	Inodes uint64 `json:"inodes"`
+
+	Attached   bool   `json:"attached"`
+	AttachedTo string `json:"attached_to,omitempty"`
+}
+
+func (p *Service) infoOf(v *Volume) *volumeInfo {
+
+	info := &volumeInfo{
+		Id:         v.Id,
+		Title:      v.Title,
+		Type:       v.Type,
+		Size:       v.Size,
+		Ctime:      v.Ctime,
+		Attached:   v.AttachedTo != "",
+		AttachedTo: v.AttachedTo,
+	}
+	usage, err := qbsmeta.ReadUsage(p.volumeDir(v.Id))
+	if err != nil {
+		log.Warn("qbs: read usage of volume failed:", v.Id, err)
+	} else {
+		info.Used, info.Inodes = usage.Bytes, usage.Inodes
+	}
+	return info
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type listVolumesArgs struct {
+	Type   string `json:"type"`
+	Marker string `json:"marker"`
+	Limit  int    `json:"limit"`
+}
+
+type listVolumesRet struct {
+	Items  []*volumeInfo `json:"items"`
+	Marker string        `json:"marker,omitempty"` // 为空表示已列完
+}
+
+/*
+GET /v1/volumes?type=<DiskType>&marker=<Marker>&limit=<Limit>
+*/
+func (p *Service) GetVolumes(args *listVolumesArgs) (ret *listVolumesRet, err error) {
+
+	limit := args.Limit
+	switch {
+	case limit == 0:
+		limit = defaultListLimit
+	case limit < 0 || limit > maxListLimit:
+		return nil, ErrInvalidLimit
+	}
+
+	p.mutex.Lock()
+	var volumes []Volume
+	for _, v := range p.volumes {
+		if args.Type != "" && v.Type != args.Type {
+			continue
+		}
+		if v.Id <= args.Marker {
+			continue
+		}
+		volumes = append(volumes, *v)
+	}
+	p.mutex.Unlock()
+
+	sort.Sort(volumesById(volumes))
+
+	ret = &listVolumesRet{Items: make([]*volumeInfo, 0, limit)}
+	if len(volumes) > limit {
+		volumes = volumes[:limit]
+		ret.Marker = volumes[limit-1].Id
+	}
+	for i := range volumes {
+		ret.Items = append(ret.Items, p.infoOf(&volumes[i]))
+	}
+	return
+}
+
+type volumesById []Volume
+
+func (p volumesById) Len() int           { return len(p) }
+func (p volumesById) Less(i, j int) bool { return p[i].Id < p[j].Id }
+func (p volumesById) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+/*
+GET /v1/volumes/<VolumeId>
+*/
+func (p *Service) GetVolumes_(args *cmdArgs) (ret *volumeInfo, err error) {
+
+	p.mutex.Lock()
+	v, ok := p.volumes[args.CmdArgs[0]]
+	var volume Volume
+	if ok {
+		volume = *v
+	}
+	p.mutex.Unlock()
+
+	if !ok {
+		return nil, ErrNoSuchVolume
+	}
+	return p.infoOf(&volume), nil
+}
+
+// ---------------------------------------------------------------------------
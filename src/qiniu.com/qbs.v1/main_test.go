@@ -0,0 +1,283 @@
+package qbs
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/qiniu/http/restrpc.v1"
+	"qiniu.com/qbsdata.v1"
+	"qiniu.com/qbsmeta.v1"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+func newTestConfig(dir string) *Config {
+
+	return &Config{
+		SaveToFile: filepath.Join(dir, "volumes.conf"),
+		SsdDir:     filepath.Join(dir, "ssd"),
+		DataDir:    filepath.Join(dir, "data"),
+		DiskTypes:  []string{"ssd", "hdd"},
+		Meta:       qbsmeta.Config{CheckpointIntervalS: -1},
+	}
+}
+
+func newTestServer(t *testing.T, cfg *Config) (p *Service, ts *httptest.Server) {
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	router := restrpc.Router{PatternPrefix: "v1"}
+	return p, httptest.NewServer(router.Register(p))
+}
+
+// call 发出请求并把 200 的返回包解析到 ret，返回 HTTP 状态码。
+//
+func call(t *testing.T, ts *httptest.Server, method, path string, args, ret interface{}) int {
+
+	var body bytes.Buffer
+	if args != nil {
+		json.NewEncoder(&body).Encode(args)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 200 && ret != nil {
+		if err = json.NewDecoder(resp.Body).Decode(ret); err != nil {
+			t.Fatal(method, path, "decode:", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func createVolume(t *testing.T, ts *httptest.Server, title, typ string) string {
+
+	var ret createVolumeRet
+	code := call(t, ts, "POST", "/v1/volumes", &createVolumeArgs{Title: title, Type: typ, Size: 1 << 30}, &ret)
+	if code != 200 || ret.Id == "" {
+		t.Fatal("create volume:", title, code, ret)
+	}
+	return ret.Id
+}
+
+// ---------------------------------------------------------------------------
+
+func TestCreateVolume(t *testing.T) {
+
+	dir := t.TempDir()
+	cfg := newTestConfig(dir)
+	_, ts := newTestServer(t, cfg)
+	defer ts.Close()
+
+	cases := []struct {
+		args createVolumeArgs
+		code int
+	}{
+		{createVolumeArgs{Title: "", Type: "ssd", Size: 1}, 400},
+		{createVolumeArgs{Title: "a", Type: "nvme", Size: 1}, 400},
+		{createVolumeArgs{Title: "a", Type: "ssd", Size: 0}, 400},
+	}
+	for _, tc := range cases {
+		if code := call(t, ts, "POST", "/v1/volumes", &tc.args, nil); code != tc.code {
+			t.Fatal("create volume:", tc.args, code, "want", tc.code)
+		}
+	}
+
+	id := createVolume(t, ts, "a", "ssd")
+	if _, err := os.Stat(filepath.Join(cfg.SsdDir, id, qbsmeta.MetadataFile)); err != nil {
+		t.Fatal("metadata not created:", err)
+	}
+	var info volumeInfo
+	if code := call(t, ts, "GET", "/v1/volumes/"+id, nil, &info); code != 200 {
+		t.Fatal("get volume:", code)
+	}
+	if info.Title != "a" || info.Type != "ssd" || info.Size != 1<<30 || info.Attached {
+		t.Fatal("get volume:", info)
+	}
+
+	// 注册表持久化，重启后仍在
+	p2, ts2 := newTestServer(t, cfg)
+	defer ts2.Close()
+	if _, ok := p2.volumes[id]; !ok {
+		t.Fatal("volume not saved:", id)
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+
+	dir := t.TempDir()
+	cfg := newTestConfig(dir)
+	p, ts := newTestServer(t, cfg)
+	defer ts.Close()
+
+	id := createVolume(t, ts, "a", "ssd")
+
+	if code := call(t, ts, "DELETE", "/v1/volumes/none", nil, nil); code != 404 {
+		t.Fatal("delete missing volume:", code)
+	}
+
+	// 挂接中的卷不能删除
+	if code := call(t, ts, "POST", "/v1/volumes/"+id+"/attach", map[string]string{"host": "h1"}, nil); code != 200 {
+		t.Fatal("attach:", code)
+	}
+	if code := call(t, ts, "POST", "/v1/volumes/"+id+"/attach", map[string]string{"host": "h2"}, nil); code != 409 {
+		t.Fatal("attach twice:", code)
+	}
+	if code := call(t, ts, "DELETE", "/v1/volumes/"+id, nil, nil); code != 409 {
+		t.Fatal("delete attached volume:", code)
+	}
+	if _, ok := p.volumes[id]; !ok {
+		t.Fatal("attached volume deleted")
+	}
+
+	if code := call(t, ts, "POST", "/v1/volumes/"+id+"/detach", nil, nil); code != 200 {
+		t.Fatal("detach:", code)
+	}
+
+	data, err := qbsdata.Open(p.dataConfig(id))
+	if err != nil {
+		t.Fatal("qbsdata.Open:", err)
+	}
+	data.WriteAt(5, []byte("hello"), 0)
+	dataFile := filepath.Join(cfg.DataDir, data.Fid(5)+".data")
+	data.Close()
+
+	if code := call(t, ts, "DELETE", "/v1/volumes/"+id, nil, nil); code != 200 {
+		t.Fatal("delete volume:", code)
+	}
+	if code := call(t, ts, "GET", "/v1/volumes/"+id, nil, nil); code != 404 {
+		t.Fatal("get deleted volume:", code)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.SsdDir, id)); !os.IsNotExist(err) {
+		t.Fatal("metadata not removed:", err)
+	}
+	if _, err := os.Stat(dataFile); !os.IsNotExist(err) {
+		t.Fatal("data not removed:", err)
+	}
+
+	p2, ts2 := newTestServer(t, cfg)
+	defer ts2.Close()
+	if _, ok := p2.volumes[id]; ok {
+		t.Fatal("deleted volume still saved:", id)
+	}
+}
+
+func TestListVolumesPaging(t *testing.T) {
+
+	_, ts := newTestServer(t, newTestConfig(t.TempDir()))
+	defer ts.Close()
+
+	ids := make(map[string]string) // id => type
+	for i, typ := range []string{"ssd", "hdd", "ssd", "ssd", "hdd"} {
+		ids[createVolume(t, ts, "v"+string(rune('0'+i)), typ)] = typ
+	}
+
+	for _, limit := range []int{1, 2, 5, 100} {
+		seen := make(map[string]bool)
+		marker, last, pages := "", "", 0
+		for {
+			var ret listVolumesRet
+			path := "/v1/volumes?limit=" + strconv.Itoa(limit) + "&marker=" + marker
+			if code := call(t, ts, "GET", path, nil, &ret); code != 200 {
+				t.Fatal("list:", path, code)
+			}
+			pages++
+			if len(ret.Items) > limit {
+				t.Fatal("list: too many items", limit, len(ret.Items))
+			}
+			for _, item := range ret.Items {
+				if item.Id <= last || seen[item.Id] {
+					t.Fatal("list: items not in id order or repeated:", item.Id, last)
+				}
+				last = item.Id
+				seen[item.Id] = true
+			}
+			if ret.Marker == "" {
+				break
+			}
+			marker = ret.Marker
+		}
+		if len(seen) != len(ids) {
+			t.Fatal("list: missing volumes", limit, len(seen), len(ids))
+		}
+		if want := (len(ids) + limit - 1) / limit; pages != want { // 最后一页不返回 marker
+			t.Fatal("list: pages", limit, pages, want)
+		}
+	}
+
+	var ret listVolumesRet
+	if code := call(t, ts, "GET", "/v1/volumes?type=hdd", nil, &ret); code != 200 || len(ret.Items) != 2 || ret.Marker != "" {
+		t.Fatal("list by type:", code, ret)
+	}
+	for _, item := range ret.Items {
+		if ids[item.Id] != "hdd" {
+			t.Fatal("list by type:", item)
+		}
+	}
+
+	for _, limit := range []string{"-1", "1001"} {
+		if code := call(t, ts, "GET", "/v1/volumes?limit="+limit, nil, nil); code != 400 {
+			t.Fatal("list with invalid limit:", limit, code)
+		}
+	}
+}
+
+func TestListVolumesUsage(t *testing.T) {
+
+	cfg := newTestConfig(t.TempDir())
+	_, ts := newTestServer(t, cfg)
+	defer ts.Close()
+
+	id := createVolume(t, ts, "a", "ssd")
+
+	// 用量取自快照文件头，Checkpoint 后才反映到列表中
+	meta, err := qbsmeta.Open(filepath.Join(cfg.SsdDir, id), &cfg.Meta)
+	if err != nil {
+		t.Fatal("qbsmeta.Open:", err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err = meta.Create(qbsmeta.RootIno, name, Attr{Mode: 0644, Size: 8192}, ""); err != nil {
+			t.Fatal("Create:", err)
+		}
+	}
+	if err = meta.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	usage, err := qbsmeta.ReadUsage(filepath.Join(cfg.SsdDir, id))
+	if err != nil || usage.Inodes != 4 {
+		t.Fatal("ReadUsage:", usage, err)
+	}
+
+	var ret listVolumesRet
+	if code := call(t, ts, "GET", "/v1/volumes", nil, &ret); code != 200 || len(ret.Items) != 1 {
+		t.Fatal("list:", code, ret)
+	}
+	if item := ret.Items[0]; item.Inodes != usage.Inodes || item.Used != usage.Bytes {
+		t.Fatal("list usage:", item, usage)
+	}
+
+	var info volumeInfo
+	if code := call(t, ts, "GET", "/v1/volumes/"+id, nil, &info); code != 200 || info.Inodes != usage.Inodes || info.Used != usage.Bytes {
+		t.Fatal("get usage:", code, info, usage)
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+
+	"qbox.us/cc/config"
+
+	"github.com/qiniu/http/restrpc.v1"
+	"github.com/qiniu/log.v1"
+
+	"qiniu.com/mac.v1"
+	"qiniu.com/qbs.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+type Config struct {
+	Qbs qbs.Config `json:"qbs"`
+
+	// 不为空时校验请求的 Qiniu MAC token。
+	//
+	Auth *mac.Config `json:"auth"`
+
+	BindHost   string `json:"bind_host"`
+	MaxProcs   int    `json:"max_procs"`
+	DebugLevel int    `json:"debug_level"`
+}
+
+func main() {
+
+	// Load Config
+
+	config.Init("f", "qiniu", "qbs.conf")
+
+	var conf Config
+	if err := config.Load(&conf); err != nil {
+		log.Fatal("config.Load failed:", err)
+	}
+	log.Info("config:", conf)
+
+	// General Settings
+
+	runtime.GOMAXPROCS(conf.MaxProcs)
+	log.SetOutputLevel(conf.DebugLevel)
+
+	// new Service
+
+	service, err := qbs.New(&conf.Qbs)
+	if err != nil {
+		log.Fatal("qbs.New failed:", err)
+	}
+
+	// run Service
+
+	router := restrpc.Router{
+		PatternPrefix: "v1",
+	}
+	var handler http.Handler = router.Register(service)
+	if conf.Auth != nil {
+		handler = mac.New(conf.Auth, nil).Handler(handler)
+	}
+	log.Info("Starting qbs ...")
+	err = http.ListenAndServe(conf.BindHost, handler)
+	log.Fatal("http.ListenAndServe(qbs):", err)
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,402 @@
+package qbsdata
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/qiniu/errors"
+)
+
+// ---------------------------------------------------------------------------
+
+// Interface 是 QBolt 服务端使用的文件数据存储。偏移读写的语义与 ReadRequest/WriteRequest 一致：
+// 读到文件尾返回的数据变短，写到文件尾之后留下的空洞读出为 0。
+//
+// 数据文件的生命周期由链接数与打开数共同决定：Unlink 报告节点剩余的链接数，
+// 当链接数为 0 且所有 Open 都已 Release 时，数据文件被删除。
+//
+type Interface interface {
+	Open(ino uint64) error
+	Release(ino uint64) error
+	Unlink(ino uint64, nlink uint32) error
+
+	ReadAt(ino uint64, b []byte, off int64) (n int, err error)
+	WriteAt(ino uint64, b []byte, off int64) (n int, err error)
+	Truncate(ino uint64, size uint64) error
+	Size(ino uint64) (size uint64, err error)
+	Sync(ino uint64) error
+}
+
+var _ Interface = (*Store)(nil)
+
+// ---------------------------------------------------------------------------
+
+type Config struct {
+	// 数据文件所在目录，即 $datavolume。数据文件为 $datavolume/<Fid>.data。
+	//
+	DataDir string `json:"data_dir"`
+
+	// inode => fid 映射的保存位置，一般为 $ssd/<VolumeId>/.fids。
+	// $datavolume 可以被多个卷共用，映射须按卷分开保存。
+	//
+	FidMap string `json:"fid_map"`
+
+	// 映射变更及 Truncate 后是否 fsync。
+	//
+	Fsync bool `json:"fsync"`
+}
+
+type entry struct {
+	fid      string
+	f        *os.File // 缓存的数据文件，在没有打开者且没有进行中的读写时关闭
+	nopen    int
+	inuse    int // 进行中的读写数
+	unlinked bool // 链接数已为 0
+}
+
+// Store 把每个 inode 的数据保存在 $datavolume/<Fid>.data 中，fid 在首次写入时分配。
+//
+type Store struct {
+	Config
+
+	fidMap  *fidMap
+	entries map[uint64]*entry
+	mutex   sync.Mutex
+}
+
+func Open(cfg *Config) (p *Store, err error) {
+
+	err = os.MkdirAll(cfg.DataDir, 0755)
+	if err != nil {
+		err = errors.Info(err, "os.MkdirAll:", cfg.DataDir).Detail(err)
+		return
+	}
+
+	fm, fids, err := openFidMap(cfg.FidMap, cfg.Fsync)
+	if err != nil {
+		return
+	}
+
+	p = &Store{
+		Config:  *cfg,
+		fidMap:  fm,
+		entries: make(map[uint64]*entry, len(fids)),
+	}
+	for ino, fid := range fids {
+		p.entries[ino] = &entry{fid: fid}
+	}
+	return
+}
+
+func (p *Store) Close() (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, e := range p.entries {
+		if e.f != nil {
+			e.f.Close()
+			e.f = nil
+		}
+	}
+	return p.fidMap.Close()
+}
+
+// Fid 返回 ino 对应的 fid，尚未分配时返回空串。
+//
+func (p *Store) Fid(ino uint64) string {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if e, ok := p.entries[ino]; ok {
+		return e.fid
+	}
+	return ""
+}
+
+func (p *Store) dataFile(fid string) string {
+
+	return filepath.Join(p.DataDir, fid+".data")
+}
+
+func newFid() (fid string, err error) {
+
+	var b [16]byte
+	_, err = io.ReadFull(rand.Reader, b[:])
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// ---------------------------------------------------------------------------
+
+// 调用者须持有 p.mutex。
+
+func (p *Store) entryOf(ino uint64) *entry {
+
+	e, ok := p.entries[ino]
+	if !ok {
+		e = &entry{}
+		p.entries[ino] = e
+	}
+	return e
+}
+
+// alloc 为 e 分配 fid 并创建空的数据文件。
+//
+func (p *Store) alloc(ino uint64, e *entry) (err error) {
+
+	if e.fid != "" {
+		return nil
+	}
+	fid, err := newFid()
+	if err != nil {
+		return errors.Info(err, "qbsdata.newFid").Detail(err)
+	}
+	f, err := os.OpenFile(p.dataFile(fid), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Info(err, "os.OpenFile:", p.dataFile(fid)).Detail(err)
+	}
+	err = p.fidMap.put(ino, fid)
+	if err != nil {
+		f.Close()
+		os.Remove(p.dataFile(fid))
+		return
+	}
+	e.fid = fid
+	e.f = f
+	return nil
+}
+
+// file 返回 ino 的数据文件。create 为 false 且 fid 尚未分配时返回 nil。
+// 返回的 closeFn 须在使用完毕后调用。
+//
+func (p *Store) file(ino uint64, create bool) (f *os.File, closeFn func(), err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e, ok := p.entries[ino]
+	if !ok || e.fid == "" {
+		if !create {
+			return nil, func() {}, nil
+		}
+		e = p.entryOf(ino)
+		err = p.alloc(ino, e)
+		if err != nil {
+			p.dropIdle(ino, e)
+			return
+		}
+	}
+	if e.f == nil {
+		e.f, err = os.OpenFile(p.dataFile(e.fid), os.O_RDWR, 0644)
+		if err != nil {
+			return nil, nil, errors.Info(err, "os.OpenFile:", p.dataFile(e.fid)).Detail(err)
+		}
+	}
+	e.inuse++
+	closeFn = func() {
+		p.mutex.Lock()
+		e.inuse--
+		closeIdle(e)
+		p.mutex.Unlock()
+	}
+	return e.f, closeFn, nil
+}
+
+func closeIdle(e *entry) {
+
+	if e.f != nil && e.nopen == 0 && e.inuse == 0 {
+		e.f.Close()
+		e.f = nil
+	}
+}
+
+// dropIdle 删除既没有打开者、也未分配 fid 的条目(打开后从未写入)，以免 entries 无限增长。
+//
+func (p *Store) dropIdle(ino uint64, e *entry) {
+
+	if e.nopen == 0 && e.fid == "" {
+		delete(p.entries, ino)
+	}
+}
+
+// tryRemove 在链接数为 0 且没有打开者时删除数据文件及映射。
+//
+func (p *Store) tryRemove(ino uint64, e *entry) (err error) {
+
+	if !e.unlinked || e.nopen > 0 {
+		return nil
+	}
+	delete(p.entries, ino)
+	closeIdle(e)
+	if e.fid == "" {
+		return nil
+	}
+	err = os.Remove(p.dataFile(e.fid))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Info(err, "os.Remove:", p.dataFile(e.fid)).Detail(err)
+	}
+	return p.fidMap.del(ino)
+}
+
+// ---------------------------------------------------------------------------
+
+func (p *Store) Open(ino uint64) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.entryOf(ino).nopen++
+	return nil
+}
+
+func (p *Store) Release(ino uint64) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e, ok := p.entries[ino]
+	if !ok || e.nopen == 0 {
+		return syscall.EBADF
+	}
+	e.nopen--
+	closeIdle(e)
+	p.dropIdle(ino, e)
+	return p.tryRemove(ino, e)
+}
+
+// Unlink 报告 ino 剩余的链接数。为 0 时，数据文件在最后一个打开者 Release 后删除。
+//
+func (p *Store) Unlink(ino uint64, nlink uint32) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if nlink != 0 {
+		return nil
+	}
+	e, ok := p.entries[ino]
+	if !ok {
+		return nil
+	}
+	e.unlinked = true
+	return p.tryRemove(ino, e)
+}
+
+func (p *Store) ReadAt(ino uint64, b []byte, off int64) (n int, err error) {
+
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	f, closeFn, err := p.file(ino, false)
+	if err != nil || f == nil {
+		return
+	}
+	defer closeFn()
+
+	n, err = f.ReadAt(b, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+func (p *Store) WriteAt(ino uint64, b []byte, off int64) (n int, err error) {
+
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	f, closeFn, err := p.file(ino, true)
+	if err != nil {
+		return
+	}
+	defer closeFn()
+
+	return f.WriteAt(b, off)
+}
+
+// Truncate 按 SetattrSize 的语义截断或扩展文件，扩展部分为空洞。
+//
+func (p *Store) Truncate(ino uint64, size uint64) (err error) {
+
+	f, closeFn, err := p.file(ino, size > 0)
+	if err != nil || f == nil {
+		return
+	}
+	defer closeFn()
+
+	err = f.Truncate(int64(size))
+	if err != nil {
+		return
+	}
+	if p.Fsync {
+		err = f.Sync()
+	}
+	return
+}
+
+func (p *Store) Size(ino uint64) (size uint64, err error) {
+
+	f, closeFn, err := p.file(ino, false)
+	if err != nil || f == nil {
+		return
+	}
+	defer closeFn()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	return uint64(fi.Size()), nil
+}
+
+// Sync 对应 FsyncRequest，把 ino 的数据刷到磁盘。
+//
+func (p *Store) Sync(ino uint64) (err error) {
+
+	f, closeFn, err := p.file(ino, false)
+	if err != nil || f == nil {
+		return
+	}
+	defer closeFn()
+
+	return f.Sync()
+}
+
+// RemoveAll 删除本卷的全部数据文件及 inode => fid 映射，用于删除卷。之后 Store 不可再用。
+//
+func (p *Store) RemoveAll() (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for ino, e := range p.entries {
+		if e.f != nil {
+			e.f.Close()
+			e.f = nil
+		}
+		if e.fid != "" {
+			err = os.Remove(p.dataFile(e.fid))
+			if err != nil && !os.IsNotExist(err) {
+				return errors.Info(err, "os.Remove:", p.dataFile(e.fid)).Detail(err)
+			}
+		}
+		delete(p.entries, ino)
+	}
+	p.fidMap.Close()
+	err = os.Remove(p.FidMap)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Info(err, "os.Remove:", p.FidMap).Detail(err)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
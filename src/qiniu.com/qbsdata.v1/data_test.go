@@ -0,0 +1,184 @@
+package qbsdata
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+
+func openStore(t *testing.T, dir string) *Store {
+
+	p, err := Open(&Config{DataDir: filepath.Join(dir, "data"), FidMap: filepath.Join(dir, ".fids")})
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	return p
+}
+
+func mustRead(t *testing.T, p *Store, ino uint64, off int64, size int) []byte {
+
+	b := make([]byte, size)
+	n, err := p.ReadAt(ino, b, off)
+	if err != nil {
+		t.Fatal("ReadAt:", ino, off, err)
+	}
+	return b[:n]
+}
+
+func mustWrite(t *testing.T, p *Store, ino uint64, off int64, data string) {
+
+	n, err := p.WriteAt(ino, []byte(data), off)
+	if err != nil || n != len(data) {
+		t.Fatal("WriteAt:", ino, off, n, err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+
+func TestOpenWithoutWrite(t *testing.T) {
+
+	p := openStore(t, t.TempDir())
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := p.Open(5); err != nil {
+			t.Fatal("Open:", err)
+		}
+	}
+	if data := mustRead(t, p, 5, 0, 10); len(data) != 0 {
+		t.Fatal("read unwritten:", data)
+	}
+	p.Release(5)
+	p.Release(5)
+	if len(p.entries) != 0 {
+		t.Fatal("entry leaked:", p.entries)
+	}
+}
+
+func TestSparseWrite(t *testing.T) {
+
+	p := openStore(t, t.TempDir())
+	defer p.Close()
+
+	const off = 1 << 20
+	mustWrite(t, p, 5, 0, "hello")
+	mustWrite(t, p, 5, off, "world")
+
+	cases := []struct {
+		off  int64
+		size int
+		want []byte
+	}{
+		{0, 5, []byte("hello")},
+		{3, 4, []byte("lo\x00\x00")},
+		{off / 2, 8, make([]byte, 8)}, // 空洞读出为 0
+		{off - 1, 10, []byte("\x00world")},
+		{off + 5, 10, []byte{}}, // EOF
+	}
+	for _, tc := range cases {
+		if data := mustRead(t, p, 5, tc.off, tc.size); !bytes.Equal(data, tc.want) {
+			t.Fatalf("ReadAt(%d, %d): %q, want %q", tc.off, tc.size, data, tc.want)
+		}
+	}
+	if size, err := p.Size(5); err != nil || size != off+5 {
+		t.Fatal("Size:", size, err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+
+	p := openStore(t, t.TempDir())
+	defer p.Close()
+
+	// 截断到 0 不为未写过的 inode 分配 fid
+	if err := p.Truncate(5, 0); err != nil || p.Fid(5) != "" {
+		t.Fatal("Truncate unallocated:", p.Fid(5), err)
+	}
+
+	mustWrite(t, p, 5, 0, "hello")
+	if err := p.Truncate(5, 2); err != nil {
+		t.Fatal("Truncate shrink:", err)
+	}
+	if err := p.Truncate(5, 6); err != nil {
+		t.Fatal("Truncate extend:", err)
+	}
+	if data := mustRead(t, p, 5, 0, 10); !bytes.Equal(data, []byte("he\x00\x00\x00\x00")) {
+		t.Fatalf("read after truncate: %q", data)
+	}
+
+	// 扩展未写过的 inode 分配 fid，内容为空洞
+	if err := p.Truncate(6, 3); err != nil || p.Fid(6) == "" {
+		t.Fatal("Truncate extend unallocated:", p.Fid(6), err)
+	}
+	if size, err := p.Size(6); err != nil || size != 3 {
+		t.Fatal("Size:", size, err)
+	}
+}
+
+func TestUnlinkWhileOpen(t *testing.T) {
+
+	dir := t.TempDir()
+	p := openStore(t, dir)
+
+	p.Open(5)
+	mustWrite(t, p, 5, 0, "hello")
+	file := p.dataFile(p.Fid(5))
+
+	// 仍被打开时数据保留，可以继续读写
+	if err := p.Unlink(5, 0); err != nil {
+		t.Fatal("Unlink:", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal("data removed while open:", err)
+	}
+	mustWrite(t, p, 5, 5, " world")
+	if data := mustRead(t, p, 5, 0, 20); string(data) != "hello world" {
+		t.Fatalf("read after unlink: %q", data)
+	}
+
+	// 最后一个打开者 Release 后删除数据文件及映射
+	if err := p.Release(5); err != nil {
+		t.Fatal("Release:", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("data not removed:", err)
+	}
+	if p.Fid(5) != "" || len(p.entries) != 0 {
+		t.Fatal("entry not removed:", p.entries)
+	}
+	p.Close()
+
+	p = openStore(t, dir)
+	defer p.Close()
+	if p.Fid(5) != "" {
+		t.Fatal("fid map not updated:", p.Fid(5))
+	}
+}
+
+func TestUnlinkWithLinks(t *testing.T) {
+
+	dir := t.TempDir()
+	p := openStore(t, dir)
+
+	mustWrite(t, p, 5, 0, "hello")
+	fid := p.Fid(5)
+	if err := p.Unlink(5, 1); err != nil {
+		t.Fatal("Unlink:", err)
+	}
+	p.Close()
+
+	// 还有链接时数据与映射都保留
+	p = openStore(t, dir)
+	defer p.Close()
+	if p.Fid(5) != fid {
+		t.Fatal("fid lost:", p.Fid(5), fid)
+	}
+	if data := mustRead(t, p, 5, 0, 10); string(data) != "hello" {
+		t.Fatalf("read: %q", data)
+	}
+}
+
+// ---------------------------------------------------------------------------
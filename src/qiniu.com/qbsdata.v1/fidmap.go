@@ -0,0 +1,122 @@
+package qbsdata
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/qiniu/errors"
+)
+
+// ---------------------------------------------------------------------------
+
+// fidMap 持久化 inode => fid 的映射。文件为追加写的文本日志，每行一条：
+//
+//	<Inode> <Fid>    建立映射
+//	<Inode> -        删除映射
+//
+// 打开时读入全部映射并重写为紧凑形式。
+//
+type fidMap struct {
+	file  string
+	f     *os.File
+	fsync bool
+}
+
+func openFidMap(file string, fsync bool) (p *fidMap, fids map[uint64]string, err error) {
+
+	fids = make(map[uint64]string)
+
+	f, err := os.Open(file)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 {
+				continue // 崩溃时写了一半的行
+			}
+			ino, err2 := strconv.ParseUint(fields[0], 10, 64)
+			if err2 != nil {
+				continue
+			}
+			if fields[1] == "-" {
+				delete(fids, ino)
+			} else {
+				fids[ino] = fields[1]
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, errors.Info(err, "qbsdata.openFidMap: read", file).Detail(err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, errors.Info(err, "os.Open:", file).Detail(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return nil, nil, errors.Info(err, "os.MkdirAll:", filepath.Dir(file)).Detail(err)
+	}
+
+	tmpFile := file + ".tmp"
+	tmp, err := os.Create(tmpFile)
+	if err != nil {
+		return nil, nil, errors.Info(err, "os.Create:", tmpFile).Detail(err)
+	}
+	w := bufio.NewWriter(tmp)
+	for ino, fid := range fids {
+		fmt.Fprintf(w, "%d %s\n", ino, fid)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmpFile, file)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return nil, nil, errors.Info(err, "qbsdata.openFidMap: compact", file).Detail(err)
+	}
+
+	f, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, errors.Info(err, "os.OpenFile:", file).Detail(err)
+	}
+	p = &fidMap{file: file, f: f, fsync: fsync}
+	return
+}
+
+func (p *fidMap) put(ino uint64, fid string) error {
+
+	return p.append(fmt.Sprintf("%d %s\n", ino, fid))
+}
+
+func (p *fidMap) del(ino uint64) error {
+
+	return p.append(fmt.Sprintf("%d -\n", ino))
+}
+
+func (p *fidMap) append(line string) (err error) {
+
+	_, err = p.f.WriteString(line)
+	if err != nil {
+		return errors.Info(err, "qbsdata.fidMap: write", p.file).Detail(err)
+	}
+	if p.fsync {
+		err = p.f.Sync()
+	}
+	return
+}
+
+func (p *fidMap) Close() error {
+
+	return p.f.Close()
+}
+
+// ---------------------------------------------------------------------------
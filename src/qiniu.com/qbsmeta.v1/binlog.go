@@ -0,0 +1,235 @@
+package qbsmeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/crc32"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/qiniu/errors"
+	"qiniupkg.com/x/log.v7"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+type opCode uint8
+
+const (
+	opCreate opCode = iota + 1
+	opLink
+	opUnlink
+	opRename
+	opSetattr
+	opSetxattr
+	opRemovexattr
+	opFree
+)
+
+// record 是 .binlog 中的一条变更。各字段的含义随 Op 不同：
+//
+//	opCreate:      Parent/Name 下新建 Ino，属性为 Attr，软链接目标为 Target
+//	opLink:        Parent/Name 指向已有的 Ino
+//	opUnlink:      删除 Parent/Name
+//	opRename:      Parent/Name 改名为 NewParent/NewName
+//	opSetattr:     Ino 的属性替换为 Attr
+//	opSetxattr:    设置 Ino 的扩展属性 Name 为 Value
+//	opRemovexattr: 删除 Ino 的扩展属性 Name
+//	opFree:        释放已没有目录项引用的 Ino
+//
+type record struct {
+	Seq  uint64
+	Op   opCode
+	Time Time
+
+	Ino       uint64
+	Parent    uint64
+	Name      string
+	NewParent uint64
+	NewName   string
+	Attr      Attr
+	Target    string
+	Value     []byte
+}
+
+// 每条记录的格式为：
+//
+//	<Len:uint32> <Crc32:uint32> <gob(record):Len>
+//
+// 每条记录独立编码，以便进程重启后可以直接追加。
+//
+const recordHeaderLen = 8
+
+func encodeRecord(rec *record) (b []byte, err error) {
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, recordHeaderLen))
+	err = gob.NewEncoder(&buf).Encode(rec)
+	if err != nil {
+		return
+	}
+	b = buf.Bytes()
+	body := b[recordHeaderLen:]
+	binary.LittleEndian.PutUint32(b, uint32(len(body)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.ChecksumIEEE(body))
+	return
+}
+
+// readRecord 读出一条完整记录。n 为该记录在 .binlog 中占用的字节数，返回的 err：
+//
+//	io.EOF:              没有更多记录
+//	io.ErrUnexpectedEOF: 文件在记录中间结束(通常是崩溃时写了一半)
+//	errCorruptRecord:    记录完整但校验或解码失败，n 为按记录头推算的长度(记录头本身损坏时为 0)
+//	其他:                读取出错
+//
+func readRecord(r io.Reader, rec *record) (n int64, err error) {
+
+	var hdr [recordHeaderLen]byte
+	_, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	if size > maxRecordLen {
+		return 0, errCorruptRecord
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	n = int64(recordHeaderLen + size)
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(hdr[4:]) {
+		return n, errCorruptRecord
+	}
+	*rec = record{}
+	err = gob.NewDecoder(bytes.NewReader(body)).Decode(rec)
+	if err != nil {
+		return n, errCorruptRecord
+	}
+	return n, nil
+}
+
+var errCorruptRecord = errors.New("qbsmeta: corrupt binlog record")
+
+const maxRecordLen = 16 << 20
+
+// ---------------------------------------------------------------------------
+
+// replay 重放 .binlog 中 Seq 大于快照的记录，并截掉末尾不完整的部分(崩溃时写了一半的最后一条记录)。
+// 读取出错，或损坏的记录之后仍有完整的记录时，说明 .binlog 中间损坏，返回错误而不截断，以免丢掉已提交的变更。
+//
+func (p *Store) replay() (err error) {
+
+	f, err := os.OpenFile(p.binlogFile(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Info(err, "os.OpenFile:", p.binlogFile()).Detail(err)
+	}
+
+	var off int64
+	r := bufio.NewReader(f)
+	for {
+		var rec record
+		n, err2 := readRecord(r, &rec)
+		if err2 == io.EOF || err2 == io.ErrUnexpectedEOF {
+			break
+		}
+		if err2 == errCorruptRecord && !hasRecordAt(f, off+n, n) {
+			break
+		}
+		if err2 != nil {
+			f.Close()
+			return errors.Info(err2, "qbsmeta.replay: read", p.binlogFile(), "at", off).Detail(err2)
+		}
+		off += n
+		if rec.Seq <= p.seq {
+			continue
+		}
+		if err = p.apply(&rec); err != nil {
+			f.Close()
+			return errors.Info(err, "qbsmeta.replay: apply", rec.Seq, rec.Op).Detail(err)
+		}
+		p.seq = rec.Seq
+		p.nlogs++
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Info(err, "qbsmeta.replay: stat", p.binlogFile()).Detail(err)
+	}
+	if fi.Size() != off {
+		log.Warn("qbsmeta.replay: truncate torn tail of", p.binlogFile(), "at", off, "size:", fi.Size())
+		err = f.Truncate(off)
+		if err != nil {
+			f.Close()
+			return errors.Info(err, "qbsmeta.replay: truncate", p.binlogFile(), off).Detail(err)
+		}
+	}
+	_, err = f.Seek(off, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return
+	}
+	p.binlog = f
+	p.logOff = off
+	return nil
+}
+
+// hasRecordAt 检查损坏记录之后的 off 处是否还有一条完整的记录。n 为损坏记录的长度，为 0 时无从定位下一条记录，
+// 视为有(即按中间损坏处理)。
+//
+func hasRecordAt(f *os.File, off, n int64) bool {
+
+	if n == 0 {
+		return true
+	}
+	var rec record
+	_, err := readRecord(io.NewSectionReader(f, off, maxRecordLen+recordHeaderLen), &rec)
+	return err == nil
+}
+
+// log 把一条已校验过的变更写入 .binlog 并应用到内存。调用者须持有 p.mutex。
+//
+func (p *Store) log(rec *record) (err error) {
+
+	if p.binlog == nil {
+		return syscall.EBADF
+	}
+	rec.Seq = p.seq + 1
+	b, err := encodeRecord(rec)
+	if err != nil {
+		return
+	}
+	_, err = p.binlog.Write(b)
+	if err != nil {
+		// 丢弃写了一半的记录，否则其后追加的记录在重放时都会被丢掉
+		p.binlog.Truncate(p.logOff)
+		p.binlog.Seek(p.logOff, io.SeekStart)
+		return errors.Info(err, "qbsmeta.log: write", p.binlogFile()).Detail(err)
+	}
+	p.logOff += int64(len(b))
+	if p.Fsync {
+		err = p.binlog.Sync()
+		if err != nil {
+			return errors.Info(err, "qbsmeta.log: fsync", p.binlogFile()).Detail(err)
+		}
+	}
+	err = p.apply(rec)
+	if err != nil {
+		return
+	}
+	p.seq = rec.Seq
+	p.nlogs++
+	return
+}
+
+// ---------------------------------------------------------------------------
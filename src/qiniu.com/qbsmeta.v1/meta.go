@@ -0,0 +1,880 @@
+package qbsmeta
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/qiniu/errors"
+	"qiniupkg.com/x/log.v7"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+// Store 是一个卷的元数据引擎，对应本地缓存结构中的：
+//
+//	$ssd/<VolumeId>/
+//		.metadata   快照
+//		.binlog     快照之后的变更日志
+//
+// 打开时加载快照并重放 binlog；Checkpoint 把 binlog 合并进新的快照并清空 binlog。
+//
+type Store struct {
+	Config
+
+	dir     string
+	inodes  map[uint64]*inode
+	nextIno uint64
+	seq     uint64 // 最后一条已应用的 binlog 记录
+	nlogs   int    // 上次 Checkpoint 后的 binlog 记录数
+	binlog  *os.File
+	logOff  int64
+	mutex   sync.Mutex
+
+	kick      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type Config struct {
+	// 每条 binlog 记录写入后是否 fsync。
+	//
+	Fsync bool `json:"fsync"`
+
+	// 定期 Checkpoint 的间隔(秒)。为 0 表示使用 DefaultCheckpointIntervalS，小于 0 表示不定期 Checkpoint。
+	//
+	CheckpointIntervalS int `json:"checkpoint_interval_s"`
+
+	// binlog 累计到这么多条记录时触发 Checkpoint。为 0 表示使用 DefaultCheckpointLogs。
+	//
+	CheckpointLogs int `json:"checkpoint_logs"`
+}
+
+const (
+	DefaultCheckpointIntervalS = 60
+	DefaultCheckpointLogs      = 100000
+)
+
+const (
+	MetadataFile = ".metadata"
+	BinlogFile   = ".binlog"
+)
+
+const RootIno uint64 = 1
+
+const nameLen = 255
+
+var (
+	ErrCorruptSnapshot = errors.New("qbsmeta: corrupt snapshot")
+)
+
+// Inode 是一个节点的元数据。
+//
+type Inode struct {
+	Attr   Attr
+	Parent uint64 // 仅目录
+	Target string // 仅软链接
+	Xattrs map[string][]byte
+}
+
+type inode struct {
+	Inode
+	entries map[string]uint64 // 仅目录
+}
+
+type Dirent struct {
+	Name  string
+	Inode uint64
+	Mode  os.FileMode
+}
+
+type Usage struct {
+	Inodes uint64
+	Bytes  uint64
+	Blocks uint64
+}
+
+// ---------------------------------------------------------------------------
+
+// Open 打开(必要时创建) dir 下的元数据。dir 一般为 $ssd/<VolumeId>。
+//
+func Open(dir string, cfg *Config) (p *Store, err error) {
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		err = errors.Info(err, "os.MkdirAll:", dir).Detail(err)
+		return
+	}
+
+	p = &Store{
+		Config: *cfg,
+		dir:    dir,
+		kick:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if p.CheckpointIntervalS == 0 {
+		p.CheckpointIntervalS = DefaultCheckpointIntervalS
+	}
+	if p.CheckpointLogs == 0 {
+		p.CheckpointLogs = DefaultCheckpointLogs
+	}
+
+	err = p.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if p.inodes == nil {
+		t := Time(time.Now().UnixNano())
+		root := &inode{
+			Inode: Inode{
+				Attr: Attr{
+					Inode: RootIno, Mode: os.ModeDir | 0755, Nlink: 2,
+					Atime: t, Mtime: t, Ctime: t, Crtime: t,
+				},
+				Parent: RootIno,
+			},
+			entries: make(map[string]uint64),
+		}
+		p.inodes = map[uint64]*inode{RootIno: root}
+		p.nextIno = RootIno + 1
+
+		// 新卷立即写出只含根目录的快照，使 .metadata 总是存在
+		err = p.saveSnapshot()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = p.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	go p.loop()
+	return
+}
+
+func (p *Store) metadataFile() string {
+
+	return filepath.Join(p.dir, MetadataFile)
+}
+
+func (p *Store) binlogFile() string {
+
+	return filepath.Join(p.dir, BinlogFile)
+}
+
+// Close 做最后一次 Checkpoint 并关闭 binlog。重复 Close 返回 EBADF。
+//
+func (p *Store) Close() (err error) {
+
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	<-p.done
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.binlog == nil {
+		return syscall.EBADF
+	}
+	err = p.checkpoint()
+	p.binlog.Close()
+	p.binlog = nil
+	return
+}
+
+func (p *Store) loop() {
+
+	defer close(p.done)
+
+	var tick <-chan time.Time
+	if p.CheckpointIntervalS > 0 {
+		ticker := time.NewTicker(time.Duration(p.CheckpointIntervalS) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-tick:
+		case <-p.kick:
+		}
+		err := p.Checkpoint()
+		if err != nil {
+			log.Error("qbsmeta.Checkpoint failed:", p.dir, err)
+		}
+	}
+}
+
+// Checkpoint 把 binlog 合并进新的 .metadata 快照，然后清空 binlog。
+//
+func (p *Store) Checkpoint() (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.checkpoint()
+}
+
+func (p *Store) checkpoint() (err error) {
+
+	if p.binlog == nil {
+		return syscall.EBADF
+	}
+	if p.nlogs == 0 {
+		return nil
+	}
+	err = p.saveSnapshot()
+	if err != nil {
+		return
+	}
+
+	// 快照已包含 Seq 以内的全部记录，即使截断前崩溃，重放时也会跳过它们
+	err = p.binlog.Truncate(0)
+	if err != nil {
+		return errors.Info(err, "qbsmeta.checkpoint: truncate", p.binlogFile()).Detail(err)
+	}
+	_, err = p.binlog.Seek(0, 0)
+	if err != nil {
+		return
+	}
+	p.logOff = 0
+	p.nlogs = 0
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// 查询
+
+// 调用者须持有 p.mutex。
+
+func (p *Store) get(ino uint64) (n *inode, err error) {
+
+	n, ok := p.inodes[ino]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return n, nil
+}
+
+func (p *Store) getDir(ino uint64) (n *inode, err error) {
+
+	n, err = p.get(ino)
+	if err != nil {
+		return
+	}
+	if !n.Attr.Mode.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	return
+}
+
+func (p *Store) Get(ino uint64) (ret Inode, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	ret = n.Inode
+	if n.Xattrs != nil {
+		ret.Xattrs = make(map[string][]byte, len(n.Xattrs))
+		for k, v := range n.Xattrs {
+			ret.Xattrs[k] = v
+		}
+	}
+	return
+}
+
+func (p *Store) Getattr(ino uint64) (attr Attr, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	return n.Attr, nil
+}
+
+func (p *Store) Lookup(parent uint64, name string) (ino uint64, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dir, err := p.getDir(parent)
+	if err != nil {
+		return
+	}
+	switch name {
+	case ".":
+		return parent, nil
+	case "..":
+		return dir.Parent, nil
+	}
+	ino, ok := dir.entries[name]
+	if !ok {
+		return 0, syscall.ENOENT
+	}
+	return ino, nil
+}
+
+// ReadDir 按名字顺序返回目录 ino 下的全部目录项（不含 "." 与 ".."）。
+//
+func (p *Store) ReadDir(ino uint64) (ents []Dirent, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dir, err := p.getDir(ino)
+	if err != nil {
+		return
+	}
+	ents = make([]Dirent, 0, len(dir.entries))
+	for name, child := range dir.entries {
+		var mode os.FileMode
+		if n, ok := p.inodes[child]; ok {
+			mode = n.Attr.Mode
+		}
+		ents = append(ents, Dirent{Name: name, Inode: child, Mode: mode})
+	}
+	sort.Sort(direntSlice(ents))
+	return
+}
+
+type direntSlice []Dirent
+
+func (p direntSlice) Len() int           { return len(p) }
+func (p direntSlice) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p direntSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func (p *Store) Readlink(ino uint64) (target string, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	if n.Attr.Mode&os.ModeSymlink == 0 {
+		return "", syscall.EINVAL
+	}
+	return n.Target, nil
+}
+
+func (p *Store) Getxattr(ino uint64, name string) (value []byte, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	value, ok := n.Xattrs[name]
+	if !ok {
+		return nil, syscall.ENODATA
+	}
+	return value, nil
+}
+
+func (p *Store) Listxattr(ino uint64) (names []string, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	names = make([]string, 0, len(n.Xattrs))
+	for name := range n.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Orphans 返回已没有目录项引用、但尚未 Free 的节点。进程重启后它们不再有打开的 handle，可以直接回收。
+//
+func (p *Store) Orphans() (inos []uint64) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for ino, n := range p.inodes {
+		if ino != RootIno && n.Attr.Nlink == 0 {
+			inos = append(inos, ino)
+		}
+	}
+	return
+}
+
+func (p *Store) Usage() (ret Usage) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.usage()
+}
+
+func (p *Store) usage() (ret Usage) {
+
+	ret.Inodes = uint64(len(p.inodes))
+	for _, n := range p.inodes {
+		ret.Bytes += n.Attr.Size
+		ret.Blocks += n.Attr.Blocks
+	}
+	return
+}
+
+// ---------------------------------------------------------------------------
+// 变更：先校验，再写 binlog，最后应用到内存
+
+func checkName(name string) error {
+
+	if name == "" || name == "." || name == ".." {
+		return syscall.EINVAL
+	}
+	if len(name) > nameLen {
+		return syscall.ENAMETOOLONG
+	}
+	return nil
+}
+
+func now() Time {
+
+	return Time(time.Now().UnixNano())
+}
+
+func (p *Store) commit(rec *record) (err error) {
+
+	err = p.log(rec)
+	if err == nil && p.nlogs >= p.CheckpointLogs {
+		select {
+		case p.kick <- struct{}{}:
+		default:
+		}
+	}
+	return
+}
+
+// Create 在目录 parent 下新建节点 name。attr.Inode 与 attr.Nlink 由 Store 分配，时间为 0 的字段取当前时间。
+// target 仅对软链接有意义。
+//
+func (p *Store) Create(parent uint64, name string, attr Attr, target string) (ret Attr, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dir, err := p.getDir(parent)
+	if err != nil {
+		return
+	}
+	if err = checkName(name); err != nil {
+		return
+	}
+	if _, ok := dir.entries[name]; ok {
+		err = syscall.EEXIST
+		return
+	}
+
+	t := now()
+	attr.Inode = p.nextIno
+	for _, pt := range []*Time{&attr.Atime, &attr.Mtime, &attr.Ctime, &attr.Crtime} {
+		if *pt == 0 {
+			*pt = t
+		}
+	}
+	rec := &record{Op: opCreate, Time: t, Ino: attr.Inode, Parent: parent, Name: name, Attr: attr, Target: target}
+	err = p.commit(rec)
+	if err != nil {
+		return
+	}
+	return p.inodes[attr.Inode].Attr, nil
+}
+
+// Link 在目录 parent 下新建指向 ino 的硬链接 name。
+//
+func (p *Store) Link(parent uint64, name string, ino uint64) (ret Attr, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dir, err := p.getDir(parent)
+	if err != nil {
+		return
+	}
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	if n.Attr.Mode.IsDir() {
+		err = syscall.EPERM
+		return
+	}
+	if err = checkName(name); err != nil {
+		return
+	}
+	if _, ok := dir.entries[name]; ok {
+		err = syscall.EEXIST
+		return
+	}
+	err = p.commit(&record{Op: opLink, Time: now(), Ino: ino, Parent: parent, Name: name})
+	if err != nil {
+		return
+	}
+	return n.Attr, nil
+}
+
+// Unlink 删除目录 parent 下的 name，dir 表示是否 rmdir。返回被删除的节点，若其 Nlink 降为 0，
+// 调用者在没有打开的 handle 后应调用 Free 回收它。
+//
+func (p *Store) Unlink(parent uint64, name string, dir bool) (ret Attr, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	d, err := p.getDir(parent)
+	if err != nil {
+		return
+	}
+	ino, ok := d.entries[name]
+	if !ok {
+		err = syscall.ENOENT
+		return
+	}
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	if dir {
+		if !n.Attr.Mode.IsDir() {
+			err = syscall.ENOTDIR
+			return
+		}
+		if len(n.entries) != 0 {
+			err = syscall.ENOTEMPTY
+			return
+		}
+	} else if n.Attr.Mode.IsDir() {
+		err = syscall.EISDIR
+		return
+	}
+	err = p.commit(&record{Op: opUnlink, Time: now(), Ino: ino, Parent: parent, Name: name})
+	if err != nil {
+		return
+	}
+	return n.Attr, nil
+}
+
+// isAncestor 判断目录 a 是否为目录 b 自身或其祖先。
+//
+func (p *Store) isAncestor(a, b uint64) bool {
+
+	for {
+		if a == b {
+			return true
+		}
+		if b == RootIno {
+			return false
+		}
+		n, ok := p.inodes[b]
+		if !ok {
+			return false
+		}
+		b = n.Parent
+	}
+}
+
+// Rename 把 oldParent/oldName 改名为 newParent/newName。若 newName 已存在则被替换，
+// replaced 返回被替换的节点(Inode 为 0 表示没有)。
+//
+func (p *Store) Rename(oldParent uint64, oldName string, newParent uint64, newName string) (replaced Attr, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	olddir, err := p.getDir(oldParent)
+	if err != nil {
+		return
+	}
+	newdir, err := p.getDir(newParent)
+	if err != nil {
+		return
+	}
+	if err = checkName(newName); err != nil {
+		return
+	}
+	ino, ok := olddir.entries[oldName]
+	if !ok {
+		err = syscall.ENOENT
+		return
+	}
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	isDir := n.Attr.Mode.IsDir()
+	if isDir && p.isAncestor(ino, newParent) {
+		err = syscall.EINVAL
+		return
+	}
+	var old *inode
+	if oldIno, ok := newdir.entries[newName]; ok {
+		if oldIno == ino {
+			return
+		}
+		if old, err = p.get(oldIno); err != nil {
+			return
+		}
+		switch {
+		case old.Attr.Mode.IsDir() && !isDir:
+			err = syscall.EISDIR
+		case !old.Attr.Mode.IsDir() && isDir:
+			err = syscall.ENOTDIR
+		case old.Attr.Mode.IsDir() && len(old.entries) != 0:
+			err = syscall.ENOTEMPTY
+		}
+		if err != nil {
+			return
+		}
+	}
+	rec := &record{Op: opRename, Time: now(), Ino: ino, Parent: oldParent, Name: oldName, NewParent: newParent, NewName: newName}
+	err = p.commit(rec)
+	if err == nil && old != nil {
+		replaced = old.Attr
+	}
+	return
+}
+
+// Setattr 替换 ino 的属性。Inode、Nlink 及文件类型位不会被修改。
+//
+func (p *Store) Setattr(ino uint64, attr Attr) (ret Attr, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	err = p.commit(&record{Op: opSetattr, Time: now(), Ino: ino, Attr: attr})
+	if err != nil {
+		return
+	}
+	return n.Attr, nil
+}
+
+const (
+	XattrCreate  = 1 // XATTR_CREATE
+	XattrReplace = 2 // XATTR_REPLACE
+)
+
+func (p *Store) Setxattr(ino uint64, name string, value []byte, flags uint32) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	_, ok := n.Xattrs[name]
+	if ok && flags&XattrCreate != 0 {
+		return syscall.EEXIST
+	}
+	if !ok && flags&XattrReplace != 0 {
+		return syscall.ENODATA
+	}
+	value = append([]byte(nil), value...)
+	return p.commit(&record{Op: opSetxattr, Time: now(), Ino: ino, Name: name, Value: value})
+}
+
+func (p *Store) Removexattr(ino uint64, name string) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	if _, ok := n.Xattrs[name]; !ok {
+		return syscall.ENODATA
+	}
+	return p.commit(&record{Op: opRemovexattr, Time: now(), Ino: ino, Name: name})
+}
+
+// Free 回收一个 Nlink 已为 0 的节点。
+//
+func (p *Store) Free(ino uint64) (err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.get(ino)
+	if err != nil {
+		return
+	}
+	if ino == RootIno || n.Attr.Nlink != 0 {
+		return syscall.EBUSY
+	}
+	return p.commit(&record{Op: opFree, Time: now(), Ino: ino})
+}
+
+// ---------------------------------------------------------------------------
+
+// apply 把一条记录应用到内存。记录在写入 binlog 前已校验过，这里只检查重放时可能出现的不一致。
+//
+func (p *Store) apply(rec *record) (err error) {
+
+	switch rec.Op {
+	case opCreate:
+		dir, err := p.getDir(rec.Parent)
+		if err != nil {
+			return err
+		}
+		n := &inode{Inode: Inode{Attr: rec.Attr, Target: rec.Target}}
+		n.Attr.Inode = rec.Ino
+		n.Attr.Nlink = 1
+		if n.Attr.Mode.IsDir() {
+			n.Attr.Nlink = 2
+			n.Parent = rec.Parent
+			n.entries = make(map[string]uint64)
+			dir.Attr.Nlink++
+		}
+		if n.Attr.Mode&os.ModeSymlink != 0 {
+			n.Attr.Size = uint64(len(rec.Target))
+		}
+		p.inodes[rec.Ino] = n
+		dir.entries[rec.Name] = rec.Ino
+		dir.Attr.Mtime, dir.Attr.Ctime = rec.Time, rec.Time
+		if rec.Ino >= p.nextIno {
+			p.nextIno = rec.Ino + 1
+		}
+
+	case opLink:
+		dir, err := p.getDir(rec.Parent)
+		if err != nil {
+			return err
+		}
+		n, err := p.get(rec.Ino)
+		if err != nil {
+			return err
+		}
+		dir.entries[rec.Name] = rec.Ino
+		dir.Attr.Mtime, dir.Attr.Ctime = rec.Time, rec.Time
+		n.Attr.Nlink++
+		n.Attr.Ctime = rec.Time
+
+	case opUnlink:
+		dir, err := p.getDir(rec.Parent)
+		if err != nil {
+			return err
+		}
+		p.unlink(dir, rec.Name, rec.Time)
+
+	case opRename:
+		olddir, err := p.getDir(rec.Parent)
+		if err != nil {
+			return err
+		}
+		newdir, err := p.getDir(rec.NewParent)
+		if err != nil {
+			return err
+		}
+		n, err := p.get(rec.Ino)
+		if err != nil {
+			return err
+		}
+		if _, ok := newdir.entries[rec.NewName]; ok {
+			p.unlink(newdir, rec.NewName, rec.Time)
+		}
+		delete(olddir.entries, rec.Name)
+		newdir.entries[rec.NewName] = rec.Ino
+		if n.Attr.Mode.IsDir() && rec.Parent != rec.NewParent {
+			n.Parent = rec.NewParent
+			olddir.Attr.Nlink--
+			newdir.Attr.Nlink++
+		}
+		olddir.Attr.Mtime, olddir.Attr.Ctime = rec.Time, rec.Time
+		newdir.Attr.Mtime, newdir.Attr.Ctime = rec.Time, rec.Time
+		n.Attr.Ctime = rec.Time
+
+	case opSetattr:
+		n, err := p.get(rec.Ino)
+		if err != nil {
+			return err
+		}
+		attr := rec.Attr
+		attr.Inode = n.Attr.Inode
+		attr.Nlink = n.Attr.Nlink
+		attr.Mode = n.Attr.Mode&os.ModeType | attr.Mode&^os.ModeType
+		n.Attr = attr
+
+	case opSetxattr:
+		n, err := p.get(rec.Ino)
+		if err != nil {
+			return err
+		}
+		if n.Xattrs == nil {
+			n.Xattrs = make(map[string][]byte)
+		}
+		n.Xattrs[rec.Name] = rec.Value
+		n.Attr.Ctime = rec.Time
+
+	case opRemovexattr:
+		n, err := p.get(rec.Ino)
+		if err != nil {
+			return err
+		}
+		delete(n.Xattrs, rec.Name)
+		n.Attr.Ctime = rec.Time
+
+	case opFree:
+		delete(p.inodes, rec.Ino)
+
+	default:
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+func (p *Store) unlink(dir *inode, name string, t Time) {
+
+	ino, ok := dir.entries[name]
+	if !ok {
+		return
+	}
+	delete(dir.entries, name)
+	dir.Attr.Mtime, dir.Attr.Ctime = t, t
+
+	n, ok := p.inodes[ino]
+	if !ok {
+		return
+	}
+	n.Attr.Ctime = t
+	if n.Attr.Mode.IsDir() {
+		n.Attr.Nlink = 0
+		dir.Attr.Nlink--
+	} else if n.Attr.Nlink > 0 {
+		n.Attr.Nlink--
+	}
+}
+
+// ---------------------------------------------------------------------------
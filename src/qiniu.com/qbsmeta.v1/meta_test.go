@@ -0,0 +1,214 @@
+package qbsmeta
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+var testConfig = &Config{CheckpointIntervalS: -1, CheckpointLogs: 1 << 30}
+
+func openStore(t *testing.T, dir string) *Store {
+
+	p, err := Open(dir, testConfig)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	return p
+}
+
+// crash 模拟进程崩溃：停止后台 Checkpoint 并关闭 binlog，但不做最后一次 Checkpoint。
+//
+func crash(p *Store) {
+
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	<-p.done
+	p.binlog.Close()
+	p.binlog = nil
+}
+
+func mustCreate(t *testing.T, p *Store, parent uint64, name string, mode os.FileMode) Attr {
+
+	attr, err := p.Create(parent, name, Attr{Mode: mode}, "")
+	if err != nil {
+		t.Fatal("Create:", name, err)
+	}
+	return attr
+}
+
+func mustLookup(t *testing.T, p *Store, parent uint64, name string) uint64 {
+
+	ino, err := p.Lookup(parent, name)
+	if err != nil {
+		t.Fatal("Lookup:", name, err)
+	}
+	return ino
+}
+
+func fileSize(t *testing.T, file string) int64 {
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// ---------------------------------------------------------------------------
+
+func TestReplay(t *testing.T) {
+
+	dir := t.TempDir()
+	p := openStore(t, dir)
+	a := mustCreate(t, p, RootIno, "a", 0644)
+	d := mustCreate(t, p, RootIno, "d", os.ModeDir|0755)
+	if _, err := p.Rename(RootIno, "a", d.Inode, "b"); err != nil {
+		t.Fatal("Rename:", err)
+	}
+	if err := p.Setxattr(a.Inode, "user.k", []byte("v"), 0); err != nil {
+		t.Fatal("Setxattr:", err)
+	}
+	crash(p)
+
+	p = openStore(t, dir)
+	defer p.Close()
+
+	if _, err := p.Lookup(RootIno, "a"); err != syscall.ENOENT {
+		t.Fatal("Lookup a:", err)
+	}
+	if ino := mustLookup(t, p, d.Inode, "b"); ino != a.Inode {
+		t.Fatal("Lookup d/b:", ino, a.Inode)
+	}
+	if v, err := p.Getxattr(a.Inode, "user.k"); err != nil || string(v) != "v" {
+		t.Fatal("Getxattr:", string(v), err)
+	}
+
+	// 重放后分配的 inode 不与已有的重复
+	c := mustCreate(t, p, RootIno, "c", 0644)
+	if c.Inode == a.Inode || c.Inode == d.Inode {
+		t.Fatal("inode reused:", c.Inode)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+
+	dir := t.TempDir()
+	p := openStore(t, dir)
+	mustCreate(t, p, RootIno, "a", 0644)
+	mustCreate(t, p, RootIno, "b", 0644)
+	if err := p.Checkpoint(); err != nil {
+		t.Fatal("Checkpoint:", err)
+	}
+	if size := fileSize(t, filepath.Join(dir, BinlogFile)); size != 0 {
+		t.Fatal("binlog not truncated:", size)
+	}
+	usage, err := ReadUsage(dir)
+	if err != nil || usage.Inodes != 3 {
+		t.Fatal("ReadUsage:", usage, err)
+	}
+
+	// Checkpoint 之后的变更在 binlog 中，与快照一起恢复
+	if _, err := p.Unlink(RootIno, "a", false); err != nil {
+		t.Fatal("Unlink:", err)
+	}
+	mustCreate(t, p, RootIno, "c", 0644)
+	crash(p)
+
+	p = openStore(t, dir)
+	defer p.Close()
+
+	if _, err := p.Lookup(RootIno, "a"); err != syscall.ENOENT {
+		t.Fatal("Lookup a:", err)
+	}
+	mustLookup(t, p, RootIno, "b")
+	mustLookup(t, p, RootIno, "c")
+}
+
+func TestTornTail(t *testing.T) {
+
+	dir := t.TempDir()
+	p := openStore(t, dir)
+	mustCreate(t, p, RootIno, "a", 0644)
+	mustCreate(t, p, RootIno, "b", 0644)
+	crash(p)
+
+	binlog := filepath.Join(dir, BinlogFile)
+	size := fileSize(t, binlog)
+
+	b, err := encodeRecord(&record{Seq: 100, Op: opCreate, Ino: 100, Parent: RootIno, Name: "torn", Attr: Attr{Inode: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tails := [][]byte{
+		b[:recordHeaderLen/2],  // 记录头写了一半
+		b[:len(b)-1],           // 包体写了一半
+		make([]byte, len(b)+5), // 文件扩展后未写入的 0
+	}
+	for _, tail := range tails {
+		f, err := os.OpenFile(binlog, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(tail)
+		f.Close()
+
+		p = openStore(t, dir)
+		mustLookup(t, p, RootIno, "a")
+		mustLookup(t, p, RootIno, "b")
+		if _, err := p.Lookup(RootIno, "torn"); err != syscall.ENOENT {
+			t.Fatal("Lookup torn:", err)
+		}
+		crash(p)
+		if got := fileSize(t, binlog); got != size {
+			t.Fatal("torn tail not truncated:", got, size)
+		}
+	}
+}
+
+func TestCorruptMiddle(t *testing.T) {
+
+	dir := t.TempDir()
+	p := openStore(t, dir)
+	mustCreate(t, p, RootIno, "a", 0644)
+	mustCreate(t, p, RootIno, "b", 0644)
+	crash(p)
+
+	// 破坏第一条记录的包体，其后的第二条记录仍然完整
+	binlog := filepath.Join(dir, BinlogFile)
+	size := fileSize(t, binlog)
+	f, err := os.OpenFile(binlog, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff, 0xff}, recordHeaderLen+4)
+	f.Close()
+
+	_, err = Open(dir, testConfig)
+	if err == nil {
+		t.Fatal("Open should fail on corruption in the middle of binlog")
+	}
+	if got := fileSize(t, binlog); got != size {
+		t.Fatal("binlog truncated:", got, size)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+
+	p := openStore(t, t.TempDir())
+	mustCreate(t, p, RootIno, "a", 0644)
+	if err := p.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if err := p.Close(); err != syscall.EBADF {
+		t.Fatal("second Close:", err)
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,150 @@
+package qbsmeta
+
+import (
+	"bufio"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+
+	"github.com/qiniu/errors"
+)
+
+// ---------------------------------------------------------------------------
+
+const snapshotVersion = 1
+
+// snapshotHeader 是 .metadata 的文件头，其后依次是 Count 个 snapshotInode。
+//
+type snapshotHeader struct {
+	Version uint32
+	Seq     uint64 // 快照已包含的最后一条 binlog 记录
+	NextIno uint64
+	Count   uint64
+	Usage   Usage // 供 ReadUsage 廉价读取
+}
+
+type snapshotInode struct {
+	Inode
+	Entries map[string]uint64
+}
+
+func (p *Store) loadSnapshot() (err error) {
+
+	f, err := os.Open(p.metadataFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Info(err, "os.Open:", p.metadataFile()).Detail(err)
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+
+	var hdr snapshotHeader
+	err = dec.Decode(&hdr)
+	if err != nil {
+		return errors.Info(ErrCorruptSnapshot, "qbsmeta.loadSnapshot: header", p.metadataFile()).Detail(err)
+	}
+	if hdr.Version != snapshotVersion {
+		return errors.Info(ErrCorruptSnapshot, "qbsmeta.loadSnapshot: unsupported version", hdr.Version)
+	}
+
+	inodes := make(map[uint64]*inode, hdr.Count)
+	for i := uint64(0); i < hdr.Count; i++ {
+		var si snapshotInode
+		err = dec.Decode(&si)
+		if err != nil {
+			return errors.Info(ErrCorruptSnapshot, "qbsmeta.loadSnapshot: inode", i).Detail(err)
+		}
+		inodes[si.Attr.Inode] = &inode{Inode: si.Inode, entries: si.Entries}
+	}
+	if _, ok := inodes[RootIno]; !ok {
+		return errors.Info(ErrCorruptSnapshot, "qbsmeta.loadSnapshot: no root", p.metadataFile())
+	}
+
+	p.inodes = inodes
+	p.seq = hdr.Seq
+	p.nextIno = hdr.NextIno
+	return nil
+}
+
+// saveSnapshot 把当前内存状态原子地写入 .metadata：先写临时文件并 fsync，再 rename 覆盖。
+// 调用者须持有 p.mutex。
+//
+func (p *Store) saveSnapshot() (err error) {
+
+	tmpFile := p.metadataFile() + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Info(err, "os.OpenFile:", tmpFile).Detail(err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	hdr := &snapshotHeader{
+		Version: snapshotVersion,
+		Seq:     p.seq,
+		NextIno: p.nextIno,
+		Count:   uint64(len(p.inodes)),
+		Usage:   p.usage(),
+	}
+	err = enc.Encode(hdr)
+	for _, ino := range p.inodes {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(&snapshotInode{Inode: ino.Inode, Entries: ino.entries})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFile)
+		return errors.Info(err, "qbsmeta.saveSnapshot: write", tmpFile).Detail(err)
+	}
+
+	err = os.Rename(tmpFile, p.metadataFile())
+	if err != nil {
+		os.Remove(tmpFile)
+		return errors.Info(err, "os.Rename:", tmpFile, p.metadataFile()).Detail(err)
+	}
+	return syncDir(filepath.Dir(p.metadataFile()))
+}
+
+// ReadUsage 只读取 dir 下 .metadata 的文件头，返回最近一次 Checkpoint 时的用量。
+// 它不加载快照、不重放 binlog，适合在卷未打开时频繁调用；卷被打开时结果最多落后一个 Checkpoint 周期。
+//
+func ReadUsage(dir string) (ret Usage, err error) {
+
+	file := filepath.Join(dir, MetadataFile)
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var hdr snapshotHeader
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&hdr)
+	if err != nil {
+		return ret, errors.Info(ErrCorruptSnapshot, "qbsmeta.ReadUsage:", file).Detail(err)
+	}
+	return hdr.Usage, nil
+}
+
+func syncDir(dir string) (err error) {
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	err = d.Sync()
+	d.Close()
+	return
+}
+
+// ---------------------------------------------------------------------------
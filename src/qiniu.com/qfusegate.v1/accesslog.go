@@ -0,0 +1,207 @@
+package qfusegate
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/qiniu/errors"
+	"qiniupkg.com/x/log.v7"
+)
+
+// ---------------------------------------------------------------------------
+
+const (
+	DefaultAccessLogMaxSizeMB  = 100
+	DefaultAccessLogMaxBackups = 5
+)
+
+// AccessLogArgs 是挂载的访问日志参数。日志每行一个 JSON 对象(accessEntry)，记录一个 FUSE 请求。
+//
+type AccessLogArgs struct {
+	// 日志文件路径。
+	//
+	Path string `json:"path"`
+
+	// 成功请求的采样比例，(0, 1]，0 表示全部记录。出错的请求总是记录。
+	//
+	SampleRate float64 `json:"sample_rate"`
+
+	// 日志文件超过 MaxSizeMB 时轮转为 <Path>.1、<Path>.2 …，最多保留 MaxBackups 个。0 表示使用默认值。
+	//
+	MaxSizeMB  int `json:"max_size_mb"`
+	MaxBackups int `json:"max_backups"`
+}
+
+// accessEntry 是访问日志的一行。reqid 与发往服务端的 X-Reqid 相同，可据此关联服务端日志。
+//
+type accessEntry struct {
+	Time      string `json:"time"` // 读到请求的时间，RFC3339Nano
+	Op        string `json:"op"`
+	Inode     uint64 `json:"inode"`
+	Handle    uint64 `json:"handle,omitempty"`
+	Name      string `json:"name,omitempty"`
+	NewName   string `json:"new_name,omitempty"`
+	Uid       uint32 `json:"uid"`
+	Gid       uint32 `json:"gid"`
+	Pid       uint32 `json:"pid"`
+	Reqid     string `json:"reqid"`
+	Target    string `json:"target,omitempty"` // 处理该请求的服务端，未发往服务端时为空
+	Status    int    `json:"status,omitempty"` // 服务端回复的 HTTP 状态码，未收到回复时为 0
+	Errno     int    `json:"errno,omitempty"`
+	LatencyUs int64  `json:"latency_us"` // 从读到请求(含排队时间)到回复的耗时
+}
+
+type accessLog struct {
+	path    string
+	rate    float64
+	maxSize int64
+	backups int
+
+	f     *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+func openAccessLog(args *AccessLogArgs) (p *accessLog, err error) {
+
+	p = &accessLog{
+		path:    args.Path,
+		rate:    args.SampleRate,
+		maxSize: int64(orDefault(args.MaxSizeMB, DefaultAccessLogMaxSizeMB)) << 20,
+		backups: orDefault(args.MaxBackups, DefaultAccessLogMaxBackups),
+	}
+	err = p.open()
+	return
+}
+
+func (p *accessLog) open() (err error) {
+
+	f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Info(err, "os.OpenFile:", p.path).Detail(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Info(err, "os.Stat:", p.path).Detail(err)
+	}
+	p.f, p.size = f, fi.Size()
+	return nil
+}
+
+// rotate 把 <path>.i 依次改名为 <path>.i+1，当前文件改名为 <path>.1，然后重新打开 path。
+//
+func (p *accessLog) rotate() (err error) {
+
+	p.f.Close()
+	p.f = nil
+	for i := p.backups - 1; i > 0; i-- {
+		os.Rename(p.path+"."+strconv.Itoa(i), p.path+"."+strconv.Itoa(i+1))
+	}
+	os.Rename(p.path, p.path+".1")
+	return p.open()
+}
+
+func (p *accessLog) log(r fuse.Request, c *opCall, reqid string) {
+
+	if c.errno == 0 && p.rate > 0 && p.rate < 1 && rand.Float64() >= p.rate {
+		return
+	}
+
+	h := r.Hdr()
+	e := &accessEntry{
+		Time:      c.start.Format(time.RFC3339Nano),
+		Op:        "unknown",
+		Inode:     uint64(h.Node),
+		Uid:       h.Uid,
+		Gid:       h.Gid,
+		Pid:       h.Pid,
+		Reqid:     reqid,
+		Target:    c.target,
+		Status:    c.status,
+		Errno:     int(c.errno),
+		LatencyUs: int64(time.Since(c.start) / time.Microsecond),
+	}
+	if c.op >= 0 {
+		e.Op = opNames[c.op]
+	}
+	if fh, ok := handleTarget(r); ok {
+		e.Handle = uint64(fh)
+	}
+	e.Name, e.NewName = namesOf(r)
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.f == nil { // 上次轮转失败
+		if err = p.open(); err != nil {
+			return
+		}
+	}
+	if p.size+int64(len(b)) > p.maxSize && p.size > 0 {
+		if err = p.rotate(); err != nil {
+			log.Warn("qfusegate: rotate access log failed:", err)
+			return
+		}
+	}
+	n, err := p.f.Write(b)
+	p.size += int64(n)
+	if err != nil {
+		log.Warn("qfusegate: write access log failed:", p.path, err)
+	}
+}
+
+func (p *accessLog) close() {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.f != nil {
+		p.f.Close()
+		p.f = nil
+	}
+}
+
+// namesOf 返回请求的名字参数。rename、symlink、link 的 newName 为新建的目录项名。
+//
+func namesOf(r fuse.Request) (name, newName string) {
+
+	switch r := r.(type) {
+	case *fuse.LookupRequest:
+		return r.Name, ""
+	case *fuse.CreateRequest:
+		return r.Name, ""
+	case *fuse.MkdirRequest:
+		return r.Name, ""
+	case *fuse.MknodRequest:
+		return r.Name, ""
+	case *fuse.RemoveRequest:
+		return r.Name, ""
+	case *fuse.SymlinkRequest:
+		return "", r.NewName
+	case *fuse.LinkRequest:
+		return "", r.NewName
+	case *fuse.RenameRequest:
+		return r.OldName, r.NewName
+	case *fuse.GetxattrRequest:
+		return r.Name, ""
+	case *fuse.SetxattrRequest:
+		return r.Name, ""
+	case *fuse.RemovexattrRequest:
+		return r.Name, ""
+	}
+	return "", ""
+}
+
+// ---------------------------------------------------------------------------
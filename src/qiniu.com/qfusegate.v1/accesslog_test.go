@@ -0,0 +1,147 @@
+package qfusegate
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// ---------------------------------------------------------------------------
+
+func readAccessLog(t *testing.T, path string) (entries []*accessEntry) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := new(accessEntry)
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			t.Fatalf("bad line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+func logLookup(p *accessLog, name string, errno fuse.Errno) {
+
+	r := &fuse.LookupRequest{Header: fuse.Header{ID: 7, Node: 5, Uid: 1000, Gid: 100, Pid: 42}, Name: name}
+	c := &opCall{op: opIndexOf(r), start: time.Now(), errno: errno, target: "http://10.0.0.1:7777", status: 404}
+	p.log(r, c, "prefix.7")
+}
+
+// ---------------------------------------------------------------------------
+
+func TestAccessLogEntry(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	p, err := openAccessLog(&AccessLogArgs{Path: path})
+	if err != nil {
+		t.Fatal("openAccessLog:", err)
+	}
+	logLookup(p, "a", fuse.Errno(syscall.ENOENT))
+	p.log(&fuse.ReadRequest{Handle: 9}, &opCall{op: opIndexOf(new(fuse.ReadRequest)), start: time.Now()}, "prefix.8")
+	p.close()
+
+	entries := readAccessLog(t, path)
+	if len(entries) != 2 {
+		t.Fatal("entries:", len(entries))
+	}
+	e := entries[0]
+	if e.Op != "lookup" || e.Inode != 5 || e.Name != "a" || e.Uid != 1000 || e.Gid != 100 || e.Pid != 42 ||
+		e.Reqid != "prefix.7" || e.Target != "http://10.0.0.1:7777" || e.Status != 404 || e.Errno != int(syscall.ENOENT) {
+		t.Fatalf("lookup entry: %+v", e)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, e.Time); err != nil {
+		t.Fatal("time:", e.Time, err)
+	}
+	if e = entries[1]; e.Op != "read" || e.Handle != 9 || e.Errno != 0 {
+		t.Fatalf("read entry: %+v", e)
+	}
+}
+
+func TestAccessLogSample(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	p, err := openAccessLog(&AccessLogArgs{Path: path, SampleRate: 0.2})
+	if err != nil {
+		t.Fatal("openAccessLog:", err)
+	}
+	const n = 2000
+	for i := 0; i < n; i++ {
+		logLookup(p, "ok", 0)
+	}
+	// 出错的请求不采样，总是记录
+	for i := 0; i < 100; i++ {
+		logLookup(p, "err", fuse.Errno(syscall.EIO))
+	}
+	p.close()
+
+	var ok, failed int
+	for _, e := range readAccessLog(t, path) {
+		if e.Errno != 0 {
+			failed++
+		} else {
+			ok++
+		}
+	}
+	if failed != 100 {
+		t.Fatal("errors should always be logged:", failed)
+	}
+	if ok < n/10 || ok > n*3/10 { // 期望 n/5
+		t.Fatal("sampled:", ok)
+	}
+}
+
+func TestAccessLogRotate(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	p, err := openAccessLog(&AccessLogArgs{Path: path, MaxSizeMB: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatal("openAccessLog:", err)
+	}
+	const maxSize = 1 << 20
+	if p.maxSize != maxSize {
+		t.Fatal("maxSize:", p.maxSize)
+	}
+
+	// 写满约 3.5 个文件，轮转 3 次，只保留 2 个备份
+	fi, _ := os.Stat(path)
+	logLookup(p, "x", 0)
+	fi2, _ := os.Stat(path)
+	lineSize := fi2.Size() - fi.Size()
+	for i := int64(1); i < 3*maxSize/lineSize+maxSize/lineSize/2; i++ {
+		logLookup(p, "x", 0)
+	}
+	p.close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > maxSize || fi.Size() == 0 {
+			t.Fatal("size:", name, fi.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("too many backups:", err)
+	}
+	for _, name := range []string{path + ".1", path + ".2"} {
+		if fi, _ := os.Stat(name); fi.Size() < maxSize-2*lineSize { // 各行长度略有不同
+			t.Fatal("rotated too early:", name, fi.Size())
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,256 @@
+package qfusegate
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/qiniu/http/httputil.v1"
+	"golang.org/x/net/context"
+	"qiniu.com/peercred.v1"
+)
+
+var (
+	ErrUnauthorized = httputil.NewError(401, "unauthorized: unknown peer or bad token")
+	ErrForbidden    = httputil.NewError(403, "forbidden by policy")
+)
+
+// ---------------------------------------------------------------------------
+
+// Caller 是允许访问控制接口的调用者及其权限。
+//
+type Caller struct {
+	Name string `json:"name"`
+
+	// 经 unix socket 访问时，对端进程 uid(SO_PEERCRED)在其中即为该调用者。
+	//
+	Uids []uint32 `json:"uids"`
+
+	// 经 TCP 访问时，请求带有 "Authorization: Bearer <Token>" 即为该调用者。
+	//
+	Token string `json:"token"`
+
+	// 允许操作的挂载点前缀(按路径逐级匹配)，为空表示不限制。
+	//
+	MountPrefixes []string `json:"mount_prefixes"`
+
+	// 允许挂载的服务端，为空表示不限制。每项可以是完整的 target(如 "unix:///var/run/qbolt.sock")、
+	// host:port 或 host。
+	//
+	Targets []string `json:"targets"`
+
+	// 以下限制只对受限的调用者(配置了 MountPrefixes 或 Targets)生效，挂载时 qfusegate 以 root 身份读写这些文件、
+	// 按这些参数转发调用者身份，默认不允许受限的调用者指定。
+	//
+	// FileDirs 是 access_log.path、sign_key_file 及 tls_* 文件允许所在的目录(按真实路径逐级匹配)。
+	// 这些目录不应允许调用者写入，否则调用者可以在挂载之后把文件换成指向别处的符号链接。
+	//
+	FileDirs []string `json:"file_dirs"`
+
+	// 不为 0 时允许指定 uid_map、gid_map、nobody_uid、nobody_gid。它们决定发往服务端的调用者身份，
+	// 调用者可以借此把自己映射为服务端的 root。
+	//
+	AllowIdMap int `json:"allow_id_map"`
+
+	// 不为 0 时允许指定 allow(allow_other、allow_root)。
+	//
+	AllowOther int `json:"allow_other"`
+}
+
+// AuthConfig 是控制接口的认证与授权配置。不配置时不做任何检查，任何能访问 bind_host 的人都能挂载。
+//
+type AuthConfig struct {
+	Callers []*Caller `json:"callers"`
+}
+
+// String 用于打印配置，不输出 Token。
+//
+func (p *Caller) String() string {
+
+	token := ""
+	if p.Token != "" {
+		token = "***"
+	}
+	return fmt.Sprintf("{Name:%s Uids:%v Token:%s MountPrefixes:%v Targets:%v FileDirs:%v AllowIdMap:%d AllowOther:%d}",
+		p.Name, p.Uids, token, p.MountPrefixes, p.Targets, p.FileDirs, p.AllowIdMap, p.AllowOther)
+}
+
+func (p *AuthConfig) String() string {
+
+	return fmt.Sprintf("{Callers:%v}", p.Callers)
+}
+
+type callerKey struct{}
+
+// Authenticate 返回先认证调用者再交给 h 处理的 http.Handler。未配置 Auth 时直接返回 h。
+// 无法认证的请求以 401 拒绝；调用者的授权由 PostMount 等按 Caller 的策略检查。
+//
+func (p *Service) Authenticate(h http.Handler) http.Handler {
+
+	if p.Auth == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		caller := p.Auth.callerOf(req)
+		if caller == nil {
+			httputil.Error(w, ErrUnauthorized)
+			return
+		}
+		ctx := context.WithValue(req.Context(), callerKey{}, caller)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func (p *AuthConfig) callerOf(req *http.Request) *Caller {
+
+	if peer, ok := peercred.FromRequest(req); ok {
+		for _, c := range p.Callers {
+			for _, uid := range c.Uids {
+				if uid == peer.Uid {
+					return c
+				}
+			}
+		}
+		return nil
+	}
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+	token := []byte(auth[len("Bearer "):])
+	for _, c := range p.Callers {
+		if c.Token != "" && subtle.ConstantTimeCompare([]byte(c.Token), token) == 1 {
+			return c
+		}
+	}
+	return nil
+}
+
+// authorize 检查请求的调用者能否操作挂载点 mountPoint 并使用 targets。未配置 Auth 时总是允许。
+//
+func (p *Service) authorize(req *http.Request, mountPoint string, targets []string) error {
+
+	if p.Auth == nil {
+		return nil
+	}
+	caller, _ := req.Context().Value(callerKey{}).(*Caller)
+	if caller == nil || !caller.allowMountPoint(mountPoint) {
+		return ErrForbidden
+	}
+	for _, t := range targets {
+		if !caller.allowTarget(t) {
+			return ErrForbidden
+		}
+	}
+	return nil
+}
+
+// authorizeMount 在 authorize 之外检查挂载参数中受限的调用者不能指定的部分，见 Caller.FileDirs 等。
+//
+func (p *Service) authorizeMount(req *http.Request, args *MountArgs) error {
+
+	err := p.authorize(req, args.MountPoint, targetsOf(args))
+	if err != nil || p.Auth == nil {
+		return err
+	}
+	caller, _ := req.Context().Value(callerKey{}).(*Caller)
+	if !caller.allowMountArgs(args) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (p *Caller) restricted() bool {
+
+	return len(p.MountPrefixes) != 0 || len(p.Targets) != 0
+}
+
+func (p *Caller) allowMountArgs(args *MountArgs) bool {
+
+	if !p.restricted() {
+		return true
+	}
+	if args.AllowMode != "" && p.AllowOther == 0 {
+		return false
+	}
+	idMapped := len(args.UidMap) != 0 || len(args.GidMap) != 0 || args.NobodyUid != 0 || args.NobodyGid != 0
+	if idMapped && p.AllowIdMap == 0 {
+		return false
+	}
+	files := []string{args.SignKeyFile, args.TLSCAFile, args.TLSCertFile, args.TLSKeyFile}
+	if args.AccessLog != nil {
+		files = append(files, args.AccessLog.Path)
+	}
+	for _, file := range files {
+		if file != "" && !underDirs(realPath(file), p.FileDirs) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Caller) allowMountPoint(mountPoint string) bool {
+
+	if len(p.MountPrefixes) == 0 {
+		return true
+	}
+	// 按真实路径检查，以免经符号链接把挂载点放到前缀之外
+	return underDirs(realPath(mountPoint), p.MountPrefixes)
+}
+
+// underDirs 判断 name 是否为 dirs 之一或在其之下，按路径逐级匹配。dirs 为空时返回 false。
+//
+func underDirs(name string, dirs []string) bool {
+
+	for _, dir := range dirs {
+		dir = path.Clean(dir)
+		if name == dir || strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// realPath 解析 name 中的符号链接。name 不存在时解析其存在的最近一级祖先，再接上其余部分，
+// 以免经尚不存在的路径(如符号链接目录下稍后创建的子目录)绕过检查。
+//
+func realPath(name string) string {
+
+	name, rest := path.Clean(name), ""
+	for {
+		if real, err := filepath.EvalSymlinks(name); err == nil {
+			return path.Join(real, rest)
+		}
+		dir := path.Dir(name)
+		if dir == name {
+			return path.Join(name, rest)
+		}
+		name, rest = dir, path.Join(path.Base(name), rest)
+	}
+}
+
+func (p *Caller) allowTarget(target string) bool {
+
+	if len(p.Targets) == 0 {
+		return true
+	}
+	var host, hostname string
+	if !strings.HasPrefix(target, unixScheme) {
+		if u, err := url.Parse(target); err == nil {
+			host, hostname = u.Host, u.Hostname()
+		}
+	}
+	for _, t := range p.Targets {
+		if t == target || (host != "" && (t == host || t == hostname)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,239 @@
+package qfusegate
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"qiniu.com/peercred.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+var testAuth = &AuthConfig{
+	Callers: []*Caller{
+		{Name: "kubelet", Uids: []uint32{uint32(os.Getuid())}},
+		{Name: "ops", Token: "ops-token"},
+		{Name: "ci", Token: "ci-token"},
+	},
+}
+
+func callerName(c *Caller) string {
+
+	if c == nil {
+		return ""
+	}
+	return c.Name
+}
+
+func TestCallerOfBearer(t *testing.T) {
+
+	cases := []struct {
+		auth string
+		want string
+	}{
+		{"Bearer ops-token", "ops"},
+		{"Bearer ci-token", "ci"},
+		{"Bearer ops-token2", ""},
+		{"Bearer ", ""}, // 没有 Token 的调用者不能以空 token 匹配
+		{"bearer ops-token", ""},
+		{"ops-token", ""},
+		{"", ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/v1/mounts", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		if got := callerName(testAuth.callerOf(req)); got != tc.want {
+			t.Fatalf("callerOf(%q): %q, want %q", tc.auth, got, tc.want)
+		}
+	}
+}
+
+func TestCallerOfPeer(t *testing.T) {
+
+	sock := filepath.Join(t.TempDir(), "qfusegate.sock")
+	l, err := peercred.Listen("unix:" + sock)
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(callerName(testAuth.callerOf(req))))
+	}))
+	ts.Listener.Close()
+	ts.Listener = l
+	ts.Config.ConnContext = peercred.ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", sock)
+		},
+	}}
+	get := func(token string) string {
+		req, _ := http.NewRequest("GET", "http://unix/v1/mounts", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	if got := get(""); got != "kubelet" {
+		t.Fatal("callerOf peer:", got)
+	}
+	// 经 unix socket 访问时只按 uid 认证，不接受 token
+	if got := get("ops-token"); got != "kubelet" {
+		t.Fatal("callerOf peer with token:", got)
+	}
+}
+
+func TestAllowMountPoint(t *testing.T) {
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := filepath.Join(dir, "mnt", "a")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{allowed, outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(allowed, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(allowed, filepath.Join(dir, "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	caller := &Caller{MountPrefixes: []string{allowed + "/"}}
+	cases := []struct {
+		mountPoint string
+		want       bool
+	}{
+		{allowed, true},
+		{allowed + "/", true},
+		{allowed + "/x", true},
+		{allowed + "/x/y", true},
+		{allowed + "b", false}, // 按路径逐级匹配，/mnt/a 不匹配 /mnt/ab
+		{allowed + "b/x", false},
+		{filepath.Dir(allowed), false},
+		{allowed + "/../b", false},
+		{allowed + "/x/../../a/y", true},
+		{filepath.Join(allowed, "escape"), false},           // 符号链接指向前缀之外
+		{filepath.Join(allowed, "escape", "x", "y"), false}, // 尚不存在的路径按其存在的祖先解析
+		{filepath.Join(dir, "inside"), true},                // 符号链接指向前缀之内
+		{filepath.Join(dir, "inside", "x"), true},
+	}
+	for _, tc := range cases {
+		if got := caller.allowMountPoint(tc.mountPoint); got != tc.want {
+			t.Fatalf("allowMountPoint(%q): %v, want %v", tc.mountPoint, got, tc.want)
+		}
+	}
+
+	if !(&Caller{}).allowMountPoint("/anywhere") {
+		t.Fatal("allowMountPoint without prefixes should allow all")
+	}
+}
+
+func TestAllowTarget(t *testing.T) {
+
+	caller := &Caller{Targets: []string{"unix:///var/run/qbolt.sock", "10.0.0.1", "10.0.0.2:7778"}}
+	cases := []struct {
+		target string
+		want   bool
+	}{
+		{"unix:///var/run/qbolt.sock", true},
+		{"unix:///var/run/qbolt2.sock", false},
+		{"http://10.0.0.1:7777", true}, // 只给出 host 时允许任何端口
+		{"https://10.0.0.1", true},
+		{"http://10.0.0.2:7778", true},
+		{"http://10.0.0.2:7777", false},
+		{"http://10.0.0.10:7777", false},
+		{"http://10.0.0.3", false},
+		{"unix://10.0.0.1", false}, // unix target 只按完整字符串匹配
+	}
+	for _, tc := range cases {
+		if got := caller.allowTarget(tc.target); got != tc.want {
+			t.Fatalf("allowTarget(%q): %v, want %v", tc.target, got, tc.want)
+		}
+	}
+
+	if !(&Caller{}).allowTarget("http://anywhere") {
+		t.Fatal("allowTarget without targets should allow all")
+	}
+}
+
+func TestAllowMountArgs(t *testing.T) {
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := filepath.Join(dir, "keys")
+	if err := os.MkdirAll(keys, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(keys, "passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	restricted := &Caller{MountPrefixes: []string{"/mnt"}, FileDirs: []string{keys}}
+	noFiles := &Caller{Targets: []string{"10.0.0.1"}}
+	trusted := &Caller{MountPrefixes: []string{"/mnt"}, AllowIdMap: 1, AllowOther: 1}
+	cases := []struct {
+		caller *Caller
+		args   MountArgs
+		want   bool
+	}{
+		{restricted, MountArgs{}, true},
+		{restricted, MountArgs{SignKeyFile: filepath.Join(keys, "k1")}, true},
+		{restricted, MountArgs{SignKeyFile: "/etc/shadow"}, false},
+		{restricted, MountArgs{SignKeyFile: filepath.Join(keys, "../k1")}, false},
+		{restricted, MountArgs{SignKeyFile: filepath.Join(keys, "passwd")}, false}, // 符号链接指向目录之外
+		{restricted, MountArgs{TransportArgs: TransportArgs{TLSArgs: TLSArgs{TLSCAFile: "/etc/ssl/ca.pem"}}}, false},
+		{restricted, MountArgs{TransportArgs: TransportArgs{TLSArgs: TLSArgs{TLSCertFile: "/root/c.pem", TLSKeyFile: filepath.Join(keys, "k.pem")}}}, false},
+		{restricted, MountArgs{TransportArgs: TransportArgs{TLSArgs: TLSArgs{TLSKeyFile: filepath.Join(keys, "k.pem")}}}, true},
+		{restricted, MountArgs{AccessLog: &AccessLogArgs{Path: "/etc/passwd"}}, false},
+		{restricted, MountArgs{AccessLog: &AccessLogArgs{Path: filepath.Join(keys, "access.log")}}, true},
+		{noFiles, MountArgs{SignKeyFile: filepath.Join(keys, "k1")}, false}, // 未配置 file_dirs 时不能指定文件
+		{restricted, MountArgs{UidMap: []IdMap{{Inside: 1000, Outside: 0, Count: 1}}}, false},
+		{restricted, MountArgs{GidMap: []IdMap{{Inside: 1000, Outside: 0, Count: 1}}}, false},
+		{restricted, MountArgs{NobodyUid: 1}, false},
+		{restricted, MountArgs{AllowMode: "allow_other"}, false},
+		{trusted, MountArgs{UidMap: []IdMap{{Inside: 1000, Outside: 0, Count: 1}}, AllowMode: "allow_other"}, true},
+		{trusted, MountArgs{SignKeyFile: filepath.Join(keys, "k1")}, false},
+		{&Caller{}, MountArgs{SignKeyFile: "/etc/shadow", NobodyUid: 1, AllowMode: "allow_other"}, true}, // 不受限的调用者
+	}
+	for i, tc := range cases {
+		if got := tc.caller.allowMountArgs(&tc.args); got != tc.want {
+			t.Fatalf("case %d: allowMountArgs(%+v): %v, want %v", i, tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestCallerString(t *testing.T) {
+
+	s := fmt.Sprint(testAuth)
+	if strings.Contains(s, "ops-token") || !strings.Contains(s, "ops") {
+		t.Fatal("token not redacted:", s)
+	}
+}
+
+// ---------------------------------------------------------------------------
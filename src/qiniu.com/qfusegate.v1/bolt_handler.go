@@ -5,15 +5,16 @@ package qfusegate
 
 import (
 	"encoding/gob"
+	"net/http"
 	"bazil.org/fuse"
 
 	. "golang.org/x/net/context"
 	. "qiniu.com/boltfs.proto.v1"
 )
 
-func handleInitRequest(ctx Context, host string, req *fuse.InitRequest) {
+func handleInitRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.InitRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(InitResponse)
 	args := &InitRequest{
@@ -24,7 +25,7 @@ func handleInitRequest(ctx Context, host string, req *fuse.InitRequest) {
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/init", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
@@ -32,29 +33,30 @@ func handleInitRequest(ctx Context, host string, req *fuse.InitRequest) {
 	fuseResp.MaxReadahead = ret.MaxReadahead
 	fuseResp.Flags = ret.Flags
 	fuseResp.MaxWrite = ret.MaxWrite
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleDestroyRequest(ctx Context, host string, req *fuse.DestroyRequest) {
+func handleDestroyRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.DestroyRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	err := client.Call(ctx, nil, "POST", host + "/v1/destroy")
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
 }
 
-func handleStatfsRequest(ctx Context, host string, req *fuse.StatfsRequest) {
+func handleStatfsRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.StatfsRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(StatfsResponse)
 	err := client.Call(ctx, ret, "POST", host + "/v1/statfs")
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
@@ -67,12 +69,13 @@ func handleStatfsRequest(ctx Context, host string, req *fuse.StatfsRequest) {
 	fuseResp.Bsize = ret.Bsize
 	fuseResp.Namelen = ret.Namelen
 	fuseResp.Frsize = ret.Frsize
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleAccessRequest(ctx Context, host string, req *fuse.AccessRequest) {
+func handleAccessRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.AccessRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	args := &AccessRequest{
 		Inode: uint64(req.Node),
@@ -80,15 +83,15 @@ func handleAccessRequest(ctx Context, host string, req *fuse.AccessRequest) {
 	}
 	err := client.CallWithGob(ctx, nil, "POST", host + "/v1/access", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
 }
 
-func handleGetattrRequest(ctx Context, host string, req *fuse.GetattrRequest) {
+func handleGetattrRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.GetattrRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(GetattrResponse)
 	args := &GetattrRequest{
@@ -96,18 +99,19 @@ func handleGetattrRequest(ctx Context, host string, req *fuse.GetattrRequest) {
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/getattr", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
 	fuseResp := new(fuse.GetattrResponse)
 	assignAttr(&fuseResp.Attr, &ret.Attr)
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleListxattrRequest(ctx Context, host string, req *fuse.ListxattrRequest) {
+func handleListxattrRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.ListxattrRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(ListxattrResponse)
 	args := &ListxattrRequest{
@@ -117,18 +121,19 @@ func handleListxattrRequest(ctx Context, host string, req *fuse.ListxattrRequest
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/listxattr", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
 	fuseResp := new(fuse.ListxattrResponse)
 	fuseResp.Xattr = ret.XattrNames
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleGetxattrRequest(ctx Context, host string, req *fuse.GetxattrRequest) {
+func handleGetxattrRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.GetxattrRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(GetxattrResponse)
 	args := &GetxattrRequest{
@@ -139,18 +144,19 @@ func handleGetxattrRequest(ctx Context, host string, req *fuse.GetxattrRequest)
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/getxattr", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
 	fuseResp := new(fuse.GetxattrResponse)
 	fuseResp.Xattr = ret.Xattr
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleRemovexattrRequest(ctx Context, host string, req *fuse.RemovexattrRequest) {
+func handleRemovexattrRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.RemovexattrRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	args := &RemovexattrRequest{
 		Inode: uint64(req.Node),
@@ -158,15 +164,15 @@ func handleRemovexattrRequest(ctx Context, host string, req *fuse.RemovexattrReq
 	}
 	err := client.CallWithGob(ctx, nil, "POST", host + "/v1/removexattr", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
 }
 
-func handleSetxattrRequest(ctx Context, host string, req *fuse.SetxattrRequest) {
+func handleSetxattrRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.SetxattrRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	args := &SetxattrRequest{
 		Inode: uint64(req.Node),
@@ -177,15 +183,15 @@ func handleSetxattrRequest(ctx Context, host string, req *fuse.SetxattrRequest)
 	}
 	err := client.CallWithGob(ctx, nil, "POST", host + "/v1/setxattr", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
 }
 
-func handleLookupRequest(ctx Context, host string, req *fuse.LookupRequest) {
+func handleLookupRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.LookupRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(LookupResponse)
 	args := &LookupRequest{
@@ -194,7 +200,7 @@ func handleLookupRequest(ctx Context, host string, req *fuse.LookupRequest) {
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/lookup", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
@@ -203,12 +209,13 @@ func handleLookupRequest(ctx Context, host string, req *fuse.LookupRequest) {
 	fuseResp.Generation = ret.Generation
 	fuseResp.EntryValid = ret.EntryValid
 	assignAttr(&fuseResp.Attr, &ret.Attr)
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleOpenRequest(ctx Context, host string, req *fuse.OpenRequest) {
+func handleOpenRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.OpenRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(OpenResponse)
 	args := &OpenRequest{
@@ -218,19 +225,24 @@ func handleOpenRequest(ctx Context, host string, req *fuse.OpenRequest) {
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/open", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
+		return
+	}
+	if !validHandle(ctx, ret.Handle) {
+		replyErrno(ctx, req, fuse.EIO)
 		return
 	}
 
 	fuseResp := new(fuse.OpenResponse)
-	fuseResp.Handle = fuse.HandleID(ret.Handle)
+	fuseResp.Handle = pinHandle(ctx, ret.Handle)
 	fuseResp.Flags = ret.Flags
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleCreateRequest(ctx Context, host string, req *fuse.CreateRequest) {
+func handleCreateRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.CreateRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(CreateResponse)
 	args := &CreateRequest{
@@ -241,7 +253,11 @@ func handleCreateRequest(ctx Context, host string, req *fuse.CreateRequest) {
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/create", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
+		return
+	}
+	if !validHandle(ctx, ret.Handle) {
+		replyErrno(ctx, req, fuse.EIO)
 		return
 	}
 
@@ -250,14 +266,15 @@ func handleCreateRequest(ctx Context, host string, req *fuse.CreateRequest) {
 	fuseResp.Generation = ret.Generation
 	fuseResp.EntryValid = ret.EntryValid
 	assignAttr(&fuseResp.Attr, &ret.Attr)
-	fuseResp.Handle = fuse.HandleID(ret.Handle)
+	fuseResp.Handle = pinHandle(ctx, ret.Handle)
 	fuseResp.Flags = ret.Flags
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleMkdirRequest(ctx Context, host string, req *fuse.MkdirRequest) {
+func handleMkdirRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.MkdirRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(MkdirResponse)
 	args := &MkdirRequest{
@@ -267,7 +284,7 @@ func handleMkdirRequest(ctx Context, host string, req *fuse.MkdirRequest) {
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/mkdir", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
@@ -276,12 +293,13 @@ func handleMkdirRequest(ctx Context, host string, req *fuse.MkdirRequest) {
 	fuseResp.Generation = ret.Generation
 	fuseResp.EntryValid = ret.EntryValid
 	assignAttr(&fuseResp.Attr, &ret.Attr)
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleSymlinkRequest(ctx Context, host string, req *fuse.SymlinkRequest) {
+func handleSymlinkRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.SymlinkRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(SymlinkResponse)
 	args := &SymlinkRequest{
@@ -291,7 +309,7 @@ func handleSymlinkRequest(ctx Context, host string, req *fuse.SymlinkRequest) {
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/symlink", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
@@ -300,12 +318,13 @@ func handleSymlinkRequest(ctx Context, host string, req *fuse.SymlinkRequest) {
 	fuseResp.Generation = ret.Generation
 	fuseResp.EntryValid = ret.EntryValid
 	assignAttr(&fuseResp.Attr, &ret.Attr)
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleReadlinkRequest(ctx Context, host string, req *fuse.ReadlinkRequest) {
+func handleReadlinkRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.ReadlinkRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(ReadlinkResponse)
 	args := &ReadlinkRequest{
@@ -313,15 +332,15 @@ func handleReadlinkRequest(ctx Context, host string, req *fuse.ReadlinkRequest)
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/readlink", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond(ret.Target)
 }
 
-func handleLinkRequest(ctx Context, host string, req *fuse.LinkRequest) {
+func handleLinkRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.LinkRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(LinkResponse)
 	args := &LinkRequest{
@@ -331,7 +350,7 @@ func handleLinkRequest(ctx Context, host string, req *fuse.LinkRequest) {
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/link", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
@@ -340,12 +359,13 @@ func handleLinkRequest(ctx Context, host string, req *fuse.LinkRequest) {
 	fuseResp.Generation = ret.Generation
 	fuseResp.EntryValid = ret.EntryValid
 	assignAttr(&fuseResp.Attr, &ret.Attr)
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleMknodRequest(ctx Context, host string, req *fuse.MknodRequest) {
+func handleMknodRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.MknodRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(MknodResponse)
 	args := &MknodRequest{
@@ -356,7 +376,7 @@ func handleMknodRequest(ctx Context, host string, req *fuse.MknodRequest) {
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/mknod", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
@@ -365,29 +385,31 @@ func handleMknodRequest(ctx Context, host string, req *fuse.MknodRequest) {
 	fuseResp.Generation = ret.Generation
 	fuseResp.EntryValid = ret.EntryValid
 	assignAttr(&fuseResp.Attr, &ret.Attr)
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleRenameRequest(ctx Context, host string, req *fuse.RenameRequest) {
+func handleRenameRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.RenameRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	args := &RenameRequest{
+		Inode: uint64(req.Node),
 		NewDirInode: uint64(req.NewDir),
 		OldName: req.OldName,
 		NewName: req.NewName,
 	}
 	err := client.CallWithGob(ctx, nil, "POST", host + "/v1/rename", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
 }
 
-func handleRemoveRequest(ctx Context, host string, req *fuse.RemoveRequest) {
+func handleRemoveRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.RemoveRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	args := &RemoveRequest{
 		Inode: uint64(req.Node),
@@ -396,70 +418,75 @@ func handleRemoveRequest(ctx Context, host string, req *fuse.RemoveRequest) {
 	}
 	err := client.CallWithGob(ctx, nil, "POST", host + "/v1/remove", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
 }
 
-func handleReadRequest(ctx Context, host string, req *fuse.ReadRequest) {
+func handleReadRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.ReadRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(ReadResponse)
 	args := &ReadRequest{
-		Handle: uint64(req.Handle),
+		Handle: handleOf(ctx, req.Handle),
 		Offset: req.Offset,
 		Size: req.Size,
 		Dir: req.Dir,
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/read", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
 	fuseResp := new(fuse.ReadResponse)
 	fuseResp.Data = ret.Data
+	countRead(ctx, len(fuseResp.Data))
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleWriteRequest(ctx Context, host string, req *fuse.WriteRequest) {
+func handleWriteRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.WriteRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(WriteResponse)
 	args := &WriteRequest{
-		Handle: uint64(req.Handle),
+		Handle: handleOf(ctx, req.Handle),
 		Offset: req.Offset,
 		Flags: req.Flags,
 		Data: req.Data,
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/write", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
+	countWritten(ctx, len(req.Data))
 
 	fuseResp := new(fuse.WriteResponse)
 	fuseResp.Size = ret.Size
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleSetattrRequest(ctx Context, host string, req *fuse.SetattrRequest) {
+func handleSetattrRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.SetattrRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	ret := new(SetattrResponse)
 	args := &SetattrRequest{
+		Inode: uint64(req.Node),
 		Valid: req.Valid,
-		Handle: uint64(req.Handle),
+		Handle: handleOf(ctx, req.Handle),
 		Size: req.Size,
 		Atime: Time(req.Atime.UnixNano()),
 		Mtime: Time(req.Mtime.UnixNano()),
 		Mode: req.Mode,
-		Uid: req.Uid,
-		Gid: req.Gid,
+		Uid: remoteUid(ctx, req.Uid),
+		Gid: remoteGid(ctx, req.Gid),
 		Bkuptime: Time(req.Bkuptime.UnixNano()),
 		Chgtime: Time(req.Chgtime.UnixNano()),
 		Crtime: Time(req.Crtime.UnixNano()),
@@ -467,55 +494,56 @@ func handleSetattrRequest(ctx Context, host string, req *fuse.SetattrRequest) {
 	}
 	err := client.CallWithGob(ctx, ret, "POST", host + "/v1/setattr", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 
 	fuseResp := new(fuse.SetattrResponse)
 	assignAttr(&fuseResp.Attr, &ret.Attr)
+	adjustResponse(ctx, req, fuseResp)
 	req.Respond(fuseResp)
 }
 
-func handleFlushRequest(ctx Context, host string, req *fuse.FlushRequest) {
+func handleFlushRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.FlushRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	args := &FlushRequest{
-		Handle: uint64(req.Handle),
+		Handle: handleOf(ctx, req.Handle),
 		LockOwner: req.LockOwner,
 		Flags: req.Flags,
 	}
 	err := client.CallWithGob(ctx, nil, "POST", host + "/v1/flush", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
 }
 
-func handleFsyncRequest(ctx Context, host string, req *fuse.FsyncRequest) {
+func handleFsyncRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.FsyncRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	args := &FsyncRequest{
-		Handle: uint64(req.Handle),
+		Handle: handleOf(ctx, req.Handle),
 		Flags: req.Flags,
 		Dir: req.Dir,
 	}
 	err := client.CallWithGob(ctx, nil, "POST", host + "/v1/fsync", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
 }
 
-func handleReleaseRequest(ctx Context, host string, req *fuse.ReleaseRequest) {
+func handleReleaseRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.ReleaseRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	args := &ReleaseRequest{
-		Handle: uint64(req.Handle),
+		Handle: handleOf(ctx, req.Handle),
 		Flags: req.Flags,
 		ReleaseFlags: req.ReleaseFlags,
 		LockOwner: req.LockOwner,
@@ -523,15 +551,15 @@ func handleReleaseRequest(ctx Context, host string, req *fuse.ReleaseRequest) {
 	}
 	err := client.CallWithGob(ctx, nil, "POST", host + "/v1/release", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
 }
 
-func handleForgetRequest(ctx Context, host string, req *fuse.ForgetRequest) {
+func handleForgetRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.ForgetRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	args := &ForgetRequest{
 		Inode: uint64(req.Node),
@@ -539,22 +567,22 @@ func handleForgetRequest(ctx Context, host string, req *fuse.ForgetRequest) {
 	}
 	err := client.CallWithGob(ctx, nil, "POST", host + "/v1/forget", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
 }
 
-func handleInterruptRequest(ctx Context, host string, req *fuse.InterruptRequest) {
+func handleInterruptRequest(ctx Context, host string, tr http.RoundTripper, req *fuse.InterruptRequest) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 	args := &InterruptRequest{
 		IntrReqId: uint64(req.IntrID),
 	}
 	err := client.CallWithGob(ctx, nil, "POST", host + "/v1/interrupt", args)
 	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
 		return
 	}
 	req.Respond()
@@ -605,3 +633,127 @@ func init() {
 	gob.RegisterName("InterruptRequest", InterruptRequest{})
 }
 
+const (
+	opInit = iota
+	opDestroy
+	opStatfs
+	opAccess
+	opGetattr
+	opListxattr
+	opGetxattr
+	opRemovexattr
+	opSetxattr
+	opLookup
+	opOpen
+	opCreate
+	opMkdir
+	opSymlink
+	opReadlink
+	opLink
+	opMknod
+	opRename
+	opRemove
+	opRead
+	opWrite
+	opSetattr
+	opFlush
+	opFsync
+	opRelease
+	opForget
+	opInterrupt
+	numOps
+)
+
+var opNames = [numOps]string{
+	"init",
+	"destroy",
+	"statfs",
+	"access",
+	"getattr",
+	"listxattr",
+	"getxattr",
+	"removexattr",
+	"setxattr",
+	"lookup",
+	"open",
+	"create",
+	"mkdir",
+	"symlink",
+	"readlink",
+	"link",
+	"mknod",
+	"rename",
+	"remove",
+	"read",
+	"write",
+	"setattr",
+	"flush",
+	"fsync",
+	"release",
+	"forget",
+	"interrupt",
+}
+
+// opIndexOf 返回 r 在 op 表中的序号，不在表中时返回 -1。
+//
+func opIndexOf(r fuse.Request) int {
+
+	switch r.(type) {
+	case *fuse.InitRequest:
+		return opInit
+	case *fuse.DestroyRequest:
+		return opDestroy
+	case *fuse.StatfsRequest:
+		return opStatfs
+	case *fuse.AccessRequest:
+		return opAccess
+	case *fuse.GetattrRequest:
+		return opGetattr
+	case *fuse.ListxattrRequest:
+		return opListxattr
+	case *fuse.GetxattrRequest:
+		return opGetxattr
+	case *fuse.RemovexattrRequest:
+		return opRemovexattr
+	case *fuse.SetxattrRequest:
+		return opSetxattr
+	case *fuse.LookupRequest:
+		return opLookup
+	case *fuse.OpenRequest:
+		return opOpen
+	case *fuse.CreateRequest:
+		return opCreate
+	case *fuse.MkdirRequest:
+		return opMkdir
+	case *fuse.SymlinkRequest:
+		return opSymlink
+	case *fuse.ReadlinkRequest:
+		return opReadlink
+	case *fuse.LinkRequest:
+		return opLink
+	case *fuse.MknodRequest:
+		return opMknod
+	case *fuse.RenameRequest:
+		return opRename
+	case *fuse.RemoveRequest:
+		return opRemove
+	case *fuse.ReadRequest:
+		return opRead
+	case *fuse.WriteRequest:
+		return opWrite
+	case *fuse.SetattrRequest:
+		return opSetattr
+	case *fuse.FlushRequest:
+		return opFlush
+	case *fuse.FsyncRequest:
+		return opFsync
+	case *fuse.ReleaseRequest:
+		return opRelease
+	case *fuse.ForgetRequest:
+		return opForget
+	case *fuse.InterruptRequest:
+		return opInterrupt
+	}
+	return -1
+}
+
@@ -2,16 +2,16 @@ package qfusegate
 
 import (
 	"bytes"
-	"encoding/binary"
-	"encoding/base64"
+	"crypto/rand"
+	"encoding/hex"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-	"unsafe"
 
 	"bazil.org/fuse"
 	"golang.org/x/net/context"
@@ -23,26 +23,122 @@ import (
 
 // ---------------------------------------------------------------------------
 
+// Conn 的运行状态。
+//
+const (
+	StateServing    = "serving"    // 正在服务
+	StateUnmounting = "unmounting" // 已请求取消挂载，等待 Serve 退出
+	StateFailed     = "failed"     // Serve 出错退出
+	StateStopped    = "stopped"    // Serve 正常退出，如在外部被 umount
+)
+
 type Conn struct {
-	target   string
+	targets  []*target
+	rr       uint32 // PolicyRoundRobin 的轮转计数
 	c        *fuse.Conn
 	readOnly bool
+
+	args     *MountArgs
+	start    time.Time
+	inflight int64 // 进行中的请求数，原子操作
+
+	done       chan struct{} // Serve 退出时关闭
+	serveErr   error
+	unmounting bool
+	mutex      sync.Mutex
+
+	pending map[fuse.RequestID]*pending // 进行中的请求，供 InterruptRequest 取消
+	cmutex  sync.Mutex
+
+	meta *lane
+	data *lane
+
+	metrics   *metrics
+	accessLog *accessLog // 未配置 AccessLog 时为 nil
+	ids       *idMapper
+	signKey   *signKey // 未配置 SignKeyId 时为 nil
+
+	// X-Reqid 的前缀，每次挂载随机生成。FUSE 请求 id 在每次挂载(包括 qfusegate 重启后恢复挂载)时从头开始，
+	// 加上前缀后才能在服务端区分不同挂载的请求，见 reqidOf。
+	//
+	reqidPrefix string
+}
+
+type pending struct {
+	cancel context.CancelFunc
+	target *target // 处理该请求的服务端，尚未选定时为 nil
 }
 
 func NewConn(c *fuse.Conn, args *MountArgs) (p *Conn, err error) {
 
+	targets, err := newTargets(args)
+	if err != nil {
+		return
+	}
+	key, err := loadSignKey(args)
+	if err != nil {
+		return
+	}
+	prefix, err := newReqidPrefix()
+	if err != nil {
+		return
+	}
+	var alog *accessLog
+	if args.AccessLog != nil {
+		alog, err = openAccessLog(args.AccessLog)
+		if err != nil {
+			return
+		}
+	}
 	p = &Conn{
-		c:        c,
-		target:   args.TargetFSHost,
-		readOnly: args.ReadOnly != 0,
+		targets:   targets,
+		c:         c,
+		readOnly:  args.ReadOnly != 0,
+		args:      args,
+		start:     time.Now(),
+		done:      make(chan struct{}),
+		pending:   make(map[fuse.RequestID]*pending),
+		metrics:   newMetrics(),
+		accessLog: alog,
+		ids:       newIdMapper(args),
+		signKey:   key,
+
+		reqidPrefix: prefix,
 	}
+	queueSize := orDefault(args.QueueSize, DefaultQueueSize)
+	p.meta = newLane(orDefault(args.MetaWorkers, DefaultMetaWorkers), queueSize)
+	p.data = newLane(orDefault(args.DataWorkers, DefaultDataWorkers), queueSize)
 	return
 }
 
+// Serve 读取并处理内核发来的请求，直到连接断开。返回前等待所有进行中的请求处理完毕。
+//
+// 请求按 isDataOp 分别交给元数据与数据两组 worker 处理。某一组的队列满时 Serve 阻塞，
+// 不再读取 /dev/fuse，由内核缓冲后续请求，从而限制对服务端的并发与内存占用。
+// 打断与 forget 请求不进入任何一组，读到即另起 goroutine 处理，不在已排队的请求之后等待。
+//
 func (p *Conn) Serve() (err error) {
 
 	var wg sync.WaitGroup
-	defer wg.Wait()
+	p.meta.start(&wg)
+	p.data.start(&wg)
+	go p.checkHealth()
+
+	defer func() {
+		p.meta.close()
+		p.data.close()
+		wg.Wait()
+		for _, t := range p.targets {
+			t.tr.CloseIdleConnections()
+		}
+		if p.accessLog != nil {
+			p.accessLog.close()
+		}
+		p.mutex.Lock()
+		p.serveErr = err
+		p.mutex.Unlock()
+		close(p.done)
+	}()
 
 	for {
 		req, err := p.c.ReadRequest()
@@ -53,81 +149,279 @@ func (p *Conn) Serve() (err error) {
 			return err
 		}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			p.serveRequest(req)
-		}()
+		// 打断请求在读取循环中立即生效，不必在队列中等待；被打断的请求可能还在排队
+		if r, ok := req.(*fuse.InterruptRequest); ok {
+			p.interrupt(r.IntrID)
+		}
+
+		// 在读取循环中登记，保证 InterruptRequest 到达时被打断的请求已经可以找到
+		ctx, cancel := context.WithCancel(context.Background())
+		id := req.Hdr().ID
+		p.cmutex.Lock()
+		p.pending[id] = &pending{cancel: cancel}
+		p.cmutex.Unlock()
+
+		atomic.AddInt64(&p.inflight, 1)
+		call := p.metrics.begin(req)
+		fn := func() {
+			defer atomic.AddInt64(&p.inflight, -1)
+			defer p.finish(req, call)
+			defer func() {
+				p.cmutex.Lock()
+				delete(p.pending, id)
+				p.cmutex.Unlock()
+				cancel()
+			}()
+			ctx := context.WithValue(ctx, opCallKey{}, call)
+			if ctx.Err() != nil { // 排队期间已被打断
+				replyErrno(ctx, req, fuse.EINTR)
+				return
+			}
+			p.serveRequest(ctx, req)
+		}
+		switch {
+		case isInlineOp(req):
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fn()
+			}()
+		case isDataOp(req):
+			p.data.put(fn)
+		default:
+			p.meta.put(fn)
+		}
 	}
 	return nil
 }
 
-func (p *Conn) serveRequest(r fuse.Request) {
+// finish 在请求回复后记录统计与访问日志。
+//
+func (p *Conn) finish(r fuse.Request, c *opCall) {
+
+	p.metrics.end(c)
+	if p.accessLog != nil {
+		p.accessLog.log(r, c, p.reqidOf(r.Hdr()))
+	}
+}
+
+func (p *Conn) served() bool {
+
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// setUnmounting 标记开始取消挂载。已在取消挂载中时返回 false。
+//
+func (p *Conn) setUnmounting(v bool) bool {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if v && p.unmounting {
+		return false
+	}
+	p.unmounting = v
+	return true
+}
+
+func (p *Conn) state() (state string, serveErr error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch {
+	case p.served() && p.serveErr != nil:
+		return StateFailed, p.serveErr
+	case p.served():
+		return StateStopped, nil
+	case p.unmounting:
+		return StateUnmounting, nil
+	}
+	return StateServing, nil
+}
+
+type mountStatus struct {
+	*MountArgs
+	State     string `json:"state"`
+	StartTime int64  `json:"start_time"` // 挂载时间(UnixNano)
+	LastError string `json:"last_error,omitempty"`
+	InFlight  int64  `json:"inflight"`             // 已读取但尚未回复的请求数，含排队中的请求
+	Retries   int    `json:"retries,omitempty"`    // StateRetrying：已重试的次数
+	NextRetry int64  `json:"next_retry,omitempty"` // StateRetrying：下次重试的时间(UnixNano)
+
+	MetaLane *laneStats      `json:"meta_lane"`
+	DataLane *laneStats      `json:"data_lane"`
+	Targets  []*targetStatus `json:"targets"`
+}
+
+func (p *Conn) targetStatus() (ret []*targetStatus) {
+
+	for i, name := range targetsOf(p.args) {
+		ret = append(ret, p.targets[i].status(name))
+	}
+	return
+}
+
+func (p *Conn) status() *mountStatus {
+
+	ret := &mountStatus{
+		MountArgs: p.args,
+		StartTime: p.start.UnixNano(),
+		InFlight:  atomic.LoadInt64(&p.inflight),
+		MetaLane:  p.meta.stats(),
+		DataLane:  p.data.stats(),
+		Targets:   p.targetStatus(),
+	}
+	state, serveErr := p.state()
+	ret.State = state
+	if serveErr != nil {
+		ret.LastError = serveErr.Error()
+	}
+	return ret
+}
+
+// ---------------------------------------------------------------------------
+
+// interrupt 取消 id 对应的进行中请求。该请求的 HTTP 调用随之返回，并以 EINTR 回复内核(见 replyError)。
+// 找不到时说明请求已经处理完毕，什么也不做。
+//
+func (p *Conn) interrupt(id fuse.RequestID) {
+
+	p.cmutex.Lock()
+	r, ok := p.pending[id]
+	p.cmutex.Unlock()
+
+	if ok {
+		r.cancel()
+	}
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+func (p *Conn) pendingTarget(id fuse.RequestID) *target {
+
+	p.cmutex.Lock()
+	defer p.cmutex.Unlock()
+
+	if r, ok := p.pending[id]; ok {
+		return r.target
+	}
+	return nil
+}
+
+// modifies 判断 r 是否修改文件系统。只读挂载在本地以 EROFS 拒绝这些请求，
+// 不依赖内核的 ro 标志与服务端(如 remount 之后或服务端不做检查时)。
+//
+func modifies(r fuse.Request) bool {
+
+	switch r := r.(type) {
+	case *fuse.WriteRequest, *fuse.CreateRequest, *fuse.MkdirRequest,
+		*fuse.SymlinkRequest, *fuse.LinkRequest, *fuse.MknodRequest,
+		*fuse.RenameRequest, *fuse.RemoveRequest, *fuse.SetattrRequest,
+		*fuse.SetxattrRequest, *fuse.RemovexattrRequest:
+		return true
+	case *fuse.OpenRequest:
+		return !r.Flags.IsReadOnly() || r.Flags&fuse.OpenTruncate != 0
+	}
+	return false
+}
+
+type connKey struct{}
+
+// connOf 返回处理请求的 Conn，供 bolt_handler.go 按挂载参数转换请求与回复。
+//
+func connOf(ctx context.Context) *Conn {
+
+	c, _ := ctx.Value(connKey{}).(*Conn)
+	return c
+}
+
+func (p *Conn) serveRequest(ctx context.Context, r fuse.Request) {
+
+	if p.readOnly && modifies(r) {
+		replyErrno(ctx, r, fuse.Errno(syscall.EROFS))
+		return
+	}
+
+	t := p.pick(r)
+	ctx = context.WithValue(ctx, targetKey{}, t)
+	ctx = context.WithValue(ctx, connKey{}, p)
+	if c := callOf(ctx); c != nil {
+		c.target = targetsOf(p.args)[t.idx]
+	}
+	if _, ok := handleTarget(r); ok {
+		ctx = context.WithValue(ctx, pinnedKey{}, true)
+	}
+	p.cmutex.Lock()
+	if pr, ok := p.pending[r.Hdr().ID]; ok {
+		pr.target = t
+	}
+	p.cmutex.Unlock()
 
 	switch r := r.(type) {
 	// Handle operations.
 	case *fuse.ReadRequest:
-		handleReadRequest(ctx, p.target, r)
+		handleReadRequest(ctx, t.host, t.tr, r)
 	case *fuse.WriteRequest:
-		handleWriteRequest(ctx, p.target, r)
+		handleWriteRequest(ctx, t.host, t.tr, r)
 	case *fuse.FlushRequest:
-		handleFlushRequest(ctx, p.target, r)
+		handleFlushRequest(ctx, t.host, t.tr, r)
 	case *fuse.FsyncRequest:
-		handleFsyncRequest(ctx, p.target, r)
+		handleFsyncRequest(ctx, t.host, t.tr, r)
 	case *fuse.ReleaseRequest:
-		handleReleaseRequest(ctx, p.target, r)
+		handleReleaseRequest(ctx, t.host, t.tr, r)
 
 	// Node operations.
 	case *fuse.AccessRequest:
-		handleAccessRequest(ctx, p.target, r)
+		handleAccessRequest(ctx, t.host, t.tr, r)
 	case *fuse.GetattrRequest:
-		handleGetattrRequest(ctx, p.target, r)
+		handleGetattrRequest(ctx, t.host, t.tr, r)
 	case *fuse.SetattrRequest:
-		handleSetattrRequest(ctx, p.target, r)
+		handleSetattrRequest(ctx, t.host, t.tr, r)
 	case *fuse.SymlinkRequest:
-		handleSymlinkRequest(ctx, p.target, r)
+		handleSymlinkRequest(ctx, t.host, t.tr, r)
 	case *fuse.ReadlinkRequest:
-		handleReadlinkRequest(ctx, p.target, r)
+		handleReadlinkRequest(ctx, t.host, t.tr, r)
 	case *fuse.LinkRequest:
-		handleLinkRequest(ctx, p.target, r)
+		handleLinkRequest(ctx, t.host, t.tr, r)
 	case *fuse.RemoveRequest:
-		handleRemoveRequest(ctx, p.target, r)
+		handleRemoveRequest(ctx, t.host, t.tr, r)
 	case *fuse.LookupRequest:
-		handleLookupRequest(ctx, p.target, r)
+		handleLookupRequest(ctx, t.host, t.tr, r)
 	case *fuse.MkdirRequest:
-		handleMkdirRequest(ctx, p.target, r)
+		handleMkdirRequest(ctx, t.host, t.tr, r)
 	case *fuse.OpenRequest:
-		handleOpenRequest(ctx, p.target, r)
+		handleOpenRequest(ctx, t.host, t.tr, r)
 	case *fuse.CreateRequest:
-		handleCreateRequest(ctx, p.target, r)
+		handleCreateRequest(ctx, t.host, t.tr, r)
 	case *fuse.GetxattrRequest:
-		handleGetxattrRequest(ctx, p.target, r)
+		handleGetxattrRequest(ctx, t.host, t.tr, r)
 	case *fuse.ListxattrRequest:
-		handleListxattrRequest(ctx, p.target, r)
+		handleListxattrRequest(ctx, t.host, t.tr, r)
 	case *fuse.SetxattrRequest:
-		handleSetxattrRequest(ctx, p.target, r)
+		handleSetxattrRequest(ctx, t.host, t.tr, r)
 	case *fuse.RemovexattrRequest:
-		handleRemovexattrRequest(ctx, p.target, r)
+		handleRemovexattrRequest(ctx, t.host, t.tr, r)
 	case *fuse.RenameRequest:
-		handleRenameRequest(ctx, p.target, r)
+		handleRenameRequest(ctx, t.host, t.tr, r)
 	case *fuse.MknodRequest:
-		handleMknodRequest(ctx, p.target, r)
+		handleMknodRequest(ctx, t.host, t.tr, r)
 	case *fuse.ForgetRequest:
-		handleForgetRequest(ctx, p.target, r)
+		handleForgetRequest(ctx, t.host, t.tr, r)
 
 	// FS operations.
 	case *fuse.InterruptRequest:
-		handleInterruptRequest(ctx, p.target, r)
+		// 已在 Serve 中取消了被打断的请求，这里仍然通知服务端，以便它中止相应的服务端工作
+		handleInterruptRequest(ctx, t.host, t.tr, r)
 	case *fuse.InitRequest:
-		handleInitRequest(ctx, p.target, r)
+		handleInitRequest(ctx, t.host, t.tr, r)
 	case *fuse.StatfsRequest:
-		handleStatfsRequest(ctx, p.target, r)
+		handleStatfsRequest(ctx, t.host, t.tr, r)
 	case *fuse.DestroyRequest:
-		handleDestroyRequest(ctx, p.target, r)
-	}
+		handleDestroyRequest(ctx, t.host, t.tr, r)
 
 	// Note: To FUSE, ENOSYS means "this server never implements this request."
 	// It would be inappropriate to return ENOSYS for other operations in this
@@ -149,62 +443,28 @@ func (p *Conn) serveRequest(r fuse.Request) {
 		done(ENOSYS)
 		r.RespondError(ENOSYS)
 	*/
-	r.RespondError(fuse.ENOSYS)
-}
-
-func replyError(r fuse.Request, err error) {
-
-	if e, ok := err.(*rpc.ErrorInfo); ok && e.Errno != 0 {
-		r.RespondError(fuse.Errno(e.Errno))
-	} else {
-		r.RespondError(err)
-	}
-}
-
-func respondError(r fuse.Request, resp io.Reader) {
-
-	var errno int32
-	err := fromReader(unsafe.Pointer(&errno), 4, resp)
-	if err != nil {
-		r.RespondError(err)
-	} else {
-		r.RespondError(fuse.Errno(errno))
+	default:
+		replyErrno(ctx, r, fuse.ENOSYS)
 	}
 }
 
-func toReader(p unsafe.Pointer, n uintptr) (r io.Reader) {
+// replyError 把服务端错误转为 errno 回复内核，见 handleError。
+//
+func replyError(ctx context.Context, r fuse.Request, err error) {
 
-	b := ((*[1<<30]byte)(p))[:n]
-	return bytes.NewReader(b)
+	replyErrno(ctx, r, handleError(ctx, err))
 }
 
-func fromReader(p unsafe.Pointer, n uintptr, r io.Reader) (err error) {
-
-	b := ((*[1<<30]byte)(p))[:n]
-	_, err = io.ReadFull(r, b)
-	return
-}
-
-func fromReaderEx(p unsafe.Pointer, n uintptr, ret interface{}, r io.Reader) (err error) {
+// handleError 返回请求出错时回复内核的 errno：请求被 InterruptRequest 取消时为 EINTR，
+// 否则为 errnoOf(err)，传输错误同时把服务端标记为不健康(见 reportError)。
+//
+func handleError(ctx context.Context, err error) fuse.Errno {
 
-	b := ((*[1<<30]byte)(p))[:n]
-	_, err = io.ReadFull(r, b)
-	if err != nil {
-		return
+	if ctx.Err() == context.Canceled {
+		return fuse.EINTR
 	}
-	data, err := ioutil.ReadAll(r)
-	if err != nil {
-		return
-	}
-	switch ret := ret.(type) {
-	case *string:
-		*ret = string(data)
-	case *[]byte:
-		*ret = data
-	default:
-		panic("fromReaderEx: unexpected")
-	}
-	return
+	reportError(ctx, err)
+	return errnoOf(err)
 }
 
 // ---------------------------------------------------------------------------
@@ -252,41 +512,80 @@ func assignAttr(dest *fuse.Attr, src *Attr) {
 // ---------------------------------------------------------------------------
 
 type transportImpl struct {
-	auth  string
-	reqid string
-	base  http.RoundTripper
+	identity string
+	reqid    string
+	key      *signKey // 为 nil 时使用旧的不签名格式
+	base     http.RoundTripper
 }
 
 // Authorization: QBolt base64(<Uid/Gid/Pid:uint32>)
-// X-Reqid: <Reqid:uint64>
+// X-Reqid: <Prefix>.base36(<Reqid:uint64>)
+//
+// 挂载配置了 SignKeyId 时改为签名格式，见 signKey.sign。
+// 其中 Uid/Gid 按挂载的 UidMap/GidMap 转换为服务端的 id。
 //
-func newBoltTransport(req *fuse.Header, base http.RoundTripper) *transportImpl {
+func newBoltTransport(ctx context.Context, req *fuse.Header, base http.RoundTripper) *transportImpl {
 
-	var b [12]byte
-	binary.LittleEndian.PutUint32(b[:], req.Uid)
-	binary.LittleEndian.PutUint32(b[4:], req.Gid)
-	binary.LittleEndian.PutUint32(b[8:], req.Pid)
-	auth := "QBolt " + base64.URLEncoding.EncodeToString(b[:])
+	uid, gid := req.Uid, req.Gid
+	var key *signKey
+	if c := connOf(ctx); c != nil {
+		uid, gid = c.ids.remoteUid(uid), c.ids.remoteGid(gid)
+		key = c.signKey
+	}
+	identity := EncodeIdentity(uid, gid, req.Pid)
 
 	reqid := strconv.FormatUint(uint64(req.ID), 36)
+	if c := connOf(ctx); c != nil {
+		reqid = c.reqidOf(req)
+	}
 
 	if base == nil {
 		base = http.DefaultTransport
 	}
-	return &transportImpl{auth: auth, reqid: reqid, base: base}
+	return &transportImpl{identity: identity, reqid: reqid, key: key, base: base}
 }
 
-func newBoltClient(req *fuse.Header, base http.RoundTripper) gob.Client {
+// reqidOf 返回请求的 X-Reqid，即 <reqidPrefix>.base36(<FUSE 请求 id>)。访问日志中也记录同一值。
+//
+func (p *Conn) reqidOf(req *fuse.Header) string {
+
+	return p.reqidPrefix + strconv.FormatUint(uint64(req.ID), 36)
+}
+
+func newReqidPrefix() (prefix string, err error) {
+
+	var b [8]byte
+	_, err = io.ReadFull(rand.Reader, b[:])
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(b[:]) + ".", nil
+}
 
-	tr := newBoltTransport(req, base)
+func newBoltClient(ctx context.Context, req *fuse.Header, base http.RoundTripper) gob.Client {
+
+	tr := newBoltTransport(ctx, req, base)
 	return gob.Client{rpc.Client{&http.Client{Transport: tr}}}
 }
 
 func (p *transportImpl) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 
-	req.Header.Set("Authorization", p.auth)
 	req.Header.Set("X-Reqid", p.reqid)
-	return p.base.RoundTrip(req)
+	if p.key != nil {
+		err = p.key.sign(req, p.identity, p.reqid)
+		if err != nil {
+			return
+		}
+	} else {
+		req.Header.Set("Authorization", LegacyScheme+p.identity)
+	}
+	resp, err = p.base.RoundTrip(req)
+	if err == nil {
+		if c := callOf(req.Context()); c != nil {
+			c.status = resp.StatusCode
+		}
+	}
+	return
 }
 
 // ---------------------------------------------------------------------------
@@ -0,0 +1,105 @@
+package qfusegate
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"qiniupkg.com/x/rpc.v7"
+)
+
+// ---------------------------------------------------------------------------
+
+func TestHandleError(t *testing.T) {
+
+	p := newTestConn(2)
+	tg := p.targets[0]
+	newCtx := func() context.Context {
+		return context.WithValue(context.Background(), targetKey{}, tg)
+	}
+	transportErr := errors.New("dial tcp: connection refused")
+
+	// 被打断的请求回复 EINTR，不论服务端的错误是什么，也不把服务端标记为不健康
+	ctx, cancel := context.WithCancel(newCtx())
+	cancel()
+	if errno := handleError(ctx, transportErr); errno != fuse.EINTR {
+		t.Fatal("canceled:", errno)
+	}
+	if !tg.isHealthy() {
+		t.Fatal("canceled request should not mark the target unhealthy")
+	}
+
+	// 服务端的出错回复按其 errno 回复，服务端仍是健康的
+	if errno := handleError(newCtx(), &rpc.ErrorInfo{Code: 404, Errno: int(syscall.ENOENT)}); errno != fuse.Errno(syscall.ENOENT) {
+		t.Fatal("server error:", errno)
+	}
+	if errno := handleError(newCtx(), &rpc.ErrorInfo{Code: 500}); errno != fuse.EIO {
+		t.Fatal("server error without errno:", errno)
+	}
+	if !tg.isHealthy() {
+		t.Fatal("server error should not mark the target unhealthy")
+	}
+
+	// 超时不是打断
+	ctx, cancel = context.WithTimeout(newCtx(), 0)
+	defer cancel()
+	<-ctx.Done()
+	if errno := handleError(ctx, transportErr); errno != fuse.EIO {
+		t.Fatal("deadline exceeded:", errno)
+	}
+
+	// 传输错误回复 EIO 并把服务端标记为不健康
+	if errno := handleError(newCtx(), transportErr); errno != fuse.EIO {
+		t.Fatal("transport error:", errno)
+	}
+	if tg.isHealthy() {
+		t.Fatal("transport error should mark the target unhealthy")
+	}
+}
+
+func TestModifies(t *testing.T) {
+
+	cases := []struct {
+		req  fuse.Request
+		want bool
+	}{
+		{new(fuse.WriteRequest), true},
+		{new(fuse.CreateRequest), true},
+		{new(fuse.MkdirRequest), true},
+		{new(fuse.SymlinkRequest), true},
+		{new(fuse.LinkRequest), true},
+		{new(fuse.MknodRequest), true},
+		{new(fuse.RenameRequest), true},
+		{new(fuse.RemoveRequest), true},
+		{new(fuse.SetattrRequest), true},
+		{new(fuse.SetxattrRequest), true},
+		{new(fuse.RemovexattrRequest), true},
+		{&fuse.OpenRequest{Flags: fuse.OpenReadOnly}, false},
+		{&fuse.OpenRequest{Flags: fuse.OpenReadOnly, Dir: true}, false},
+		{&fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, true},
+		{&fuse.OpenRequest{Flags: fuse.OpenReadWrite}, true},
+		{&fuse.OpenRequest{Flags: fuse.OpenReadOnly | fuse.OpenTruncate}, true},
+		{new(fuse.ReadRequest), false},
+		{new(fuse.LookupRequest), false},
+		{new(fuse.GetattrRequest), false},
+		{new(fuse.GetxattrRequest), false},
+		{new(fuse.ListxattrRequest), false},
+		{new(fuse.ReadlinkRequest), false},
+		{new(fuse.AccessRequest), false},
+		{new(fuse.StatfsRequest), false},
+		{new(fuse.FlushRequest), false}, // 只读打开的文件也会 flush、fsync、release
+		{new(fuse.FsyncRequest), false},
+		{new(fuse.ReleaseRequest), false},
+		{new(fuse.ForgetRequest), false},
+		{new(fuse.InterruptRequest), false},
+	}
+	for _, tc := range cases {
+		if got := modifies(tc.req); got != tc.want {
+			t.Fatalf("modifies(%T %+v): %v", tc.req, tc.req, got)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,106 @@
+package qfusegate
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// ---------------------------------------------------------------------------
+
+const DefaultNobody = 65534
+
+// IdMap 把本机的 [Inside, Inside+Count) 映射到服务端的 [Outside, Outside+Count)，同 user namespace 的 uid_map/gid_map。
+//
+type IdMap struct {
+	Inside  uint32 `json:"inside"`
+	Outside uint32 `json:"outside"`
+	Count   uint32 `json:"count"`
+}
+
+// idMapper 在本机与服务端的 uid/gid 之间转换。未配置映射时原样传递；配置了映射时，
+// 不在任何映射中的 id 统一转换为 nobody。
+//
+type idMapper struct {
+	uids, gids           []IdMap
+	nobodyUid, nobodyGid uint32
+}
+
+func checkIdMaps(maps []IdMap) error {
+
+	for i, m := range maps {
+		if m.Count == 0 || m.Inside+m.Count-1 < m.Inside || m.Outside+m.Count-1 < m.Outside {
+			return ErrInvalidIdMap
+		}
+		for _, m2 := range maps[:i] {
+			if overlaps(m.Inside, m2.Inside, m.Count, m2.Count) || overlaps(m.Outside, m2.Outside, m.Count, m2.Count) {
+				return ErrInvalidIdMap
+			}
+		}
+	}
+	return nil
+}
+
+func overlaps(a, b, na, nb uint32) bool {
+
+	return uint64(a) < uint64(b)+uint64(nb) && uint64(b) < uint64(a)+uint64(na)
+}
+
+func newIdMapper(args *MountArgs) *idMapper {
+
+	return &idMapper{
+		uids:      args.UidMap,
+		gids:      args.GidMap,
+		nobodyUid: uint32(orDefault(args.NobodyUid, DefaultNobody)),
+		nobodyGid: uint32(orDefault(args.NobodyGid, DefaultNobody)),
+	}
+}
+
+func mapId(maps []IdMap, id, nobody uint32, outbound bool) uint32 {
+
+	if len(maps) == 0 {
+		return id
+	}
+	for _, m := range maps {
+		from, to := m.Outside, m.Inside
+		if outbound {
+			from, to = m.Inside, m.Outside
+		}
+		if id >= from && id-from < m.Count {
+			return to + (id - from)
+		}
+	}
+	return nobody
+}
+
+func (p *idMapper) remoteUid(uid uint32) uint32 { return mapId(p.uids, uid, p.nobodyUid, true) }
+func (p *idMapper) remoteGid(gid uint32) uint32 { return mapId(p.gids, gid, p.nobodyGid, true) }
+func (p *idMapper) localUid(uid uint32) uint32  { return mapId(p.uids, uid, p.nobodyUid, false) }
+func (p *idMapper) localGid(gid uint32) uint32  { return mapId(p.gids, gid, p.nobodyGid, false) }
+
+// remoteUid、remoteGid 供 bolt_handler.go 转换请求中的 uid/gid(如 setattr 的 chown)。
+//
+func remoteUid(ctx context.Context, uid uint32) uint32 {
+
+	if c := connOf(ctx); c != nil {
+		return c.ids.remoteUid(uid)
+	}
+	return uid
+}
+
+func remoteGid(ctx context.Context, gid uint32) uint32 {
+
+	if c := connOf(ctx); c != nil {
+		return c.ids.remoteGid(gid)
+	}
+	return gid
+}
+
+// localAttr 把服务端回复的属性中的 owner 转换为本机的 uid/gid。
+//
+func (p *idMapper) localAttr(attr *fuse.Attr) {
+
+	attr.Uid = p.localUid(attr.Uid)
+	attr.Gid = p.localGid(attr.Gid)
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,83 @@
+package qfusegate
+
+import (
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+
+func TestCheckIdMaps(t *testing.T) {
+
+	cases := []struct {
+		maps []IdMap
+		ok   bool
+	}{
+		{nil, true},
+		{[]IdMap{{Inside: 0, Outside: 100000, Count: 65536}}, true},
+		{[]IdMap{{Inside: 0, Outside: 0, Count: 1 << 31}, {Inside: 1 << 31, Outside: 1 << 31, Count: 1 << 31}}, true},
+		{[]IdMap{{Inside: 0xffffffff, Outside: 0, Count: 1}}, true},  // 恰好到达上界
+		{[]IdMap{{Inside: 1000, Outside: 1000, Count: 0}}, false},    // 空区间
+		{[]IdMap{{Inside: 0xffffffff, Outside: 0, Count: 2}}, false}, // Inside 溢出
+		{[]IdMap{{Inside: 0, Outside: 0xfffffff0, Count: 17}}, false},
+		{[]IdMap{{Inside: 0, Outside: 0, Count: 0xffffffff}, {Inside: 0xffffffff, Outside: 0xffffffff, Count: 1}}, true},
+		{[]IdMap{{Inside: 0, Outside: 100, Count: 10}, {Inside: 9, Outside: 200, Count: 10}}, false},  // Inside 重叠
+		{[]IdMap{{Inside: 0, Outside: 100, Count: 10}, {Inside: 10, Outside: 109, Count: 10}}, false}, // Outside 重叠
+		{[]IdMap{{Inside: 0, Outside: 100, Count: 10}, {Inside: 10, Outside: 110, Count: 10}}, true},  // 首尾相接
+		{[]IdMap{{Inside: 10, Outside: 0, Count: 5}, {Inside: 0, Outside: 20, Count: 100}}, false},    // 包含
+	}
+	for i, tc := range cases {
+		if err := checkIdMaps(tc.maps); (err == nil) != tc.ok {
+			t.Fatalf("case %d: checkIdMaps(%v): %v", i, tc.maps, err)
+		}
+	}
+}
+
+func TestMapId(t *testing.T) {
+
+	ids := newIdMapper(&MountArgs{
+		UidMap: []IdMap{{Inside: 0, Outside: 100000, Count: 1000}, {Inside: 1000, Outside: 5000, Count: 1}},
+		GidMap: []IdMap{{Inside: 0, Outside: 100000, Count: 1000}},
+	})
+	cases := []struct {
+		local, remote uint32
+	}{
+		{0, 100000},
+		{999, 100999}, // 区间末端
+		{1000, 5000},
+	}
+	for _, tc := range cases {
+		if got := ids.remoteUid(tc.local); got != tc.remote {
+			t.Fatal("remoteUid:", tc.local, got, "want", tc.remote)
+		}
+		if got := ids.localUid(tc.remote); got != tc.local {
+			t.Fatal("localUid:", tc.remote, got, "want", tc.local)
+		}
+	}
+
+	// 不在映射中的 id 在两个方向上都转换为 nobody
+	for _, uid := range []uint32{1001, 65534, 0xffffffff} {
+		if got := ids.remoteUid(uid); got != DefaultNobody {
+			t.Fatal("remoteUid outside maps:", uid, got)
+		}
+	}
+	for _, uid := range []uint32{0, 99999, 101000, 4999, 5001} {
+		if got := ids.localUid(uid); got != DefaultNobody {
+			t.Fatal("localUid outside maps:", uid, got)
+		}
+	}
+	if ids.remoteGid(1000) != DefaultNobody || ids.localGid(101000) != DefaultNobody {
+		t.Fatal("gid outside maps should map to nobody")
+	}
+
+	// 可以指定 nobody
+	ids = newIdMapper(&MountArgs{UidMap: []IdMap{{Inside: 0, Outside: 100000, Count: 1}}, NobodyUid: 99, NobodyGid: 98})
+	if ids.remoteUid(1) != 99 || ids.localUid(1) != 99 {
+		t.Fatal("custom nobody uid")
+	}
+	// 未配置映射时原样传递，不使用 nobody
+	if ids.remoteGid(1) != 1 || ids.localGid(12345) != 12345 {
+		t.Fatal("gid without maps should pass through")
+	}
+}
+
+// ---------------------------------------------------------------------------
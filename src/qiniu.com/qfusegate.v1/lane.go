@@ -0,0 +1,125 @@
+package qfusegate
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"bazil.org/fuse"
+)
+
+// ---------------------------------------------------------------------------
+
+const (
+	DefaultMetaWorkers = 32
+	DefaultDataWorkers = 16
+	DefaultQueueSize   = 128
+)
+
+// lane 是一组固定数目的 worker 及其请求队列。队列满时 put 阻塞，
+// Conn.Serve 因此暂停读取 /dev/fuse，后续请求由内核缓冲。打断与 forget 请求不进入 lane，见 isInlineOp。
+//
+type lane struct {
+	queue   chan func()
+	workers int
+
+	active  int64 // 正在处理的请求数
+	served  int64 // 已处理的请求数
+	blocked int64 // 因队列满而阻塞的次数
+}
+
+type laneStats struct {
+	Workers   int   `json:"workers"`
+	Active    int64 `json:"active"`
+	Queued    int   `json:"queued"`
+	QueueSize int   `json:"queue_size"`
+	Served    int64 `json:"served"`
+	Blocked   int64 `json:"blocked"`
+}
+
+func newLane(workers, queueSize int) *lane {
+
+	return &lane{
+		queue:   make(chan func(), queueSize),
+		workers: workers,
+	}
+}
+
+func (p *lane) start(wg *sync.WaitGroup) {
+
+	wg.Add(p.workers)
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for fn := range p.queue {
+				atomic.AddInt64(&p.active, 1)
+				fn()
+				atomic.AddInt64(&p.active, -1)
+				atomic.AddInt64(&p.served, 1)
+			}
+		}()
+	}
+}
+
+func (p *lane) put(fn func()) {
+
+	select {
+	case p.queue <- fn:
+	default:
+		atomic.AddInt64(&p.blocked, 1)
+		p.queue <- fn
+	}
+}
+
+// close 停止接收请求。worker 处理完队列中剩余的请求后退出。
+//
+func (p *lane) close() {
+
+	close(p.queue)
+}
+
+func (p *lane) stats() *laneStats {
+
+	return &laneStats{
+		Workers:   p.workers,
+		Active:    atomic.LoadInt64(&p.active),
+		Queued:    len(p.queue),
+		QueueSize: cap(p.queue),
+		Served:    atomic.LoadInt64(&p.served),
+		Blocked:   atomic.LoadInt64(&p.blocked),
+	}
+}
+
+// ---------------------------------------------------------------------------
+
+// isDataOp 判断 r 是否走数据通道。大块的读写不应让 lookup、getattr 等元数据请求排队等待。
+//
+func isDataOp(r fuse.Request) bool {
+
+	switch r.(type) {
+	case *fuse.ReadRequest, *fuse.WriteRequest, *fuse.FlushRequest, *fuse.FsyncRequest:
+		return true
+	}
+	return false
+}
+
+// isInlineOp 判断 r 是否不经 lane 排队、读到即处理。打断请求要尽快取消被打断的请求并通知服务端；
+// forget 不需要回复，但内核可能一次发出大量 forget，排队时会占满元数据队列。
+//
+func isInlineOp(r fuse.Request) bool {
+
+	switch r.(type) {
+	case *fuse.InterruptRequest, *fuse.ForgetRequest:
+		return true
+	}
+	return false
+}
+
+func orDefault(v, def int) int {
+
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,80 @@
+package qfusegate
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// ---------------------------------------------------------------------------
+
+func TestLaneBlock(t *testing.T) {
+
+	p := newLane(2, 4)
+	var wg sync.WaitGroup
+	p.start(&wg)
+
+	// 占住所有 worker 并填满队列
+	release := make(chan struct{})
+	var served int64
+	fn := func() {
+		<-release
+		atomic.AddInt64(&served, 1)
+	}
+	for i := 0; i < 6; i++ {
+		p.put(fn)
+	}
+	for p.stats().Active != 2 || p.stats().Queued != 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 队列满时 put 阻塞，直到 worker 腾出空位
+	blocked := p.stats().Blocked
+	done := make(chan struct{})
+	go func() {
+		p.put(fn)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("put should block when the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if st := p.stats(); st.Blocked != blocked+1 {
+		t.Fatal("stats:", st)
+	}
+
+	close(release)
+	<-done
+	p.close()
+	wg.Wait()
+	if atomic.LoadInt64(&served) != 7 {
+		t.Fatal("not all requests served:", served)
+	}
+	if st := p.stats(); st.Served != 7 || st.Queued != 0 {
+		t.Fatal("stats after close:", st)
+	}
+}
+
+func TestIsInlineOp(t *testing.T) {
+
+	cases := []struct {
+		req  fuse.Request
+		want bool
+	}{
+		{new(fuse.InterruptRequest), true},
+		{new(fuse.ForgetRequest), true},
+		{new(fuse.ReadRequest), false},
+		{new(fuse.LookupRequest), false},
+	}
+	for _, tc := range cases {
+		if got := isInlineOp(tc.req); got != tc.want {
+			t.Fatalf("isInlineOp(%T): %v", tc.req, got)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -1,21 +1,27 @@
 package qfusegate
 
 import (
-	"encoding/json"
-	"io"
-	"os"
 	"sync"
 	"syscall"
 
 	"bazil.org/fuse"
 	"github.com/qiniu/errors"
 	"github.com/qiniu/http/httputil.v1"
+	"github.com/qiniu/http/restrpc.v1"
 	"qiniupkg.com/x/log.v7"
 )
 
 var (
 	ErrInvalidAllowMode = httputil.NewError(
 		400, "invalid argument `allow`: value can be `allow_root` or `allow_other`")
+	ErrInvalidTarget   = httputil.NewError(400, "invalid argument `target`")
+	ErrInvalidPolicy   = httputil.NewError(400, "invalid argument `policy`: value can be `primary` or `round_robin`")
+	ErrInvalidMaxWrite = httputil.NewError(400, "invalid argument `max_write`: value must be in [4096, 16777216]")
+	ErrInvalidIdMap    = httputil.NewError(400, "invalid argument `uid_map` or `gid_map`: empty, overflowing or overlapping range")
+	ErrInvalidSignKey  = httputil.NewError(400, "invalid argument `sign_key_id` or `sign_key_file`: both or neither must be set, key must not be empty")
+	ErrInvalidTLSArgs  = httputil.NewError(400, "invalid tls arguments: `tls_cert_file` and `tls_key_file` must be set together, and tls_* requires an https target")
+	ErrNoSuchMount     = httputil.NewError(404, "no such mount")
+	ErrUnmounting      = httputil.NewError(409, "mount is being unmounted")
 )
 
 // ---------------------------------------------------------------------------
@@ -23,35 +29,51 @@ var (
 type Config struct {
 	SaveToFile string `json:"save_to"`
 	BackupFile string `json:"backup_to"`
+
+	// 启动时挂载失败的挂载在后台重试，首次重试前等待 MountRetryMs，之后每次加倍，直到 MountRetryMaxMs。
+	// 0 表示使用默认值。
+	//
+	MountRetryMs    int `json:"mount_retry_ms"`
+	MountRetryMaxMs int `json:"mount_retry_max_ms"`
+
+	// 控制接口的认证与授权，见 AuthConfig。
+	//
+	Auth *AuthConfig `json:"auth"`
 }
 
 type Service struct {
 	Config
 
 	mounts []*MountArgs
-	conns  map[string]*Conn // mountpoint => conn
+	conns  map[string]*Conn        // mountpoint => conn
+	failed map[string]*failedMount // mountpoint => 正在重试的挂载
 	mutex  sync.Mutex
 }
 
 func New(cfg *Config) (p *Service, err error) {
 
-	var mounts []*MountArgs
-
-	f, err2 := os.Open(cfg.SaveToFile)
-	if err2 == nil {
-		json.NewDecoder(f).Decode(&mounts)
-		f.Close()
+	mounts, err := loadMounts(cfg)
+	if err != nil {
+		return
 	}
 
 	p = &Service{
 		Config: *cfg,
 		conns:  make(map[string]*Conn),
+		failed: make(map[string]*failedMount),
 	}
+
+	// 一个挂载失败(如服务端不可用)不影响其他挂载，失败的挂载在后台重试
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	for _, args := range mounts {
+		p.mounts = append(p.mounts, args)
 		fuse.Unmount(args.MountPoint)
-		err = p.mount(args)
-		if err != nil {
-			return
+		err2 := p.mount(args)
+		if err2 != nil {
+			log.Error("qfusegate.New: mount failed, retry in background:", args.MountPoint, err2)
+			p.remount(args, err2)
 		}
 	}
 	return
@@ -64,10 +86,26 @@ type MountArgs struct {
 	//
 	MountPoint string `json:"mountpoint"`
 
-	// 目标文件系统位置(Host)。如 "http://127.0.0.1:7777"
+	// 目标文件系统位置(Host)。如 "http://127.0.0.1:7777"，
+	// 或 "unix:///path/to/qbolt.sock" 表示经 unix socket 访问本机的服务端。
 	//
 	TargetFSHost string `json:"target"`
 
+	// 多个服务端(如主备)，设置后忽略 TargetFSHost。每项的格式同 TargetFSHost。
+	//
+	Targets []string `json:"targets"`
+
+	// 多个服务端时的选择策略：
+	// "primary"(默认) 总是使用第一个健康的服务端；
+	// "round_robin" 把 getattr 等幂等的只读请求及只读 open 轮流发往各健康的服务端，其余请求同 "primary"。
+	// 针对已打开句柄的请求总是发往打开它的服务端。
+	//
+	Policy string `json:"policy"`
+
+	// 多个服务端时健康检查的间隔，0 表示 DefaultHealthCheckIntervalMs。
+	//
+	HealthCheckIntervalMs int `json:"health_check_interval_ms"`
+
 	// the file system name (also called source) that is visible in the list of mounted file systems
 	//
 	FSName string `json:"fsname"`
@@ -90,13 +128,56 @@ type MountArgs struct {
 	// ReadOnly makes the mount read-only.
 	//
 	ReadOnly int `json:"readonly"`
+
+	// 其余挂载选项及与内核协商的参数，见 FuseArgs。
+	//
+	FuseArgs
+
+	// 本机与服务端之间的 uid/gid 映射，用于发往服务端的调用者身份、setattr 的 owner，以及服务端回复的属性。
+	// 为空时不做映射；不为空时不在映射中的 id 转换为 NobodyUid/NobodyGid(0 表示 DefaultNobody)。
+	//
+	UidMap    []IdMap `json:"uid_map"`
+	GidMap    []IdMap `json:"gid_map"`
+	NobodyUid int     `json:"nobody_uid"`
+	NobodyGid int     `json:"nobody_gid"`
+
+	// 元数据请求与数据请求(read、write、flush、fsync)分别由两组 worker 处理，以限制对服务端的并发，
+	// 并避免大量数据请求阻塞 lookup 等元数据请求。0 表示使用默认值。
+	//
+	MetaWorkers int `json:"meta_workers"`
+	DataWorkers int `json:"data_workers"`
+
+	// 每组 worker 的排队长度。队列满时暂停读取 /dev/fuse，由内核缓冲后续请求。0 表示使用默认值。
+	// 打断与 forget 请求不排队。
+	//
+	QueueSize int `json:"queue_size"`
+
+	// 到服务端的 HTTP 连接参数。
+	//
+	TransportArgs
+
+	// 不为空时以 HMAC-SHA256 签名发往服务端的请求(见 QBOLT.md)，SignKeyFile 中为与服务端共享的密钥。
+	// 密钥只保存在该文件中，不写入 mounts.conf，也不经 /v1/mounts 返回。为空时使用旧的不签名格式。
+	//
+	SignKeyId   string `json:"sign_key_id"`
+	SignKeyFile string `json:"sign_key_file"`
+
+	// 不为空时记录该挂载的访问日志，见 AccessLogArgs。
+	//
+	AccessLog *AccessLogArgs `json:"access_log"`
 }
 
-func (p *Service) PostMount(args *MountArgs) (err error) {
+func (p *Service) PostMount(args *MountArgs, env *restrpc.Env) (err error) {
+
+	err = p.authorizeMount(env.Req, args)
+	if err != nil {
+		return
+	}
 
 	p.mutex.Lock()
 	_, ok := p.conns[args.MountPoint]
-	if ok {
+	_, retrying := p.failed[args.MountPoint]
+	if ok || retrying {
 		err = syscall.EEXIST
 	} else {
 		err = p.mount(args)
@@ -109,39 +190,12 @@ func (p *Service) PostMount(args *MountArgs) (err error) {
 	return
 }
 
-func (p *Service) save() (err error) {
-
-	os.Remove(p.BackupFile)
-
-	backup, err := os.Create(p.BackupFile)
-	if err != nil {
-		err = errors.Info(err, "os.Create:", p.BackupFile).Detail(err)
-		return
-	}
-	defer backup.Close()
-
-	old, err2 := os.Open(p.SaveToFile)
-	if err2 == nil {
-		io.Copy(backup, old)
-		old.Close()
-	}
+func (p *Service) mount(args *MountArgs) (err error) {
 
-	f, err := os.Create(p.SaveToFile)
+	err = checkTargets(args)
 	if err != nil {
-		err = errors.Info(err, "os.Create:", p.SaveToFile).Detail(err)
 		return
 	}
-	defer f.Close()
-
-	err = json.NewEncoder(f).Encode(p.mounts)
-	if err != nil {
-		err = errors.Info(err, "json.Marshal:", p.mounts).Detail(err)
-	}
-	return
-}
-
-func (p *Service) mount(args *MountArgs) (err error) {
-
 	options, err := mountOptions(args)
 	if err != nil {
 		err = errors.Info(err, "parse mount options failed").Detail(err)
@@ -158,6 +212,8 @@ func (p *Service) mount(args *MountArgs) (err error) {
 	log.Info("NewConn:", *args)
 	conn, err := NewConn(c, args)
 	if err != nil {
+		fuse.Unmount(args.MountPoint)
+		c.Close()
 		err = errors.Info(err, "qfusegate.NewConn failed").Detail(err)
 		return
 	}
@@ -196,6 +252,22 @@ func mountOptions(args *MountArgs) (options []fuse.MountOption, err error) {
 	if args.ReadOnly != 0 {
 		options = append(options, fuse.ReadOnly())
 	}
+	if args.DefaultPermissions != 0 {
+		options = append(options, fuse.DefaultPermissions())
+	}
+	err = checkFuseArgs(&args.FuseArgs)
+	if err != nil {
+		return
+	}
+	if checkIdMaps(args.UidMap) != nil || checkIdMaps(args.GidMap) != nil {
+		err = ErrInvalidIdMap
+		return
+	}
+	err = checkSignArgs(args)
+	if err != nil {
+		return
+	}
+	err = checkTLSArgs(args)
 	return
 }
 
@@ -203,11 +275,130 @@ func mountOptions(args *MountArgs) (options []fuse.MountOption, err error) {
 
 type unmountArgs struct {
 	MountPoint string `json:"mountpoint"`
+
+	// Lazy 立即把挂载点从目录树上摘除(umount -l)，不等待仍在使用的文件关闭。
+	// 挂载点随即可被再次挂载，原连接在后台处理完剩余请求后关闭。
+	//
+	Lazy int `json:"lazy"`
+
+	// Force 摘除挂载点后立即关闭与内核的连接，不等待进行中的请求。
+	// 使用中的文件此后的访问返回 ENOTCONN。
+	//
+	Force int `json:"force"`
 }
 
-func (p *Service) PostUnmount(args *unmountArgs) (err error) {
+/*
+取消挂载：摘除挂载点，等待 Serve 处理完进行中的请求后退出，关闭连接，并从 mounts.conf 中删除。
+若 Serve 已经退出(如在外部被 umount)，只做后面的清理。
+*/
+func (p *Service) PostUnmount(args *unmountArgs, env *restrpc.Env) (err error) {
+
+	err = p.authorize(env.Req, args.MountPoint, nil)
+	if err != nil {
+		return
+	}
+
+	p.mutex.Lock()
+	conn, ok := p.conns[args.MountPoint]
+	if !ok {
+		defer p.mutex.Unlock()
+		if _, retrying := p.failed[args.MountPoint]; retrying {
+			// 尚未挂载上，停止重试并从 mounts.conf 中删除即可
+			delete(p.failed, args.MountPoint)
+			p.removeMount(args.MountPoint)
+			return p.save()
+		}
+		return ErrNoSuchMount
+	}
+	p.mutex.Unlock()
+
+	if !conn.setUnmounting(true) {
+		return ErrUnmounting
+	}
 
-	return fuse.Unmount(args.MountPoint)
+	lazy := args.Lazy != 0 || args.Force != 0
+	if !conn.served() {
+		if lazy {
+			err = unmountLazy(args.MountPoint)
+		} else {
+			err = fuse.Unmount(args.MountPoint)
+		}
+		if err != nil {
+			conn.setUnmounting(false)
+			return errors.Info(err, "qfusegate.PostUnmount:", args.MountPoint).Detail(err)
+		}
+	}
+	log.Info("Unmounted:", args.MountPoint, "lazy:", args.Lazy, "force:", args.Force)
+
+	if args.Force != 0 {
+		conn.c.Close()
+	}
+	if lazy {
+		go func() {
+			<-conn.done
+			if args.Force == 0 {
+				conn.c.Close()
+			}
+			log.Info("Conn closed:", args.MountPoint)
+		}()
+	} else {
+		<-conn.done
+		conn.c.Close()
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.conns[args.MountPoint] == conn {
+		delete(p.conns, args.MountPoint)
+	}
+	p.removeMount(args.MountPoint)
+	return p.save()
+}
+
+func (p *Service) removeMount(mountPoint string) {
+
+	for i, m := range p.mounts {
+		if m.MountPoint == mountPoint {
+			p.mounts = append(p.mounts[:i], p.mounts[i+1:]...)
+			break
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+
+type getMountsArgs struct {
+	MountPoint string `json:"mountpoint"`
+}
+
+/*
+GET /v1/mounts
+GET /v1/mounts?mountpoint=<MountPoint>
+*/
+func (p *Service) GetMounts(args *getMountsArgs, env *restrpc.Env) (ret []*mountStatus, err error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ret = make([]*mountStatus, 0, len(p.mounts))
+	for _, m := range p.mounts {
+		if args.MountPoint != "" && m.MountPoint != args.MountPoint {
+			continue
+		}
+		if p.authorize(env.Req, m.MountPoint, nil) != nil { // 只列出调用者有权操作的挂载
+			continue
+		}
+		if conn, ok := p.conns[m.MountPoint]; ok {
+			ret = append(ret, conn.status())
+		} else if fm, ok := p.failed[m.MountPoint]; ok {
+			ret = append(ret, fm.status())
+		}
+	}
+	if args.MountPoint != "" && len(ret) == 0 {
+		return nil, ErrNoSuchMount
+	}
+	return
 }
 
 // ---------------------------------------------------------------------------
@@ -0,0 +1,108 @@
+package qfusegate
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qiniu/http/restrpc.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+func callerEnv(caller *Caller) *restrpc.Env {
+
+	req := httptest.NewRequest("GET", "/v1/mounts", nil)
+	if caller != nil {
+		req = req.WithContext(context.WithValue(req.Context(), callerKey{}, caller))
+	}
+	return &restrpc.Env{W: httptest.NewRecorder(), Req: req}
+}
+
+func TestConnState(t *testing.T) {
+
+	p, err := NewConn(nil, &MountArgs{MountPoint: "/mnt/a", TargetFSHost: "http://10.0.0.1:7777"})
+	if err != nil {
+		t.Fatal("NewConn:", err)
+	}
+	check := func(want string) {
+		if st := p.status(); st.State != want {
+			t.Fatal("state:", st.State, "want", want)
+		}
+	}
+	check(StateServing)
+	if !p.setUnmounting(true) || p.setUnmounting(true) {
+		t.Fatal("setUnmounting should succeed only once")
+	}
+	check(StateUnmounting)
+	p.setUnmounting(false) // 取消挂载失败
+	check(StateServing)
+
+	p.serveErr = errors.New("read /dev/fuse: bad file descriptor")
+	close(p.done)
+	check(StateFailed)
+	if st := p.status(); st.LastError != p.serveErr.Error() {
+		t.Fatal("last error:", st.LastError)
+	}
+	p.serveErr = nil
+	check(StateStopped)
+}
+
+func TestGetMounts(t *testing.T) {
+
+	a := &MountArgs{MountPoint: "/mnt/a", TargetFSHost: "http://10.0.0.1:7777"}
+	b := &MountArgs{MountPoint: "/mnt/b", TargetFSHost: "http://10.0.0.2:7777"}
+	conn, err := NewConn(nil, a)
+	if err != nil {
+		t.Fatal("NewConn:", err)
+	}
+	p := &Service{
+		mounts: []*MountArgs{a, b},
+		conns:  map[string]*Conn{a.MountPoint: conn},
+		failed: map[string]*failedMount{
+			b.MountPoint: {args: b, err: errors.New("connection refused"), retries: 3, nextRetry: time.Now()},
+		},
+	}
+
+	ret, err := p.GetMounts(new(getMountsArgs), callerEnv(nil))
+	if err != nil || len(ret) != 2 {
+		t.Fatal("GetMounts:", len(ret), err)
+	}
+	if st := ret[0]; st.MountPoint != "/mnt/a" || st.State != StateServing || st.MetaLane == nil ||
+		len(st.Targets) != 1 || st.Targets[0].Target != "http://10.0.0.1:7777" || !st.Targets[0].Healthy {
+		t.Fatalf("serving mount: %+v", st)
+	}
+	if st := ret[1]; st.MountPoint != "/mnt/b" || st.State != StateRetrying || st.Retries != 3 || st.LastError != "connection refused" {
+		t.Fatalf("retrying mount: %+v", st)
+	}
+
+	cases := []struct {
+		auth       *AuthConfig
+		caller     *Caller
+		mountPoint string
+		want       []string
+		err        error
+	}{
+		{nil, nil, "/mnt/b", []string{"/mnt/b"}, nil},
+		{nil, nil, "/mnt/none", nil, ErrNoSuchMount},
+		{new(AuthConfig), &Caller{MountPrefixes: []string{"/mnt/b"}}, "", []string{"/mnt/b"}, nil}, // 只列出有权操作的挂载
+		{new(AuthConfig), &Caller{MountPrefixes: []string{"/mnt/b"}}, "/mnt/a", nil, ErrNoSuchMount},
+		{new(AuthConfig), &Caller{}, "", []string{"/mnt/a", "/mnt/b"}, nil},
+		{new(AuthConfig), nil, "", nil, nil},
+	}
+	for i, tc := range cases {
+		p.Auth = tc.auth
+		ret, err := p.GetMounts(&getMountsArgs{MountPoint: tc.mountPoint}, callerEnv(tc.caller))
+		var got []string
+		for _, st := range ret {
+			got = append(got, st.MountPoint)
+		}
+		if err != tc.err || !equalStrings(got, tc.want) {
+			t.Fatal("case", i, ":", got, err)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,294 @@
+package qfusegate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"qiniupkg.com/x/rpc.v7"
+)
+
+// ---------------------------------------------------------------------------
+
+// latencyBuckets 是请求耗时直方图的上界(秒)。
+//
+var latencyBuckets = []float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+type opStats struct {
+	count    int64
+	inflight int64
+	sumNs    int64
+	buckets  []int64 // 与 latencyBuckets 对应，非累计；最后一项为 +Inf
+
+	errnos map[fuse.Errno]int64
+}
+
+// metrics 是一个挂载按 op 统计的请求数、耗时、出错 errno、进行中的请求数及读写字节数。
+// op 表由 mkgobbolthandler 生成(见 bolt_handler.go 的 opNames)，新增的 op 自动得到统计。
+//
+type metrics struct {
+	ops      [numOps]opStats
+	nread    int64
+	nwritten int64
+	mutex    sync.Mutex // 保护 errnos
+}
+
+func newMetrics() *metrics {
+
+	p := new(metrics)
+	for i := range p.ops {
+		p.ops[i].buckets = make([]int64, len(latencyBuckets)+1)
+		p.ops[i].errnos = make(map[fuse.Errno]int64)
+	}
+	return p
+}
+
+// opCall 记录一个请求的处理结果，经 context 传给 bolt_handler.go 与 replyError。
+// 一个请求只在一个 goroutine 中处理，不需要加锁。
+//
+type opCall struct {
+	op       int
+	start    time.Time
+	errno    fuse.Errno
+	nread    int
+	nwritten int
+
+	target string // 处理该请求的服务端，见 Conn.serveRequest
+	status int    // 服务端回复的 HTTP 状态码，见 transportImpl.RoundTrip
+}
+
+type opCallKey struct{}
+
+func callOf(ctx context.Context) *opCall {
+
+	c, _ := ctx.Value(opCallKey{}).(*opCall)
+	return c
+}
+
+// begin 在读到请求时调用，耗时从此刻算起，包括排队时间。
+//
+func (p *metrics) begin(r fuse.Request) *opCall {
+
+	c := &opCall{op: opIndexOf(r), start: time.Now()}
+	if c.op >= 0 {
+		atomic.AddInt64(&p.ops[c.op].inflight, 1)
+	}
+	return c
+}
+
+func (p *metrics) end(c *opCall) {
+
+	if c.op < 0 {
+		return
+	}
+	s := &p.ops[c.op]
+	d := time.Since(c.start)
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddInt64(&s.buckets[i], 1)
+	atomic.AddInt64(&s.sumNs, int64(d))
+	atomic.AddInt64(&s.count, 1)
+	atomic.AddInt64(&s.inflight, -1)
+	atomic.AddInt64(&p.nread, int64(c.nread))
+	atomic.AddInt64(&p.nwritten, int64(c.nwritten))
+
+	if c.errno != 0 {
+		p.mutex.Lock()
+		s.errnos[c.errno]++
+		p.mutex.Unlock()
+	}
+}
+
+func countRead(ctx context.Context, n int) {
+
+	if c := callOf(ctx); c != nil {
+		c.nread += n
+	}
+}
+
+func countWritten(ctx context.Context, n int) {
+
+	if c := callOf(ctx); c != nil {
+		c.nwritten += n
+	}
+}
+
+func setErrno(ctx context.Context, errno fuse.Errno) {
+
+	if c := callOf(ctx); c != nil {
+		c.errno = errno
+	}
+}
+
+// errnoOf 返回 err 回复给内核的 errno，与 fuse 包的转换规则一致：无法识别的错误为 EIO。
+//
+func errnoOf(err error) fuse.Errno {
+
+	if e, ok := err.(*rpc.ErrorInfo); ok && e.Errno != 0 {
+		return fuse.Errno(e.Errno)
+	}
+	if e, ok := err.(fuse.ErrorNumber); ok {
+		return e.Errno()
+	}
+	return fuse.EIO
+}
+
+// replyErrno 在本地以 errno 回复请求，不经过服务端。
+//
+func replyErrno(ctx context.Context, r fuse.Request, errno fuse.Errno) {
+
+	setErrno(ctx, errno)
+	r.RespondError(errno)
+}
+
+// ---------------------------------------------------------------------------
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w metricsWriter) header(name, typ, help string) {
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w metricsWriter) sample(name, labels string, v interface{}) {
+
+	fmt.Fprintf(w, "%s{%s} %v\n", name, labels, v)
+}
+
+func mountLabel(mountPoint string) string {
+
+	return `mountpoint="` + labelReplacer.Replace(mountPoint) + `"`
+}
+
+// writeMetrics 以 Prometheus 文本格式输出各挂载的统计。
+//
+func writeMetrics(out io.Writer, mountPoints []string, ms []*metrics, targets [][]*targetStatus) error {
+
+	w := metricsWriter{bufio.NewWriter(out)}
+
+	w.header("qfusegate_requests_total", "counter", "FUSE requests handled, by mount and op.")
+	for i, m := range ms {
+		for op := range m.ops {
+			w.sample("qfusegate_requests_total", opLabels(mountPoints[i], op), atomic.LoadInt64(&m.ops[op].count))
+		}
+	}
+
+	w.header("qfusegate_requests_inflight", "gauge", "FUSE requests read from the kernel but not yet replied, including queued ones.")
+	for i, m := range ms {
+		for op := range m.ops {
+			w.sample("qfusegate_requests_inflight", opLabels(mountPoints[i], op), atomic.LoadInt64(&m.ops[op].inflight))
+		}
+	}
+
+	w.header("qfusegate_request_errors_total", "counter", "FUSE requests replied with an error, by errno.")
+	for i, m := range ms {
+		m.mutex.Lock()
+		for op := range m.ops {
+			errnos := make([]int, 0, len(m.ops[op].errnos))
+			for errno := range m.ops[op].errnos {
+				errnos = append(errnos, int(errno))
+			}
+			sort.Ints(errnos)
+			for _, errno := range errnos {
+				labels := opLabels(mountPoints[i], op) + `,errno="` + strconv.Itoa(errno) + `"`
+				w.sample("qfusegate_request_errors_total", labels, m.ops[op].errnos[fuse.Errno(errno)])
+			}
+		}
+		m.mutex.Unlock()
+	}
+
+	w.header("qfusegate_request_duration_seconds", "histogram", "FUSE request latency, from reading the request to replying it.")
+	for i, m := range ms {
+		for op := range m.ops {
+			s := &m.ops[op]
+			labels := opLabels(mountPoints[i], op)
+			var n int64
+			for j, le := range latencyBuckets {
+				n += atomic.LoadInt64(&s.buckets[j])
+				w.sample("qfusegate_request_duration_seconds_bucket", labels+`,le="`+strconv.FormatFloat(le, 'g', -1, 64)+`"`, n)
+			}
+			n += atomic.LoadInt64(&s.buckets[len(latencyBuckets)])
+			w.sample("qfusegate_request_duration_seconds_bucket", labels+`,le="+Inf"`, n)
+			w.sample("qfusegate_request_duration_seconds_sum", labels, float64(atomic.LoadInt64(&s.sumNs))/1e9)
+			w.sample("qfusegate_request_duration_seconds_count", labels, n)
+		}
+	}
+
+	w.header("qfusegate_read_bytes_total", "counter", "Bytes returned to the kernel by read requests.")
+	for i, m := range ms {
+		w.sample("qfusegate_read_bytes_total", mountLabel(mountPoints[i]), atomic.LoadInt64(&m.nread))
+	}
+
+	w.header("qfusegate_written_bytes_total", "counter", "Bytes accepted from the kernel by write requests.")
+	for i, m := range ms {
+		w.sample("qfusegate_written_bytes_total", mountLabel(mountPoints[i]), atomic.LoadInt64(&m.nwritten))
+	}
+
+	w.header("qfusegate_retries_total", "counter", "Requests retried after transport errors, by mount and target.")
+	for i, ts := range targets {
+		for _, t := range ts {
+			w.sample("qfusegate_retries_total", targetLabels(mountPoints[i], t.Target), t.Transport.Retries)
+		}
+	}
+
+	w.header("qfusegate_retry_giveups_total", "counter", "Requests that failed after retrying until the deadline or the target turned unhealthy.")
+	for i, ts := range targets {
+		for _, t := range ts {
+			w.sample("qfusegate_retry_giveups_total", targetLabels(mountPoints[i], t.Target), t.Transport.RetryGiveups)
+		}
+	}
+
+	return w.Flush()
+}
+
+func opLabels(mountPoint string, op int) string {
+
+	return mountLabel(mountPoint) + `,op="` + opNames[op] + `"`
+}
+
+func targetLabels(mountPoint, target string) string {
+
+	return mountLabel(mountPoint) + `,target="` + labelReplacer.Replace(target) + `"`
+}
+
+// ---------------------------------------------------------------------------
+
+/*
+GET /metrics
+
+以 Prometheus 文本格式返回各挂载按 op 的请求统计。不经 restrpc 路由，由 main 直接挂在同一监听地址上。
+*/
+func (p *Service) ServeMetrics(w http.ResponseWriter, req *http.Request) {
+
+	p.mutex.Lock()
+	var mountPoints []string
+	var ms []*metrics
+	var targets [][]*targetStatus
+	for _, m := range p.mounts {
+		if conn, ok := p.conns[m.MountPoint]; ok {
+			mountPoints = append(mountPoints, m.MountPoint)
+			ms = append(ms, conn.metrics)
+			targets = append(targets, conn.targetStatus())
+		}
+	}
+	p.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, mountPoints, ms, targets)
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,85 @@
+package qfusegate
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// ---------------------------------------------------------------------------
+
+func TestWriteMetrics(t *testing.T) {
+
+	m := newMetrics()
+	c := m.begin(new(fuse.ReadRequest))
+	c.errno, c.nread = fuse.Errno(syscall.EIO), 100
+	m.end(c)
+	m.end(m.begin(new(fuse.ReadRequest)))
+	m.begin(new(fuse.GetattrRequest)) // 进行中
+
+	mountPoint := "/mnt/a\"b\\c\n" // 标签值中的 "、\ 与换行须转义
+	targets := []*targetStatus{{Target: "http://10.0.0.1:7777", Transport: &transportStats{Retries: 3, RetryGiveups: 1}}}
+
+	var out bytes.Buffer
+	if err := writeMetrics(&out, []string{mountPoint}, []*metrics{m}, [][]*targetStatus{targets}); err != nil {
+		t.Fatal("writeMetrics:", err)
+	}
+	mp := `mountpoint="/mnt/a\"b\\c\n"`
+	for _, line := range []string{
+		"# TYPE qfusegate_requests_total counter",
+		"qfusegate_requests_total{" + mp + `,op="read"} 2`,
+		"qfusegate_requests_total{" + mp + `,op="getattr"} 0`,
+		"qfusegate_requests_inflight{" + mp + `,op="getattr"} 1`,
+		"qfusegate_requests_inflight{" + mp + `,op="read"} 0`,
+		"qfusegate_request_errors_total{" + mp + `,op="read",errno="5"} 1`,
+		"# TYPE qfusegate_request_duration_seconds histogram",
+		"qfusegate_request_duration_seconds_bucket{" + mp + `,op="read",le="+Inf"} 2`,
+		"qfusegate_request_duration_seconds_count{" + mp + `,op="read"} 2`,
+		"qfusegate_read_bytes_total{" + mp + "} 100",
+		"qfusegate_written_bytes_total{" + mp + "} 0",
+		"qfusegate_retries_total{" + mp + `,target="http://10.0.0.1:7777"} 3`,
+		"qfusegate_retry_giveups_total{" + mp + `,target="http://10.0.0.1:7777"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, out.String())
+		}
+	}
+
+	// 每个样本占一行，转义后的标签值中没有换行
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if !strings.HasPrefix(line, "# ") && !strings.HasPrefix(line, "qfusegate_") {
+			t.Fatalf("bad line %q", line)
+		}
+	}
+}
+
+func TestLatencyBuckets(t *testing.T) {
+
+	m := newMetrics()
+	m.end(m.begin(new(fuse.StatfsRequest)))
+
+	var out bytes.Buffer
+	writeMetrics(&out, []string{"/mnt/a"}, []*metrics{m}, nil)
+
+	// 桶是累计的：计数随上界不减，+Inf 桶为请求总数
+	prefix := `qfusegate_request_duration_seconds_bucket{mountpoint="/mnt/a",op="statfs",le="`
+	var counts []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			counts = append(counts, line[strings.LastIndex(line, " ")+1:])
+		}
+	}
+	if len(counts) != len(latencyBuckets)+1 || counts[len(counts)-1] != "1" {
+		t.Fatal("buckets:", counts)
+	}
+	for i := 1; i < len(counts); i++ {
+		if counts[i] < counts[i-1] { // 计数只有 0 与 1
+			t.Fatal("buckets not cumulative:", counts)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
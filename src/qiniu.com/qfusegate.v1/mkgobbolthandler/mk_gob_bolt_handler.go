@@ -13,6 +13,8 @@ import (
 
 var initProc string
 
+var opConsts, opNames, opCases string
+
 var types = []interface{}{
 	new(InitRequest),
 	new(fuse.InitRequest),
@@ -220,9 +222,11 @@ func requestAssign(dest reflect.Type) {
 		case "Inode":       src = "uint64(req.Node)"
 		case "OldInode":    src = "uint64(req.OldNode)"
 		case "NewDirInode": src = "uint64(req.NewDir)"
-		case "Handle":      src = "uint64(req.Handle)"
+		case "Handle":      src = "handleOf(ctx, req.Handle)"
 		case "LookupReqid": src = "uint64(req.N)"
 		case "IntrReqId":   src = "uint64(req.IntrID)"
+		case "Uid":         src = "remoteUid(ctx, req.Uid)"
+		case "Gid":         src = "remoteGid(ctx, req.Gid)"
 		default:
 			if f.Type.String() == "boltfs.Time" {
 				src = fmt.Sprintf("Time(req.%s.UnixNano())", f.Name)
@@ -250,7 +254,7 @@ func responseAssign(srcType reflect.Type) {
 		src, destName := "ret." + f.Name, f.Name
 		switch f.Name {
 		case "Inode":      destName, src = "Node", "fuse.NodeID(ret.Inode)"
-		case "Handle":     src = "fuse.HandleID(ret.Handle)"
+		case "Handle":     src = "pinHandle(ctx, ret.Handle)"
 		case "XattrNames": destName = "Xattr"
 		}
 		fmt.Printf("\tfuseResp.%s = %s\n", destName, src)
@@ -263,10 +267,19 @@ func gen(types []interface{}) {
 	fuseReq, fuseResp := typeOf(types[1]), typeOf(types[3])
 
 	reqName := fuseReq.Name()
-	reqPath := "/v1/" + strings.ToLower(strings.TrimSuffix(reqName, "Request"))
-	fmt.Printf(`func handle%s(ctx Context, host string, req *fuse.%s) {
+	opName := strings.TrimSuffix(reqName, "Request")
+	reqPath := "/v1/" + strings.ToLower(opName)
+
+	if opConsts == "" {
+		opConsts = fmt.Sprintf("\top%s = iota\n", opName)
+	} else {
+		opConsts += fmt.Sprintf("\top%s\n", opName)
+	}
+	opNames += fmt.Sprintf("\t%q,\n", strings.ToLower(opName))
+	opCases += fmt.Sprintf("\tcase *fuse.%s:\n\t\treturn op%s\n", reqName, opName)
+	fmt.Printf(`func handle%s(ctx Context, host string, tr http.RoundTripper, req *fuse.%s) {
 
-	client := newBoltClient(&req.Header, nil)
+	client := newBoltClient(ctx, &req.Header, tr)
 
 `, reqName, reqName)
 
@@ -289,10 +302,20 @@ func gen(types []interface{}) {
 		fmt.Printf("\terr := client.CallWithGob(ctx, %s, \"POST\", host + \"%s\", args)\n", retExp, reqPath)
 	}
 	fmt.Printf(`	if err != nil {
-		replyError(req, err)
+		replyError(ctx, req, err)
+		return
+	}
+`)
+	if hasData(fuseReq) {
+		fmt.Printf("\tcountWritten(ctx, len(req.Data))\n")
+	}
+	if hasHandle(resp) {
+		fmt.Printf(`	if !validHandle(ctx, ret.Handle) {
+		replyErrno(ctx, req, fuse.EIO)
 		return
 	}
 `)
+	}
 
 	if resp == nil {
 		fmt.Printf("\treq.Respond()\n}\n\n")
@@ -307,9 +330,35 @@ func gen(types []interface{}) {
 	respName := fuseResp.Name()
 	fmt.Printf("\n\tfuseResp := new(fuse.%s)\n", respName)
 	responseAssign(resp)
+	if hasData(fuseResp) {
+		fmt.Printf("\tcountRead(ctx, len(fuseResp.Data))\n")
+	}
+	fmt.Printf("\tadjustResponse(ctx, req, fuseResp)\n")
 	fmt.Printf("\treq.Respond(fuseResp)\n}\n\n")
 }
 
+// hasHandle 判断服务端的回复 t 是否带有新打开的句柄(如 OpenResponse、CreateResponse)。
+//
+func hasHandle(t reflect.Type) bool {
+
+	if t == nil || t.Kind() != reflect.Struct {
+		return false
+	}
+	_, ok := t.FieldByName("Handle")
+	return ok
+}
+
+// hasData 判断 t 是否带有数据块(如 WriteRequest、ReadResponse)，其长度计入读写字节数。
+//
+func hasData(t reflect.Type) bool {
+
+	if t == nil || t.Kind() != reflect.Struct {
+		return false
+	}
+	f, ok := t.FieldByName("Data")
+	return ok && f.Type == reflect.TypeOf([]byte(nil))
+}
+
 func typeOf(v interface{}) reflect.Type {
 
 	if v == nil {
@@ -332,6 +381,7 @@ package qfusegate
 
 import (
 	"encoding/gob"
+	"net/http"
 	"bazil.org/fuse"
 
 	. "golang.org/x/net/context"
@@ -349,6 +399,24 @@ import (
 %s}
 
 `, initProc)
+
+	fmt.Printf(`const (
+%s	numOps
+)
+
+var opNames = [numOps]string{
+%s}
+
+// opIndexOf 返回 r 在 op 表中的序号，不在表中时返回 -1。
+//
+func opIndexOf(r fuse.Request) int {
+
+	switch r.(type) {
+%s	}
+	return -1
+}
+
+`, opConsts, opNames, opCases)
 }
 
 // ---------------------------------------------------------------------------
@@ -0,0 +1,165 @@
+package qfusegate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/qiniu/errors"
+	"qiniupkg.com/x/log.v7"
+)
+
+// ---------------------------------------------------------------------------
+
+// mounts.conf 的格式版本：
+//
+//	1. [<MountArgs>, ...]
+//	2. {"version": 2, "mounts": [<MountArgs>, ...]}
+//
+// 读取时把旧版本迁移到 mountsVersion，保存时总是写 mountsVersion。
+//
+const mountsVersion = 2
+
+type mountsConf struct {
+	Version int          `json:"version"`
+	Mounts  []*MountArgs `json:"mounts"`
+}
+
+// decodeMounts 解析 mounts.conf 的内容并迁移到当前版本。
+//
+func decodeMounts(data []byte) (mounts []*MountArgs, err error) {
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty file")
+	}
+	if data[0] == '[' { // 版本 1
+		err = json.Unmarshal(data, &mounts)
+		return
+	}
+
+	var conf mountsConf
+	err = json.Unmarshal(data, &conf)
+	if err != nil {
+		return
+	}
+	switch {
+	case conf.Version < 2:
+		return nil, fmt.Errorf("invalid version %d", conf.Version)
+	case conf.Version > mountsVersion:
+		return nil, fmt.Errorf("version %d is newer than supported %d", conf.Version, mountsVersion)
+	}
+	return conf.Mounts, nil
+}
+
+func encodeMounts(mounts []*MountArgs) ([]byte, error) {
+
+	if mounts == nil {
+		mounts = []*MountArgs{}
+	}
+	return json.MarshalIndent(&mountsConf{Version: mountsVersion, Mounts: mounts}, "", "\t")
+}
+
+func readMounts(path string) (mounts []*MountArgs, err error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	mounts, err = decodeMounts(data)
+	if err != nil {
+		err = errors.Info(err, "decode", path).Detail(err)
+	}
+	return
+}
+
+// loadMounts 读取 SaveToFile，它损坏(如旧版本在写入时崩溃留下的空文件)或不存在时改用 BackupFile。
+// 两者都不存在时为首次启动，返回空表；存在但都无法解析时返回错误，以免随后的 save 覆盖掉仍可手工修复的配置。
+//
+func loadMounts(cfg *Config) (mounts []*MountArgs, err error) {
+
+	mounts, err = readMounts(cfg.SaveToFile)
+	if err == nil {
+		return
+	}
+	if cfg.BackupFile == "" {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Info(err, "qfusegate: load mounts failed").Detail(err)
+	}
+	log.Warn("qfusegate: read", cfg.SaveToFile, "failed, try", cfg.BackupFile, ":", err)
+
+	mounts, err2 := readMounts(cfg.BackupFile)
+	if err2 == nil {
+		log.Warn("qfusegate: mounts loaded from backup", cfg.BackupFile)
+		return mounts, nil
+	}
+	if os.IsNotExist(err) && os.IsNotExist(err2) {
+		return nil, nil
+	}
+	log.Error("qfusegate: neither", cfg.SaveToFile, "nor", cfg.BackupFile, "can be loaded:", err, err2)
+	return nil, errors.Info(err, "qfusegate: load mounts failed, backup:", err2).Detail(err)
+}
+
+// writeFileAtomic 先写入临时文件并 fsync，再改名为 path。崩溃时 path 要么是旧内容，要么是完整的新内容。
+//
+func writeFileAtomic(path string, data []byte) (err error) {
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Info(err, "os.OpenFile:", tmp).Detail(err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Info(err, "write:", tmp).Detail(err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Info(err, "os.Rename:", tmp, path).Detail(err)
+	}
+
+	// 改名本身也须落盘
+	if dir, err2 := os.Open(filepath.Dir(path)); err2 == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// save 保存 p.mounts。SaveToFile 原有内容能够解析时先复制为 BackupFile，损坏的内容不会覆盖已有的备份。
+// 调用时须持有 p.mutex。
+//
+func (p *Service) save() (err error) {
+
+	if p.BackupFile != "" {
+		if old, err2 := ioutil.ReadFile(p.SaveToFile); err2 == nil {
+			if _, err2 = decodeMounts(old); err2 == nil {
+				err = writeFileAtomic(p.BackupFile, old)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	data, err := encodeMounts(p.mounts)
+	if err != nil {
+		return errors.Info(err, "json.Marshal:", p.mounts).Detail(err)
+	}
+	return writeFileAtomic(p.SaveToFile, data)
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,153 @@
+package qfusegate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+
+func mountPointsOf(mounts []*MountArgs) (ret []string) {
+
+	for _, m := range mounts {
+		ret = append(ret, m.MountPoint)
+	}
+	return
+}
+
+func equalStrings(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	testMountsV1 = `[{"mountpoint": "/mnt/a", "target": "http://10.0.0.1:7777"}]`
+	testMountsV2 = `{"version": 2, "mounts": [{"mountpoint": "/mnt/b", "target": "http://10.0.0.1:7777"}]}`
+)
+
+func TestDecodeMounts(t *testing.T) {
+
+	cases := []struct {
+		data string
+		want []string
+		ok   bool
+	}{
+		{testMountsV1, []string{"/mnt/a"}, true}, // 版本 1 迁移到当前版本
+		{"\n[]\n", nil, true},
+		{testMountsV2, []string{"/mnt/b"}, true},
+		{`{"version": 2, "mounts": []}`, nil, true},
+		{`{"version": 3, "mounts": []}`, nil, false}, // 更新的版本
+		{`{"mounts": []}`, nil, false},
+		{"", nil, false}, // 旧版本在写入时崩溃留下的空文件
+		{" \n", nil, false},
+		{`{"version": 2, "mounts": [`, nil, false},
+	}
+	for _, tc := range cases {
+		mounts, err := decodeMounts([]byte(tc.data))
+		if (err == nil) != tc.ok || !equalStrings(mountPointsOf(mounts), tc.want) {
+			t.Fatalf("decodeMounts(%q): %v, %v", tc.data, mountPointsOf(mounts), err)
+		}
+	}
+
+	// 保存的内容总是当前版本，且能读回
+	data, err := encodeMounts(nil)
+	if err != nil {
+		t.Fatal("encodeMounts:", err)
+	}
+	if mounts, err := decodeMounts(data); err != nil || len(mounts) != 0 {
+		t.Fatal("decodeMounts(encodeMounts(nil)):", string(data), err)
+	}
+}
+
+func TestLoadMounts(t *testing.T) {
+
+	const missing = "<missing>" // 文件不存在
+	cases := []struct {
+		name            string
+		primary, backup string
+		want            []string
+		ok              bool
+	}{
+		{"primary", testMountsV2, testMountsV1, []string{"/mnt/b"}, true},
+		{"empty-primary", "", testMountsV1, []string{"/mnt/a"}, true},
+		{"corrupt-primary", "{", testMountsV1, []string{"/mnt/a"}, true},
+		{"missing-primary", missing, testMountsV1, []string{"/mnt/a"}, true},
+		{"both-missing", missing, missing, nil, true},
+		{"both-corrupt", "{", "", nil, false},
+		{"corrupt-primary-missing-backup", "{", missing, nil, false},
+	}
+	for _, tc := range cases {
+		dir := t.TempDir()
+		cfg := &Config{
+			SaveToFile: filepath.Join(dir, "mounts.conf"),
+			BackupFile: filepath.Join(dir, "mounts.conf.bak"),
+		}
+		for path, data := range map[string]string{cfg.SaveToFile: tc.primary, cfg.BackupFile: tc.backup} {
+			if data == missing {
+				continue
+			}
+			if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		mounts, err := loadMounts(cfg)
+		if (err == nil) != tc.ok || !equalStrings(mountPointsOf(mounts), tc.want) {
+			t.Fatal(tc.name, ":", mountPointsOf(mounts), err)
+		}
+	}
+}
+
+func TestSaveKeepsBackup(t *testing.T) {
+
+	dir := t.TempDir()
+	p := &Service{Config: Config{
+		SaveToFile: filepath.Join(dir, "mounts.conf"),
+		BackupFile: filepath.Join(dir, "mounts.conf.bak"),
+	}}
+	p.mounts = []*MountArgs{{MountPoint: "/mnt/a"}}
+	if err := p.save(); err != nil {
+		t.Fatal("save:", err)
+	}
+	if _, err := os.Stat(p.BackupFile); !os.IsNotExist(err) {
+		t.Fatal("first save should not create a backup:", err)
+	}
+
+	// 再次保存时，原有的可解析内容成为备份
+	p.mounts = append(p.mounts, &MountArgs{MountPoint: "/mnt/b"})
+	if err := p.save(); err != nil {
+		t.Fatal("save:", err)
+	}
+	backup, err := readMounts(p.BackupFile)
+	if err != nil || !equalStrings(mountPointsOf(backup), []string{"/mnt/a"}) {
+		t.Fatal("backup:", mountPointsOf(backup), err)
+	}
+
+	// 损坏的内容不覆盖已有的备份
+	if err := ioutil.WriteFile(p.SaveToFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.save(); err != nil {
+		t.Fatal("save:", err)
+	}
+	backup, err = readMounts(p.BackupFile)
+	if err != nil || !equalStrings(mountPointsOf(backup), []string{"/mnt/a"}) {
+		t.Fatal("backup after corrupt primary:", mountPointsOf(backup), err)
+	}
+	mounts, err := readMounts(p.SaveToFile)
+	if err != nil || !equalStrings(mountPointsOf(mounts), []string{"/mnt/a", "/mnt/b"}) {
+		t.Fatal("saved:", mountPointsOf(mounts), err)
+	}
+}
+
+// ---------------------------------------------------------------------------
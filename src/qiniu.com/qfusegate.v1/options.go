@@ -0,0 +1,133 @@
+package qfusegate
+
+import (
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// ---------------------------------------------------------------------------
+
+const (
+	minMaxWrite = 4096
+	maxMaxWrite = 16 << 20 // fuse 包的接收缓冲区只能容纳这么大的 write
+)
+
+// FuseArgs 是挂载选项及 init 时与内核协商的参数。除 DefaultPermissions 外都由 qfusegate 在回复内核前调整服务端的回复，
+// 0 表示沿用服务端的回复。
+//
+type FuseArgs struct {
+	// 由内核按文件的 mode/uid/gid 检查权限，而不是交给服务端(access 请求)。
+	//
+	DefaultPermissions int `json:"default_permissions"`
+
+	// 预读的上限(字节)。服务端回复 0 时以内核请求的值为准。
+	//
+	MaxReadahead uint32 `json:"max_readahead"`
+
+	// 单个 write 请求的上限(字节)，4096 ~ 16M。服务端回复的值更小时以服务端为准。
+	//
+	MaxWrite uint32 `json:"max_write"`
+
+	// 不为 0 且内核支持时启用异步读(同一文件的多个 read 并发)与 writeback 缓存。
+	//
+	AsyncRead      int `json:"async_read"`
+	WritebackCache int `json:"writeback_cache"`
+
+	// 覆盖服务端给出的属性、目录项在内核中的缓存时间。小于 0 表示不缓存。
+	//
+	AttrTTLMs  int `json:"attr_ttl_ms"`
+	EntryTTLMs int `json:"entry_ttl_ms"`
+
+	// 不为 0 时所有打开的文件都绕过内核页缓存(open、create 的回复带 OpenDirectIO)。
+	//
+	DirectIO int `json:"direct_io"`
+}
+
+func checkFuseArgs(args *FuseArgs) error {
+
+	if args.MaxWrite != 0 && (args.MaxWrite < minMaxWrite || args.MaxWrite > maxMaxWrite) {
+		return ErrInvalidMaxWrite
+	}
+	return nil
+}
+
+func ttlOf(ms int, v time.Duration) time.Duration {
+
+	switch {
+	case ms < 0:
+		return 0
+	case ms > 0:
+		return time.Duration(ms) * time.Millisecond
+	}
+	return v
+}
+
+// adjustResponse 在回复内核前按挂载的 FuseArgs 调整服务端的回复，并把属性中的 owner 转换为本机的 uid/gid。
+// 由 bolt_handler.go 调用。
+//
+func adjustResponse(ctx context.Context, req fuse.Request, resp interface{}) {
+
+	c := connOf(ctx)
+	if c == nil {
+		return
+	}
+	args := &c.args.FuseArgs
+
+	switch resp := resp.(type) {
+	case *fuse.InitResponse:
+		r := req.(*fuse.InitRequest)
+		if resp.MaxReadahead == 0 {
+			resp.MaxReadahead = r.MaxReadahead
+		}
+		if args.MaxReadahead != 0 && args.MaxReadahead < resp.MaxReadahead {
+			resp.MaxReadahead = args.MaxReadahead
+		}
+		if args.MaxWrite != 0 && (resp.MaxWrite == 0 || args.MaxWrite < resp.MaxWrite) {
+			resp.MaxWrite = args.MaxWrite
+		}
+		if args.AsyncRead != 0 {
+			resp.Flags |= r.Flags & fuse.InitAsyncRead
+		}
+		if args.WritebackCache != 0 {
+			resp.Flags |= r.Flags & fuse.InitWritebackCache
+		}
+	case *fuse.OpenResponse:
+		adjustOpen(args, resp)
+	case *fuse.CreateResponse:
+		adjustOpen(args, &resp.OpenResponse)
+		adjustEntry(c, &resp.LookupResponse)
+	case *fuse.LookupResponse:
+		adjustEntry(c, resp)
+	case *fuse.MkdirResponse:
+		adjustEntry(c, &resp.LookupResponse)
+	case *fuse.SymlinkResponse:
+		adjustEntry(c, &resp.LookupResponse)
+	case *fuse.GetattrResponse:
+		adjustAttr(c, &resp.Attr)
+	case *fuse.SetattrResponse:
+		adjustAttr(c, &resp.Attr)
+	}
+}
+
+func adjustOpen(args *FuseArgs, resp *fuse.OpenResponse) {
+
+	if args.DirectIO != 0 {
+		resp.Flags |= fuse.OpenDirectIO
+	}
+}
+
+func adjustEntry(c *Conn, resp *fuse.LookupResponse) {
+
+	resp.EntryValid = ttlOf(c.args.EntryTTLMs, resp.EntryValid)
+	adjustAttr(c, &resp.Attr)
+}
+
+func adjustAttr(c *Conn, attr *fuse.Attr) {
+
+	attr.Valid = ttlOf(c.args.AttrTTLMs, attr.Valid)
+	c.ids.localAttr(attr)
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,120 @@
+package qfusegate
+
+import (
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// ---------------------------------------------------------------------------
+
+func fuseArgsCtx(args *MountArgs) context.Context {
+
+	c := &Conn{args: args, ids: newIdMapper(args)}
+	return context.WithValue(context.Background(), connKey{}, c)
+}
+
+func TestAdjustTTL(t *testing.T) {
+
+	cases := []struct {
+		attrMs, entryMs int
+		attr, entry     time.Duration
+	}{
+		{0, 0, 3 * time.Second, 5 * time.Second}, // 沿用服务端的回复
+		{100, 200, 100 * time.Millisecond, 200 * time.Millisecond},
+		{-1, -1, 0, 0}, // 不缓存
+		{-1, 0, 0, 5 * time.Second},
+	}
+	for _, tc := range cases {
+		args := new(MountArgs)
+		args.AttrTTLMs, args.EntryTTLMs = tc.attrMs, tc.entryMs
+		ctx := fuseArgsCtx(args)
+
+		lookup := &fuse.LookupResponse{EntryValid: 5 * time.Second, Attr: fuse.Attr{Valid: 3 * time.Second}}
+		adjustResponse(ctx, new(fuse.LookupRequest), lookup)
+		if lookup.EntryValid != tc.entry || lookup.Attr.Valid != tc.attr {
+			t.Fatal("lookup:", tc, lookup.EntryValid, lookup.Attr.Valid)
+		}
+
+		create := new(fuse.CreateResponse)
+		create.EntryValid, create.Attr.Valid = 5*time.Second, 3*time.Second
+		adjustResponse(ctx, new(fuse.CreateRequest), create)
+		if create.EntryValid != tc.entry || create.Attr.Valid != tc.attr {
+			t.Fatal("create:", tc, create.EntryValid, create.Attr.Valid)
+		}
+
+		getattr := &fuse.GetattrResponse{Attr: fuse.Attr{Valid: 3 * time.Second}}
+		adjustResponse(ctx, new(fuse.GetattrRequest), getattr)
+		if getattr.Attr.Valid != tc.attr {
+			t.Fatal("getattr:", tc, getattr.Attr.Valid)
+		}
+	}
+}
+
+func TestAdjustInit(t *testing.T) {
+
+	req := &fuse.InitRequest{MaxReadahead: 128 << 10, Flags: fuse.InitAsyncRead | fuse.InitWritebackCache}
+	cases := []struct {
+		maxWrite, maxReadahead uint32
+		asyncRead              int
+		serverWrite, wantWrite uint32
+		wantReadahead          uint32
+		wantFlags              fuse.InitFlags
+	}{
+		{0, 0, 0, 128 << 10, 128 << 10, 128 << 10, 0},
+		{64 << 10, 0, 0, 128 << 10, 64 << 10, 128 << 10, 0}, // 限制为 max_write
+		{1 << 20, 0, 0, 128 << 10, 128 << 10, 128 << 10, 0}, // 服务端的值更小时以服务端为准
+		{64 << 10, 0, 0, 0, 64 << 10, 128 << 10, 0},         // 服务端未给出时使用 max_write
+		{0, 32 << 10, 1, 0, 0, 32 << 10, fuse.InitAsyncRead},
+		{0, 1 << 20, 0, 0, 0, 128 << 10, 0}, // 预读不超过内核请求的值
+	}
+	for _, tc := range cases {
+		args := new(MountArgs)
+		args.MaxWrite, args.MaxReadahead, args.AsyncRead = tc.maxWrite, tc.maxReadahead, tc.asyncRead
+		resp := &fuse.InitResponse{MaxWrite: tc.serverWrite}
+		adjustResponse(fuseArgsCtx(args), req, resp)
+		if resp.MaxWrite != tc.wantWrite || resp.MaxReadahead != tc.wantReadahead || resp.Flags != tc.wantFlags {
+			t.Fatalf("%+v: %+v", tc, resp)
+		}
+	}
+}
+
+func TestAdjustDirectIO(t *testing.T) {
+
+	for _, directIO := range []int{0, 1} {
+		args := new(MountArgs)
+		args.DirectIO = directIO
+		ctx := fuseArgsCtx(args)
+
+		open := &fuse.OpenResponse{Flags: fuse.OpenKeepCache}
+		adjustResponse(ctx, new(fuse.OpenRequest), open)
+		create := new(fuse.CreateResponse)
+		adjustResponse(ctx, new(fuse.CreateRequest), create)
+
+		want := directIO != 0
+		if open.Flags&fuse.OpenDirectIO != 0 != want || create.Flags&fuse.OpenDirectIO != 0 != want {
+			t.Fatal("direct_io:", directIO, open.Flags, create.Flags)
+		}
+		if open.Flags&fuse.OpenKeepCache == 0 {
+			t.Fatal("server flags should be kept:", open.Flags)
+		}
+	}
+}
+
+func TestCheckFuseArgs(t *testing.T) {
+
+	for _, tc := range []struct {
+		maxWrite uint32
+		ok       bool
+	}{
+		{0, true}, {4096, true}, {16 << 20, true}, {4095, false}, {16<<20 + 1, false},
+	} {
+		if err := checkFuseArgs(&FuseArgs{MaxWrite: tc.maxWrite}); (err == nil) != tc.ok {
+			t.Fatal("checkFuseArgs:", tc.maxWrite, err)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
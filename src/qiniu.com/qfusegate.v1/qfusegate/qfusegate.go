@@ -2,13 +2,16 @@ package main
 
 import (
 	"net/http"
+	"os"
 	"runtime"
+	"strconv"
 
 	"qbox.us/cc/config"
 
 	"github.com/qiniu/http/restrpc.v1"
 	"github.com/qiniu/log.v1"
 
+	"qiniu.com/peercred.v1"
 	"qiniu.com/qfusegate.v1"
 )
 
@@ -17,9 +20,17 @@ import (
 type Config struct {
 	Gate qfusegate.Config `json:"gate"`
 
-	BindHost   string `json:"bind_host"`
-	MaxProcs   int    `json:"max_procs"`
-	DebugLevel int    `json:"debug_level"`
+	// 监听地址。"unix:/path/to/qfusegate.sock" 表示监听 unix socket，此时可按对端 uid 授权，见 gate.auth。
+	//
+	BindHost string `json:"bind_host"`
+
+	// 监听 unix socket 时 socket 文件的权限(八进制，如 "0660")。为空时，配置了 gate.auth 则为 0666，
+	// 由 gate.auth 按对端 uid 控制访问；否则按 umask，通常只有 qfusegate 的属主能连接。
+	//
+	BindMode string `json:"bind_mode"`
+
+	MaxProcs   int `json:"max_procs"`
+	DebugLevel int `json:"debug_level"`
 }
 
 func main() {
@@ -48,12 +59,29 @@ func main() {
 
 	// run Service
 
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", service.ServeMetrics)
+
 	router := restrpc.Router{
 		PatternPrefix: "v1",
+		Mux:           mux,
+	}
+	router.Register(service)
+
+	var mode os.FileMode
+	switch {
+	case conf.BindMode != "":
+		m, err := strconv.ParseUint(conf.BindMode, 8, 32)
+		if err != nil {
+			log.Fatal("invalid bind_mode:", conf.BindMode, err)
+		}
+		mode = os.FileMode(m)
+	case conf.Gate.Auth != nil:
+		mode = 0666
 	}
 	log.Info("Starting qfusegate ...")
-	err = http.ListenAndServe(conf.BindHost, router.Register(service))
-	log.Fatal("http.ListenAndServe(qfusegate):", err)
+	err = peercred.ListenAndServeMode(conf.BindHost, mode, service.Authenticate(mux))
+	log.Fatal("peercred.ListenAndServe(qfusegate):", err)
 }
 
 // ---------------------------------------------------------------------------
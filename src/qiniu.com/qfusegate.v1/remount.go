@@ -0,0 +1,81 @@
+package qfusegate
+
+import (
+	"time"
+
+	"bazil.org/fuse"
+	"qiniupkg.com/x/log.v7"
+)
+
+// ---------------------------------------------------------------------------
+
+const (
+	DefaultMountRetryMs    = 1000
+	DefaultMountRetryMaxMs = 60000
+)
+
+// StateRetrying 表示启动时挂载失败，正在后台重试。
+//
+const StateRetrying = "retrying"
+
+// failedMount 是启动时挂载失败、正在后台重试的挂载。
+//
+type failedMount struct {
+	args      *MountArgs
+	err       error
+	retries   int
+	nextRetry time.Time
+}
+
+func (p *failedMount) status() *mountStatus {
+
+	return &mountStatus{
+		MountArgs: p.args,
+		State:     StateRetrying,
+		LastError: p.err.Error(),
+		Retries:   p.retries,
+		NextRetry: p.nextRetry.UnixNano(),
+	}
+}
+
+// remount 以指数退避在后台重试挂载 args，直到成功或该挂载被取消(PostUnmount)。
+// 调用时须持有 p.mutex，且 args 已在 p.mounts 中。
+//
+func (p *Service) remount(args *MountArgs, err error) {
+
+	backoff := time.Duration(orDefault(p.MountRetryMs, DefaultMountRetryMs)) * time.Millisecond
+	maxBackoff := time.Duration(orDefault(p.MountRetryMaxMs, DefaultMountRetryMaxMs)) * time.Millisecond
+
+	fm := &failedMount{args: args, err: err, nextRetry: time.Now().Add(backoff)}
+	p.failed[args.MountPoint] = fm
+
+	go func() {
+		for {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+
+			p.mutex.Lock()
+			if p.failed[args.MountPoint] != fm { // 已被取消
+				p.mutex.Unlock()
+				return
+			}
+			fuse.Unmount(args.MountPoint)
+			err := p.mount(args)
+			if err == nil {
+				delete(p.failed, args.MountPoint)
+				p.mutex.Unlock()
+				log.Info("qfusegate: remounted", args.MountPoint, "retries:", fm.retries+1)
+				return
+			}
+			fm.err = err
+			fm.retries++
+			fm.nextRetry = time.Now().Add(backoff)
+			p.mutex.Unlock()
+			log.Warn("qfusegate: remount failed:", args.MountPoint, "retries:", fm.retries, err)
+		}
+	}()
+}
+
+// ---------------------------------------------------------------------------
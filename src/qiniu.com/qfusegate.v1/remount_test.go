@@ -0,0 +1,135 @@
+package qfusegate
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qiniu/http/restrpc.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+func testEnv() *restrpc.Env {
+
+	return &restrpc.Env{W: httptest.NewRecorder(), Req: httptest.NewRequest("POST", "/v1/unmount", nil)}
+}
+
+// failedOf 返回正在后台重试的挂载及其重试次数。
+//
+func (p *Service) failedOf(mountPoint string) (fm *failedMount, retries int) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if fm = p.failed[mountPoint]; fm != nil {
+		retries = fm.retries
+	}
+	return
+}
+
+// newRetryingService 以两个无法挂载的挂载(target 非法，不会调用 fuse.Mount)启动 qfusegate。
+//
+func newRetryingService(t *testing.T) (p *Service, a, b string) {
+
+	dir := t.TempDir()
+	a, b = filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	cfg := &Config{
+		SaveToFile:      filepath.Join(dir, "mounts.conf"),
+		MountRetryMs:    10,
+		MountRetryMaxMs: 40,
+	}
+	saver := &Service{Config: *cfg, mounts: []*MountArgs{
+		{MountPoint: a, TargetFSHost: "unix://relative.sock"},
+		{MountPoint: b, TargetFSHost: "unix://relative.sock"},
+	}}
+	if err := saver.save(); err != nil {
+		t.Fatal("save:", err)
+	}
+
+	// 挂载失败不影响启动
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	return
+}
+
+// ---------------------------------------------------------------------------
+
+func TestRemountBackoff(t *testing.T) {
+
+	p, a, b := newRetryingService(t)
+	defer func() {
+		p.PostUnmount(&unmountArgs{MountPoint: a}, testEnv())
+		p.PostUnmount(&unmountArgs{MountPoint: b}, testEnv())
+	}()
+
+	ret, err := p.GetMounts(new(getMountsArgs), testEnv())
+	if err != nil || len(ret) != 2 {
+		t.Fatal("GetMounts:", len(ret), err)
+	}
+	for _, st := range ret {
+		if st.State != StateRetrying || st.LastError == "" {
+			t.Fatalf("status: %+v", st)
+		}
+	}
+
+	// 间隔 10、20、40、40 … 毫秒：没有上限时 500ms 内只能重试 5 次，不退避时则远多于此
+	time.Sleep(500 * time.Millisecond)
+	_, retries := p.failedOf(a)
+	if retries < 7 || retries > 20 {
+		t.Fatal("retries:", retries)
+	}
+
+	ret, err = p.GetMounts(&getMountsArgs{MountPoint: a}, testEnv())
+	if err != nil || len(ret) != 1 {
+		t.Fatal("GetMounts a:", err)
+	}
+	if next := time.Unix(0, ret[0].NextRetry); next.Before(time.Now().Add(-time.Second)) || next.After(time.Now().Add(40*time.Millisecond)) {
+		t.Fatal("next retry:", next)
+	}
+}
+
+func TestRemountCancel(t *testing.T) {
+
+	p, a, b := newRetryingService(t)
+	defer p.PostUnmount(&unmountArgs{MountPoint: b}, testEnv())
+
+	fm, _ := p.failedOf(a)
+	if fm == nil {
+		t.Fatal("a should be retrying")
+	}
+	if err := p.PostUnmount(&unmountArgs{MountPoint: a}, testEnv()); err != nil {
+		t.Fatal("PostUnmount:", err)
+	}
+	if err := p.PostUnmount(&unmountArgs{MountPoint: a}, testEnv()); err != ErrNoSuchMount {
+		t.Fatal("PostUnmount again:", err)
+	}
+	if _, err := p.GetMounts(&getMountsArgs{MountPoint: a}, testEnv()); err != ErrNoSuchMount {
+		t.Fatal("GetMounts a:", err)
+	}
+
+	// 取消后不再重试，并从 mounts.conf 中删除
+	p.mutex.Lock()
+	retries := fm.retries
+	p.mutex.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	p.mutex.Lock()
+	after := fm.retries
+	p.mutex.Unlock()
+	if after != retries {
+		t.Fatal("retrying after unmount:", retries, after)
+	}
+
+	mounts, err := readMounts(p.SaveToFile)
+	if err != nil || !equalStrings(mountPointsOf(mounts), []string{b}) {
+		t.Fatal("mounts.conf:", mountPointsOf(mounts), err)
+	}
+	if fm, _ := p.failedOf(b); fm == nil {
+		t.Fatal("b should still be retrying")
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,143 @@
+package qfusegate
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"qiniupkg.com/x/log.v7"
+)
+
+// ---------------------------------------------------------------------------
+
+const (
+	DefaultRetryDeadlineMs   = 30000
+	DefaultRetryBackoffMs    = 50
+	DefaultRetryMaxBackoffMs = 2000
+)
+
+// ReqidDedupHeader 出现在 /v1/init 的回复中，表示服务端按 X-Reqid 对修改请求去重：
+// 重复的请求直接返回首次处理的结果。见 QBOLT.md。
+//
+const ReqidDedupHeader = "X-Qbolt-Reqid-Dedup"
+
+type RetryArgs struct {
+	// 传输错误(如服务端重启期间连接失败)时，从首次发出起持续重试的时间。
+	// 0 表示 DefaultRetryDeadlineMs，小于 0 表示不重试。
+	//
+	RetryDeadlineMs int `json:"retry_deadline_ms"`
+
+	// 首次重试前的等待时间，之后每次加倍，直到 RetryMaxBackoffMs。0 表示使用默认值。
+	//
+	RetryBackoffMs    int `json:"retry_backoff_ms"`
+	RetryMaxBackoffMs int `json:"retry_max_backoff_ms"`
+}
+
+type retryPolicy struct {
+	deadline   time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newRetryPolicy(args *RetryArgs) retryPolicy {
+
+	p := retryPolicy{
+		backoff:    time.Duration(orDefault(args.RetryBackoffMs, DefaultRetryBackoffMs)) * time.Millisecond,
+		maxBackoff: time.Duration(orDefault(args.RetryMaxBackoffMs, DefaultRetryMaxBackoffMs)) * time.Millisecond,
+	}
+	if args.RetryDeadlineMs >= 0 {
+		p.deadline = time.Duration(orDefault(args.RetryDeadlineMs, DefaultRetryDeadlineMs)) * time.Millisecond
+	}
+	return p
+}
+
+// safeOps 是重复执行也不改变结果的请求，遇到传输错误时总是可以重试。
+//
+var safeOps = map[string]bool{
+	"access":    true,
+	"getattr":   true,
+	"lookup":    true,
+	"read":      true,
+	"readlink":  true,
+	"statfs":    true,
+	"getxattr":  true,
+	"listxattr": true,
+}
+
+// opOf 从 <Host>/v1/<op> 中取出 op。
+//
+func opOf(req *http.Request) string {
+
+	path := req.URL.Path
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// ---------------------------------------------------------------------------
+
+// RoundTrip 发出请求，遇到传输错误时以指数退避重试，直到 RetryDeadlineMs 或请求被取消(如被打断)。
+// 服务端已返回的出错回复不重试。有多个服务端时，所在服务端被判为不健康后不再重试(见 abandoned)，
+// 针对已打开句柄的请求除外。
+//
+// create、mkdir、rename、remove、write 等修改请求可能已被服务端执行，只有在服务端声明了 X-Reqid 去重
+// (ReqidDedupHeader)，或请求尚未完整写出时才重试。X-Reqid 在重试之间保持不变。
+//
+func (p *boltTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+
+	op := opOf(req)
+	ctx := req.Context()
+	start := time.Now()
+	backoff := p.retry.backoff
+
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 {
+			r = req.WithContext(ctx)
+			if req.Body != nil {
+				r.Body, err = req.GetBody()
+				if err != nil {
+					return
+				}
+			}
+		}
+
+		var wrote int32
+		resp, err = p.roundTrip(r, &wrote)
+		if err == nil {
+			if op == "init" {
+				var dedup int32
+				if resp.Header.Get(ReqidDedupHeader) == "1" {
+					dedup = 1
+				}
+				atomic.StoreInt32(&p.reqidDedup, dedup)
+			}
+			return
+		}
+
+		retriable := safeOps[op] || atomic.LoadInt32(&p.reqidDedup) != 0 || atomic.LoadInt32(&wrote) == 0
+		if !retriable || p.retry.deadline == 0 || ctx.Err() != nil {
+			return
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return
+		}
+		if time.Since(start)+backoff > p.retry.deadline || abandoned(ctx) {
+			atomic.AddInt64(&p.retryGiveups, 1)
+			log.Warn("qfusegate: give up retrying", req.URL, "attempts:", attempt+1, err)
+			return
+		}
+
+		atomic.AddInt64(&p.retries, 1)
+		log.Debug("qfusegate: retry", req.URL, "attempt:", attempt+1, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > p.retry.maxBackoff {
+			backoff = p.retry.maxBackoff
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,110 @@
+package qfusegate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/qiniu/errors"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+// signKey 是一个挂载与服务端共享的签名密钥，见 MountArgs.SignKeyId。
+//
+type signKey struct {
+	id     string
+	secret []byte
+	now    func() time.Time
+}
+
+func checkSignArgs(args *MountArgs) error {
+
+	if (args.SignKeyId == "") != (args.SignKeyFile == "") {
+		return ErrInvalidSignKey
+	}
+	return nil
+}
+
+// loadSignKey 读取挂载的签名密钥，未配置时返回 nil。
+//
+func loadSignKey(args *MountArgs) (k *signKey, err error) {
+
+	if args.SignKeyId == "" {
+		return
+	}
+	secret, err := ioutil.ReadFile(args.SignKeyFile)
+	if err != nil {
+		return nil, errors.Info(err, "qfusegate: read sign_key_file", args.SignKeyFile).Detail(err)
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, ErrInvalidSignKey
+	}
+	return &signKey{id: args.SignKeyId, secret: secret, now: time.Now}, nil
+}
+
+// sign 为 req 加上签名：
+//
+//	Authorization: QBolt-HMAC-SHA256 <KeyId>:<Signature>
+//	X-Qbolt-Identity: <Identity>
+//	X-Qbolt-Date: <UnixSeconds>
+//
+// 重试的请求沿用同一组头部，即与首次请求的签名相同。
+//
+func (p *signKey) sign(req *http.Request, identity, reqid string) (err error) {
+
+	bodyHash, err := bodyHashOf(req)
+	if err != nil {
+		return
+	}
+	date := strconv.FormatInt(p.now().Unix(), 10)
+	sig := Sign(p.secret, StringToSign(req.Method, req.URL.Path, reqid, identity, date, bodyHash))
+
+	req.Header.Set("Authorization", SignScheme+p.id+":"+sig)
+	req.Header.Set(IdentityHeader, identity)
+	req.Header.Set(SignDateHeader, date)
+	return nil
+}
+
+// bodyHashOf 返回 sha256(Body)。有 GetBody 时从其副本计算，否则读出 Body 并换成可重复读取的副本。
+//
+func bodyHashOf(req *http.Request) (hash []byte, err error) {
+
+	h := sha256.New()
+	if req.Body == nil {
+		return h.Sum(nil), nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,147 @@
+package qfusegate
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"qiniu.com/boltfsd.v1"
+	"qiniupkg.com/x/rpc.v7"
+	rpcgob "qiniupkg.com/x/rpc.v7/gob"
+
+	. "qiniu.com/boltfs.proto.v1"
+)
+
+// ---------------------------------------------------------------------------
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	return f(req)
+}
+
+// signTest 以 qfusegate 的 transportImpl 向 boltfsd 发请求，base 可以在签名之后篡改请求。
+//
+type signTest struct {
+	t    *testing.T
+	host string
+}
+
+func newSignTest(t *testing.T, cfg *boltfsd.Config) (p *signTest, close func()) {
+
+	svc, err := boltfsd.New(cfg)
+	if err != nil {
+		t.Fatal("boltfsd.New:", err)
+	}
+	ts := httptest.NewServer(svc)
+	return &signTest{t: t, host: ts.URL}, ts.Close
+}
+
+// create 返回服务端回复的 HTTP 状态码，成功时为 200。
+//
+func (p *signTest) create(key *signKey, name string, tamper func(req *http.Request)) int {
+
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if tamper != nil {
+			tamper(req)
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	tr := &transportImpl{
+		identity: EncodeIdentity(1000, 1000, 1),
+		reqid:    "test." + name,
+		key:      key,
+		base:     base,
+	}
+	client := rpcgob.Client{rpc.Client{&http.Client{Transport: tr}}}
+	args := &CreateRequest{Inode: uint64(fuse.RootID), Flags: fuse.OpenReadWrite, Mode: 0644, Name: name}
+	err := client.CallWithGob(context.Background(), new(CreateResponse), "POST", p.host+"/v1/create", args)
+	if err == nil {
+		return 200
+	}
+	if e, ok := err.(*rpc.ErrorInfo); ok {
+		return e.Code
+	}
+	p.t.Fatal("create:", name, err)
+	return 0
+}
+
+func newTestSignKey(id, secret string, skew time.Duration) *signKey {
+
+	return &signKey{
+		id:     id,
+		secret: []byte(secret),
+		now:    func() time.Time { return time.Now().Add(skew) },
+	}
+}
+
+// ---------------------------------------------------------------------------
+
+func TestSignRoundTrip(t *testing.T) {
+
+	p, close := newSignTest(t, &boltfsd.Config{SignKeys: boltfsd.SignKeys{"k1": "secret1"}})
+	defer close()
+
+	key := newTestSignKey("k1", "secret1", 0)
+	var body bytes.Buffer
+	gob.NewEncoder(&body).Encode(&CreateRequest{Inode: uint64(fuse.RootID), Mode: 0644, Name: "evil"})
+
+	cases := []struct {
+		name   string
+		key    *signKey
+		tamper func(req *http.Request)
+		code   int
+	}{
+		{"signed", key, nil, 200},
+		{"tampered-body", key, func(req *http.Request) {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+			req.ContentLength = int64(body.Len())
+		}, 401},
+		{"tampered-identity", key, func(req *http.Request) {
+			req.Header.Set(IdentityHeader, EncodeIdentity(0, 0, 1))
+		}, 401},
+		{"tampered-reqid", key, func(req *http.Request) {
+			req.Header.Set("X-Reqid", "other")
+		}, 401},
+		{"tampered-date", key, func(req *http.Request) {
+			req.Header.Set(SignDateHeader, "1")
+		}, 401},
+		{"wrong-key-id", newTestSignKey("k2", "secret1", 0), nil, 401},
+		{"wrong-secret", newTestSignKey("k1", "secret2", 0), nil, 401},
+		{"past-skew", newTestSignKey("k1", "secret1", -(boltfsd.DefaultMaxSignSkewS+60)*time.Second), nil, 401},
+		{"future-skew", newTestSignKey("k1", "secret1", (boltfsd.DefaultMaxSignSkewS+60)*time.Second), nil, 401},
+		{"within-skew", newTestSignKey("k1", "secret1", -(boltfsd.DefaultMaxSignSkewS-60)*time.Second), nil, 200},
+		{"unsigned", nil, nil, 401},
+	}
+	for _, tc := range cases {
+		if code := p.create(tc.key, tc.name, tc.tamper); code != tc.code {
+			t.Fatal(tc.name, ":", code, "want", tc.code)
+		}
+	}
+}
+
+func TestSignAllowUnsigned(t *testing.T) {
+
+	p, close := newSignTest(t, &boltfsd.Config{SignKeys: boltfsd.SignKeys{"k1": "secret1"}, AllowUnsigned: 1})
+	defer close()
+
+	if code := p.create(nil, "unsigned", nil); code != 200 {
+		t.Fatal("unsigned:", code)
+	}
+	// 允许不签名的请求时，签名的请求仍须正确
+	if code := p.create(newTestSignKey("k1", "secret2", 0), "wrong-secret", nil); code != 401 {
+		t.Fatal("wrong secret:", code)
+	}
+	if code := p.create(newTestSignKey("k1", "secret1", 0), "signed", nil); code != 200 {
+		t.Fatal("signed:", code)
+	}
+}
+
+// ---------------------------------------------------------------------------
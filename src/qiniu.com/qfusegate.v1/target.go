@@ -0,0 +1,334 @@
+package qfusegate
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"qiniupkg.com/x/log.v7"
+	"qiniupkg.com/x/rpc.v7"
+)
+
+// ---------------------------------------------------------------------------
+
+const (
+	PolicyPrimary    = "primary"
+	PolicyRoundRobin = "round_robin"
+
+	DefaultHealthCheckIntervalMs = 1000
+)
+
+// 有多个服务端时，内核看到的文件句柄为 <服务端句柄> << handleShift | <服务端序号>，
+// 以便针对该句柄的后续请求(read、write、release 等)总是发往打开它的服务端。
+// 此时服务端句柄只能使用低 64-handleShift 位，更大的句柄无法编码，open/create 回复 EIO，见 validHandle。
+//
+const (
+	handleShift = 8
+	maxTargets  = 1 << handleShift
+	maxHandle   = 1<<(64-handleShift) - 1
+)
+
+type target struct {
+	idx  int
+	host string
+	tr   *boltTransport
+	pin  bool // 有多个服务端，句柄需要编码服务端序号
+
+	healthy int32 // 原子操作
+	lastErr error
+	mutex   sync.Mutex
+}
+
+type targetStatus struct {
+	Target    string          `json:"target"`
+	Healthy   bool            `json:"healthy"`
+	LastError string          `json:"last_error,omitempty"`
+	Transport *transportStats `json:"transport"`
+}
+
+func (p *target) isHealthy() bool {
+
+	return atomic.LoadInt32(&p.healthy) != 0
+}
+
+func (p *target) setHealthy(healthy bool, err error) {
+
+	var v int32
+	if healthy {
+		v = 1
+	}
+	if atomic.SwapInt32(&p.healthy, v) != v {
+		log.Info("qfusegate: target", p.host, "healthy:", healthy, err)
+	}
+	if err != nil {
+		p.mutex.Lock()
+		p.lastErr = err
+		p.mutex.Unlock()
+	}
+}
+
+func (p *target) status(name string) *targetStatus {
+
+	ret := &targetStatus{
+		Target:    name,
+		Healthy:   p.isHealthy(),
+		Transport: p.tr.stats(),
+	}
+	p.mutex.Lock()
+	if p.lastErr != nil {
+		ret.LastError = p.lastErr.Error()
+	}
+	p.mutex.Unlock()
+	return ret
+}
+
+// targetsOf 返回挂载的全部服务端。未设置 Targets 时为 TargetFSHost。
+//
+func targetsOf(args *MountArgs) []string {
+
+	if len(args.Targets) > 0 {
+		return args.Targets
+	}
+	return []string{args.TargetFSHost}
+}
+
+func checkTargets(args *MountArgs) (err error) {
+
+	targets := targetsOf(args)
+	if len(targets) > maxTargets {
+		return ErrInvalidTarget
+	}
+	for _, t := range targets {
+		if _, _, err = parseTarget(t); err != nil {
+			return
+		}
+	}
+	switch args.Policy {
+	case "", PolicyPrimary, PolicyRoundRobin:
+		return nil
+	}
+	return ErrInvalidPolicy
+}
+
+func newTargets(args *MountArgs) (targets []*target, err error) {
+
+	var tl *tlsLoader // 同一挂载的各 https target 共用
+	names := targetsOf(args)
+	for i, name := range names {
+		host, sock, err := parseTarget(name)
+		if err != nil {
+			return nil, err
+		}
+		var targetTL *tlsLoader
+		if strings.HasPrefix(host, httpsScheme) {
+			if tl == nil {
+				tl, err = newTLSLoader(&args.TLSArgs)
+				if err != nil {
+					return nil, err
+				}
+			}
+			targetTL = tl
+		}
+		targets = append(targets, &target{
+			idx:     i,
+			host:    host,
+			tr:      newTransport(&args.TransportArgs, sock, targetTL),
+			pin:     len(names) > 1,
+			healthy: 1,
+		})
+	}
+	return
+}
+
+// ---------------------------------------------------------------------------
+
+type targetKey struct{}
+
+// pinnedKey 标记请求针对已打开的句柄，只能由打开它的服务端处理，见 handleTarget。
+//
+type pinnedKey struct{}
+
+func targetOf(ctx context.Context) *target {
+
+	t, _ := ctx.Value(targetKey{}).(*target)
+	return t
+}
+
+// abandoned 判断请求应放弃所在的服务端：有多个服务端、健康检查已把该服务端判为不健康且另有健康的服务端，
+// 请求又不针对已打开的句柄。此时继续重试只会等到截止时间，不如立即失败，让调用者重新发起的请求改由其他服务端处理。
+//
+func abandoned(ctx context.Context) bool {
+
+	t, c := targetOf(ctx), connOf(ctx)
+	if t == nil || c == nil || !t.pin || t.isHealthy() {
+		return false
+	}
+	if pinned, _ := ctx.Value(pinnedKey{}).(bool); pinned {
+		return false
+	}
+	return c.primary() != t
+}
+
+// pinHandle 把服务端返回的句柄编码为交给内核的句柄，见 handleShift。
+//
+func pinHandle(ctx context.Context, h uint64) fuse.HandleID {
+
+	if t := targetOf(ctx); t != nil && t.pin {
+		return fuse.HandleID(h<<handleShift | uint64(t.idx))
+	}
+	return fuse.HandleID(h)
+}
+
+// validHandle 判断服务端返回的句柄能否由 pinHandle 编码。不能编码时该句柄在服务端上保持打开，
+// 直到服务端自行回收。
+//
+func validHandle(ctx context.Context, h uint64) bool {
+
+	if t := targetOf(ctx); t != nil && t.pin && h > maxHandle {
+		log.Error("qfusegate: handle out of range", t.host, h)
+		return false
+	}
+	return true
+}
+
+// handleOf 从内核的句柄取回服务端句柄，是 pinHandle 的逆运算。
+//
+func handleOf(ctx context.Context, h fuse.HandleID) uint64 {
+
+	if t := targetOf(ctx); t != nil && t.pin {
+		return uint64(h) >> handleShift
+	}
+	return uint64(h)
+}
+
+// handleTarget 返回请求针对的已打开句柄。
+//
+func handleTarget(r fuse.Request) (h fuse.HandleID, ok bool) {
+
+	switch r := r.(type) {
+	case *fuse.ReadRequest:
+		return r.Handle, true
+	case *fuse.WriteRequest:
+		return r.Handle, true
+	case *fuse.FlushRequest:
+		return r.Handle, true
+	case *fuse.FsyncRequest:
+		return r.Handle, true
+	case *fuse.ReleaseRequest:
+		return r.Handle, true
+	case *fuse.SetattrRequest:
+		return r.Handle, r.Valid.Handle()
+	}
+	return 0, false
+}
+
+// isIdempotentRead 判断 r 是否可以发往任一服务端。lookup 会增加服务端的 lookup 计数，
+// 之后的 forget 只发往主服务端，因此不在其中；只读 open 返回的句柄会被绑定到打开它的服务端。
+//
+func isIdempotentRead(r fuse.Request) bool {
+
+	switch r := r.(type) {
+	case *fuse.GetattrRequest, *fuse.AccessRequest, *fuse.StatfsRequest,
+		*fuse.ReadlinkRequest, *fuse.GetxattrRequest, *fuse.ListxattrRequest:
+		return true
+	case *fuse.OpenRequest:
+		return r.Flags.IsReadOnly() && r.Flags&fuse.OpenTruncate == 0
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------
+
+// primary 返回第一个健康的服务端；都不健康时返回第一个，让请求照常失败。
+//
+func (p *Conn) primary() *target {
+
+	for _, t := range p.targets {
+		if t.isHealthy() {
+			return t
+		}
+	}
+	return p.targets[0]
+}
+
+// pick 为请求选择服务端：
+//
+//	1. 针对已打开句柄的请求发往打开它的服务端，不论其是否健康；
+//	2. 打断请求发往被打断请求所在的服务端；
+//	3. PolicyRoundRobin 下，幂等的只读请求轮流发往各健康的服务端；
+//	4. 其余请求发往 primary。
+//
+func (p *Conn) pick(r fuse.Request) *target {
+
+	if len(p.targets) == 1 {
+		return p.targets[0]
+	}
+	if h, ok := handleTarget(r); ok {
+		return p.targets[int(uint64(h)&(maxTargets-1))%len(p.targets)]
+	}
+	if r, ok := r.(*fuse.InterruptRequest); ok {
+		if t := p.pendingTarget(r.IntrID); t != nil {
+			return t
+		}
+	}
+	if p.args.Policy == PolicyRoundRobin && isIdempotentRead(r) {
+		n := len(p.targets)
+		start := int(atomic.AddUint32(&p.rr, 1))
+		for i := 0; i < n; i++ {
+			t := p.targets[(start+i)%n]
+			if t.isHealthy() {
+				return t
+			}
+		}
+	}
+	return p.primary()
+}
+
+// checkHealth 定期探测各服务端。服务端能回复(即使是出错回复)即视为健康，连接失败等传输错误视为不健康。
+// 只有一个服务端时没有可切换的服务端，不做探测。
+//
+func (p *Conn) checkHealth() {
+
+	if len(p.targets) == 1 {
+		return
+	}
+	interval := time.Duration(orDefault(p.args.HealthCheckIntervalMs, DefaultHealthCheckIntervalMs)) * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		for _, t := range p.targets {
+			ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), connKey{}, p), interval)
+			client := newBoltClient(ctx, &fuse.Header{}, t.tr)
+			err := client.Call(ctx, nil, "POST", t.host+"/v1/statfs")
+			cancel()
+			if _, ok := err.(*rpc.ErrorInfo); ok || err == nil {
+				t.setHealthy(true, nil)
+			} else {
+				t.setHealthy(false, err)
+			}
+		}
+	}
+}
+
+// reportError 在请求遇到传输错误时把服务端标记为不健康，后续请求随即切换到其他服务端。
+//
+func reportError(ctx context.Context, err error) {
+
+	if _, ok := err.(*rpc.ErrorInfo); ok || ctx.Err() != nil {
+		return
+	}
+	if t := targetOf(ctx); t != nil && t.pin {
+		t.setHealthy(false, err)
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,180 @@
+package qfusegate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// ---------------------------------------------------------------------------
+
+func newTestConn(n int) *Conn {
+
+	p := &Conn{args: new(MountArgs), pending: make(map[fuse.RequestID]*pending)}
+	for i := 0; i < n; i++ {
+		p.targets = append(p.targets, &target{idx: i, pin: n > 1, healthy: 1})
+	}
+	return p
+}
+
+func TestAbandoned(t *testing.T) {
+
+	p := newTestConn(2)
+	t0, t1 := p.targets[0], p.targets[1]
+	ctxOf := func(t *target, pinned bool) context.Context {
+		ctx := context.WithValue(context.Background(), connKey{}, p)
+		ctx = context.WithValue(ctx, targetKey{}, t)
+		if pinned {
+			ctx = context.WithValue(ctx, pinnedKey{}, true)
+		}
+		return ctx
+	}
+
+	if abandoned(ctxOf(t0, false)) || abandoned(context.Background()) {
+		t.Fatal("healthy target should not be abandoned")
+	}
+	t0.setHealthy(false, nil)
+	if !abandoned(ctxOf(t0, false)) {
+		t.Fatal("unhealthy target should be abandoned when another is healthy")
+	}
+	if abandoned(ctxOf(t0, true)) {
+		t.Fatal("pinned request should stay on its target")
+	}
+	t1.setHealthy(false, nil)
+	if abandoned(ctxOf(t0, false)) {
+		t.Fatal("should keep retrying when no target is healthy")
+	}
+
+	single := newTestConn(1)
+	single.targets[0].setHealthy(false, nil)
+	ctx := context.WithValue(context.Background(), connKey{}, single)
+	if abandoned(context.WithValue(ctx, targetKey{}, single.targets[0])) {
+		t.Fatal("single target should not be abandoned")
+	}
+}
+
+func TestPick(t *testing.T) {
+
+	p := newTestConn(3)
+	t0, t1, t2 := p.targets[0], p.targets[1], p.targets[2]
+
+	// 针对已打开句柄的请求发往打开它的服务端，即使该服务端不健康
+	t1.setHealthy(false, nil)
+	if got := p.pick(&fuse.ReadRequest{Handle: fuse.HandleID(5<<handleShift | 1)}); got != t1 {
+		t.Fatal("pick read:", got.idx)
+	}
+	if got := p.pick(&fuse.SetattrRequest{Valid: fuse.SetattrHandle, Handle: fuse.HandleID(5<<handleShift | 2)}); got != t2 {
+		t.Fatal("pick setattr with handle:", got.idx)
+	}
+
+	// 打断请求发往被打断请求所在的服务端；被打断的请求已结束时发往 primary
+	p.pending[7] = &pending{target: t2}
+	if got := p.pick(&fuse.InterruptRequest{IntrID: 7}); got != t2 {
+		t.Fatal("pick interrupt:", got.idx)
+	}
+	if got := p.pick(&fuse.InterruptRequest{IntrID: 8}); got != t0 {
+		t.Fatal("pick interrupt of finished request:", got.idx)
+	}
+
+	// PolicyPrimary 下其余请求都发往第一个健康的服务端
+	if got := p.pick(new(fuse.GetattrRequest)); got != t0 {
+		t.Fatal("pick primary:", got.idx)
+	}
+	t0.setHealthy(false, nil)
+	if got := p.pick(new(fuse.LookupRequest)); got != t2 {
+		t.Fatal("pick primary with unhealthy targets:", got.idx)
+	}
+	t0.setHealthy(true, nil)
+
+	// PolicyRoundRobin 下幂等的只读请求轮流发往各健康的服务端，跳过不健康的
+	p.args.Policy = PolicyRoundRobin
+	seen := make(map[int]int)
+	for i := 0; i < 6; i++ {
+		seen[p.pick(new(fuse.GetattrRequest)).idx]++
+	}
+	if seen[1] != 0 || seen[0] == 0 || seen[2] == 0 {
+		t.Fatal("pick round robin:", seen)
+	}
+	if got := p.pick(new(fuse.LookupRequest)); got != t0 {
+		t.Fatal("pick lookup under round robin:", got.idx)
+	}
+	if got := p.pick(&fuse.OpenRequest{Flags: fuse.OpenReadOnly | fuse.OpenTruncate}); got != t0 {
+		t.Fatal("pick open with truncate under round robin:", got.idx)
+	}
+}
+
+func TestPinHandle(t *testing.T) {
+
+	p := newTestConn(4)
+	ctx := context.WithValue(context.Background(), targetKey{}, p.targets[3])
+
+	for _, h := range []uint64{0, 1, 12345, maxHandle} {
+		if !validHandle(ctx, h) {
+			t.Fatal("validHandle:", h)
+		}
+		fh := pinHandle(ctx, h)
+		if got := handleOf(ctx, fh); got != h {
+			t.Fatal("handleOf(pinHandle):", h, got)
+		}
+		if got := p.pick(&fuse.ReleaseRequest{Handle: fh}); got != p.targets[3] {
+			t.Fatal("pick pinned handle:", h, got.idx)
+		}
+	}
+	// 超出 56 位的句柄无法编码
+	if validHandle(ctx, maxHandle+1) || validHandle(ctx, 1<<63) {
+		t.Fatal("validHandle should reject handles beyond 56 bits")
+	}
+
+	// 只有一个服务端时句柄原样传递
+	single := newTestConn(1)
+	ctx = context.WithValue(context.Background(), targetKey{}, single.targets[0])
+	h := uint64(1<<63 | 5)
+	if !validHandle(ctx, h) || uint64(pinHandle(ctx, h)) != h || handleOf(ctx, fuse.HandleID(h)) != h {
+		t.Fatal("single target should not pin handles")
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+
+	// 能回复的服务端即使回复错误也是健康的
+	errTs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(500)
+		w.Write([]byte(`{"error":"internal error","errno":5}`))
+	}))
+	defer errTs.Close()
+	deadTs := httptest.NewServer(http.NotFoundHandler())
+	deadTs.Close()
+
+	args := &MountArgs{
+		Targets:               []string{errTs.URL, deadTs.URL},
+		HealthCheckIntervalMs: 10,
+	}
+	args.RetryDeadlineMs = -1
+	p, err := NewConn(nil, args)
+	if err != nil {
+		t.Fatal("NewConn:", err)
+	}
+	p.targets[0].setHealthy(false, nil)
+	go p.checkHealth()
+	defer close(p.done)
+
+	for i := 0; ; i++ {
+		if p.targets[0].isHealthy() && !p.targets[1].isHealthy() {
+			break
+		}
+		if i == 200 {
+			t.Fatal("checkHealth:", p.targetStatus()[0], p.targetStatus()[1])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := p.targetStatus()[1]; st.LastError == "" {
+		t.Fatal("unhealthy target without last error:", st)
+	}
+}
+
+// ---------------------------------------------------------------------------
@@ -0,0 +1,180 @@
+package qfusegate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qiniu/errors"
+	"qiniupkg.com/x/log.v7"
+)
+
+// ---------------------------------------------------------------------------
+
+// TLSArgs 是 https target 的 TLS 参数。证书文件在建立新连接时检查，内容变化后自动重新加载，无需重新挂载。
+//
+type TLSArgs struct {
+	// 校验服务端证书的 CA 证书(PEM，可包含多个)，为空时使用系统的 CA。
+	//
+	TLSCAFile string `json:"tls_ca_file"`
+
+	// 客户端证书及其私钥(PEM)，用于 mTLS，须同时给出。
+	//
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+
+	// 服务端证书须匹配的名字，为空时为 target 的主机名。服务端以 IP 访问、证书签发给域名时使用。
+	//
+	TLSServerName string `json:"tls_server_name"`
+}
+
+func (p *TLSArgs) enabled() bool {
+
+	return p.TLSCAFile != "" || p.TLSCertFile != "" || p.TLSKeyFile != "" || p.TLSServerName != ""
+}
+
+func checkTLSArgs(args *MountArgs) error {
+
+	if (args.TLSCertFile == "") != (args.TLSKeyFile == "") {
+		return ErrInvalidTLSArgs
+	}
+	if !args.TLSArgs.enabled() {
+		return nil
+	}
+	for _, name := range targetsOf(args) {
+		if strings.HasPrefix(name, httpsScheme) {
+			return nil
+		}
+	}
+	return ErrInvalidTLSArgs
+}
+
+const httpsScheme = "https://"
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// tlsLoader 按 TLSArgs 生成 tls.Config，并在证书文件变化时重新加载。重新加载失败时沿用原来的配置。
+//
+type tlsLoader struct {
+	args   *TLSArgs
+	stamps []fileStamp
+	cfg    *tls.Config
+	mutex  sync.Mutex
+}
+
+func newTLSLoader(args *TLSArgs) (p *tlsLoader, err error) {
+
+	p = &tlsLoader{args: args}
+	p.stamps = p.stat()
+	p.cfg, err = p.load()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (p *tlsLoader) files() []string {
+
+	return []string{p.args.TLSCAFile, p.args.TLSCertFile, p.args.TLSKeyFile}
+}
+
+func (p *tlsLoader) stat() []fileStamp {
+
+	files := p.files()
+	stamps := make([]fileStamp, len(files))
+	for i, file := range files {
+		if file == "" {
+			continue
+		}
+		if fi, err := os.Stat(file); err == nil {
+			stamps[i] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return stamps
+}
+
+func (p *tlsLoader) load() (cfg *tls.Config, err error) {
+
+	cfg = &tls.Config{ServerName: p.args.TLSServerName}
+	if p.args.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(p.args.TLSCAFile)
+		if err != nil {
+			return nil, errors.Info(err, "qfusegate: read tls_ca_file", p.args.TLSCAFile).Detail(err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Info(ErrInvalidTLSArgs, "qfusegate: no certificate in tls_ca_file", p.args.TLSCAFile)
+		}
+	}
+	if p.args.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.args.TLSCertFile, p.args.TLSKeyFile)
+		if err != nil {
+			return nil, errors.Info(err, "qfusegate: load tls_cert_file", p.args.TLSCertFile, p.args.TLSKeyFile).Detail(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// config 返回当前的 tls.Config，证书文件变化时先重新加载。
+//
+func (p *tlsLoader) config() *tls.Config {
+
+	stamps := p.stat()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	changed := false
+	for i := range stamps {
+		if stamps[i] != p.stamps[i] {
+			changed = true
+		}
+	}
+	if changed {
+		// 证书与私钥分别更新时可能暂时不匹配，加载失败时不更新 stamps，下次建立连接时再试
+		cfg, err := p.load()
+		if err != nil {
+			log.Warn("qfusegate: reload tls certificates failed, keep using the old ones:", err)
+		} else {
+			p.cfg, p.stamps = cfg, stamps
+			log.Info("qfusegate: tls certificates reloaded:", p.files())
+		}
+	}
+	return p.cfg
+}
+
+// dialTLS 经 dial 建立连接后以当前的 tls.Config 握手。nextProtos 不为空时用于 ALPN(如 HTTP/2 的 "h2")。
+//
+func (p *tlsLoader) dialTLS(conn net.Conn, addr string, timeout time.Duration, nextProtos []string) (net.Conn, error) {
+
+	cfg := p.config().Clone()
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg.ServerName = host
+	}
+	cfg.NextProtos = nextProtos
+
+	tc := tls.Client(conn, cfg)
+	tc.SetDeadline(time.Now().Add(timeout))
+	err := tc.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// ---------------------------------------------------------------------------
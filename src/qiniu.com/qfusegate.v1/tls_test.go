@@ -0,0 +1,222 @@
+package qfusegate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+var testSerial int64
+
+// newTestCert 签发证书，parent 为 nil 时生成自签名的 CA。
+//
+func newTestCert(t *testing.T, cn string, dnsNames []string, parent *testCert) *testCert {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+// writeTestFile 写入文件并推后其修改时间，确保 tlsLoader 能发现变化。
+//
+func writeTestFile(t *testing.T, path string, data []byte, mtime time.Time) {
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTLSTestServer 启动 https 服务端，证书签发给 bolt.test 而不是其 IP。客户端出示证书时回复其 CN。
+//
+func newTLSTestServer(t *testing.T, ca *testCert) *httptest.Server {
+
+	server := newTestCert(t, "server", []string{"bolt.test"}, ca)
+	pair, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // 校验失败的握手是预期的
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	ts.StartTLS()
+	return ts
+}
+
+// tlsGet 以挂载的 https target 发一个请求，每次都建立新连接。
+//
+func tlsGet(t *testing.T, args *MountArgs) (peer string, err error) {
+
+	targets, err := newTargets(args)
+	if err != nil {
+		t.Fatal("newTargets:", err)
+	}
+	return tlsGetWith(targets[0])
+}
+
+func tlsGetWith(tg *target) (peer string, err error) {
+
+	tg.tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tg.tr}).Get(tg.host + "/v1/statfs")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+// ---------------------------------------------------------------------------
+
+func TestTLSVerify(t *testing.T) {
+
+	dir := t.TempDir()
+	ca, otherCA := newTestCert(t, "ca", nil, nil), newTestCert(t, "other-ca", nil, nil)
+	ts := newTLSTestServer(t, ca)
+	defer ts.Close()
+
+	caFile, otherCAFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "other-ca.pem")
+	writeTestFile(t, caFile, ca.certPEM, time.Now())
+	writeTestFile(t, otherCAFile, otherCA.certPEM, time.Now())
+
+	cases := []struct {
+		name       string
+		caFile     string
+		serverName string
+		ok         bool
+	}{
+		{"wrong-ca", otherCAFile, "bolt.test", false},
+		{"ip-not-in-cert", caFile, "", false}, // 证书签发给域名，以 IP 访问时校验失败
+		{"server-name", caFile, "bolt.test", true},
+		{"wrong-server-name", caFile, "other.test", false},
+	}
+	for _, tc := range cases {
+		args := &MountArgs{TargetFSHost: ts.URL}
+		args.TLSCAFile, args.TLSServerName = tc.caFile, tc.serverName
+		args.RetryDeadlineMs = -1
+		if _, err := tlsGet(t, args); (err == nil) != tc.ok {
+			t.Fatal(tc.name, ":", err)
+		}
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, nil)
+	ts := newTLSTestServer(t, ca)
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	mtime := time.Now()
+	writeTestFile(t, caFile, ca.certPEM, mtime)
+	client1 := newTestCert(t, "client1", nil, ca)
+	writeTestFile(t, certFile, client1.certPEM, mtime)
+	writeTestFile(t, keyFile, client1.keyPEM, mtime)
+
+	args := &MountArgs{TargetFSHost: ts.URL}
+	args.TLSCAFile, args.TLSServerName = caFile, "bolt.test"
+	args.TLSCertFile, args.TLSKeyFile = certFile, keyFile
+	args.RetryDeadlineMs = -1
+	targets, err := newTargets(args)
+	if err != nil {
+		t.Fatal("newTargets:", err)
+	}
+	tg := targets[0]
+	if peer, err := tlsGetWith(tg); err != nil || peer != "client1" {
+		t.Fatal("client1:", peer, err)
+	}
+
+	// 改写证书与私钥后，新建的连接使用新证书
+	client2 := newTestCert(t, "client2", nil, ca)
+	mtime = mtime.Add(time.Minute)
+	writeTestFile(t, certFile, client2.certPEM, mtime)
+	writeTestFile(t, keyFile, client2.keyPEM, mtime)
+	if peer, err := tlsGetWith(tg); err != nil || peer != "client2" {
+		t.Fatal("client2:", peer, err)
+	}
+
+	// 证书与私钥不匹配(如只更新了其一)时沿用原来的配置
+	client3 := newTestCert(t, "client3", nil, ca)
+	mtime = mtime.Add(time.Minute)
+	writeTestFile(t, certFile, client3.certPEM, mtime)
+	if peer, err := tlsGetWith(tg); err != nil || peer != "client2" {
+		t.Fatal("mismatched pair:", peer, err)
+	}
+
+	// 私钥随后更新，再次加载成功
+	writeTestFile(t, keyFile, client3.keyPEM, mtime)
+	if peer, err := tlsGetWith(tg); err != nil || peer != "client3" {
+		t.Fatal("client3:", peer, err)
+	}
+}
+
+// ---------------------------------------------------------------------------
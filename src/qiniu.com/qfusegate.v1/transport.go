@@ -0,0 +1,213 @@
+package qfusegate
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+)
+
+// ---------------------------------------------------------------------------
+
+const (
+	DefaultMaxIdleConnsPerHost = 64
+	DefaultIdleTimeoutMs       = 90000
+	DefaultDialTimeoutMs       = 5000
+)
+
+// TransportArgs 是挂载的 HTTP 连接参数。每个挂载独占一个按此配置的连接池，所有 FUSE 请求共用。
+//
+type TransportArgs struct {
+	// 到服务端的最大连接数，0 表示不限制。
+	//
+	MaxConnsPerHost int `json:"max_conns_per_host"`
+
+	// 保持的最大空闲连接数，0 表示 DefaultMaxIdleConnsPerHost。
+	//
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"`
+
+	// 空闲连接的保持时间，0 表示 DefaultIdleTimeoutMs。
+	//
+	IdleTimeoutMs int `json:"idle_timeout_ms"`
+
+	// 发出请求后等待返回头的超时时间，0 表示不限制。
+	//
+	ResponseHeaderTimeoutMs int `json:"response_header_timeout_ms"`
+
+	// 建立连接的超时时间，0 表示 DefaultDialTimeoutMs。
+	//
+	DialTimeoutMs int `json:"dial_timeout_ms"`
+
+	// 不为 0 时以明文 HTTP/2 (h2c) 访问服务端，所有请求复用少量连接。https target 时为 HTTP/2 over TLS。
+	//
+	H2C int `json:"h2c"`
+
+	// 传输错误的重试参数，见 retry.go。
+	//
+	RetryArgs
+
+	// https target 的 TLS 参数，见 tls.go。
+	//
+	TLSArgs
+}
+
+type transportStats struct {
+	NewConns    int64 `json:"new_conns"`    // 新建的连接数
+	ReusedConns int64 `json:"reused_conns"` // 复用已有连接的请求数
+	DialErrors  int64 `json:"dial_errors"`
+	DialTimeMs  int64 `json:"dial_time_ms"` // 建立连接的累计耗时
+
+	Retries      int64 `json:"retries"`       // 重试次数
+	RetryGiveups int64 `json:"retry_giveups"` // 放弃重试的请求数(到截止时间或服务端不健康)
+	ReqidDedup   bool  `json:"reqid_dedup"`   // 服务端是否按 X-Reqid 去重
+}
+
+// boltTransport 在 base 之上按 retryPolicy 重试传输错误，并统计连接的建立与复用情况。
+//
+type boltTransport struct {
+	base interface {
+		http.RoundTripper
+		CloseIdleConnections()
+	}
+	retry retryPolicy
+
+	newConns    int64
+	reusedConns int64
+	dialErrors  int64
+	dialTimeNs  int64
+
+	retries      int64
+	retryGiveups int64
+	reqidDedup   int32 // 服务端在 init 回复中声明了 X-Reqid 去重
+}
+
+const unixScheme = "unix://"
+
+// parseTarget 解析挂载的 target。"unix:///path/to/qbolt.sock" 表示经 unix socket 访问服务端，
+// 此时返回的 host 只是用于拼接 URL 的占位符；其余形式原样作为 host。
+//
+func parseTarget(target string) (host, sock string, err error) {
+
+	if !strings.HasPrefix(target, unixScheme) {
+		return target, "", nil
+	}
+	sock = target[len(unixScheme):]
+	if !strings.HasPrefix(sock, "/") {
+		return "", "", ErrInvalidTarget
+	}
+	return "http://unix", sock, nil
+}
+
+// newTransport 创建挂载的连接池。sock 不为空时所有连接都建立到该 unix socket；
+// tl 不为空时(https target)以其当前的证书建立 TLS 连接。
+//
+func newTransport(args *TransportArgs, sock string, tl *tlsLoader) *boltTransport {
+
+	dialTimeout := time.Duration(orDefault(args.DialTimeoutMs, DefaultDialTimeoutMs)) * time.Millisecond
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if sock != "" {
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", sock)
+		}
+	}
+
+	dialTLS := func(network, addr string, nextProtos []string) (net.Conn, error) {
+		conn, err := dial(context.Background(), network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return tl.dialTLS(conn, addr, dialTimeout, nextProtos)
+	}
+
+	p := &boltTransport{retry: newRetryPolicy(&args.RetryArgs)}
+	if args.H2C != 0 {
+		// https target 时为 HTTP/2 over TLS
+		p.base = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				if tl != nil {
+					return dialTLS(network, addr, []string{http2.NextProtoTLS})
+				}
+				return dial(context.Background(), network, addr)
+			},
+		}
+		return p
+	}
+	tr := &http.Transport{
+		DialContext:           dial,
+		MaxConnsPerHost:       args.MaxConnsPerHost,
+		MaxIdleConnsPerHost:   orDefault(args.MaxIdleConnsPerHost, DefaultMaxIdleConnsPerHost),
+		IdleConnTimeout:       time.Duration(orDefault(args.IdleTimeoutMs, DefaultIdleTimeoutMs)) * time.Millisecond,
+		ResponseHeaderTimeout: time.Duration(args.ResponseHeaderTimeoutMs) * time.Millisecond,
+	}
+	if tl != nil {
+		tr.DialTLS = func(network, addr string) (net.Conn, error) {
+			return dialTLS(network, addr, nil)
+		}
+	}
+	p.base = tr
+	return p
+}
+
+// roundTrip 发出一次请求。wrote 记录请求是否已完整写出，未写出的请求总是可以安全地重试。
+//
+func (p *boltTransport) roundTrip(req *http.Request, wrote *int32) (resp *http.Response, err error) {
+
+	var dialStart int64 // happy eyeballs 时可能并发建立多个连接
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&p.reusedConns, 1)
+			} else {
+				atomic.AddInt64(&p.newConns, 1)
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			atomic.StoreInt64(&dialStart, time.Now().UnixNano())
+		},
+		ConnectDone: func(network, addr string, err error) {
+			atomic.AddInt64(&p.dialTimeNs, time.Now().UnixNano()-atomic.LoadInt64(&dialStart))
+			if err != nil {
+				atomic.AddInt64(&p.dialErrors, 1)
+			}
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				atomic.StoreInt32(wrote, 1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return p.base.RoundTrip(req)
+}
+
+func (p *boltTransport) CloseIdleConnections() {
+
+	p.base.CloseIdleConnections()
+}
+
+func (p *boltTransport) stats() *transportStats {
+
+	return &transportStats{
+		NewConns:    atomic.LoadInt64(&p.newConns),
+		ReusedConns: atomic.LoadInt64(&p.reusedConns),
+		DialErrors:  atomic.LoadInt64(&p.dialErrors),
+		DialTimeMs:  atomic.LoadInt64(&p.dialTimeNs) / int64(time.Millisecond),
+
+		Retries:      atomic.LoadInt64(&p.retries),
+		RetryGiveups: atomic.LoadInt64(&p.retryGiveups),
+		ReqidDedup:   atomic.LoadInt32(&p.reqidDedup) != 0,
+	}
+}
+
+// ---------------------------------------------------------------------------
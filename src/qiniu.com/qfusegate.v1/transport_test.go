@@ -0,0 +1,71 @@
+package qfusegate
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+
+func TestParseTarget(t *testing.T) {
+
+	cases := []struct {
+		target     string
+		host, sock string
+		ok         bool
+	}{
+		{"http://10.0.0.1:7777", "http://10.0.0.1:7777", "", true},
+		{"https://bolt.test", "https://bolt.test", "", true},
+		{"unix:///var/run/qbolt.sock", "http://unix", "/var/run/qbolt.sock", true},
+		{"unix:///qbolt.sock", "http://unix", "/qbolt.sock", true},
+		{"unix://var/run/qbolt.sock", "", "", false}, // 须为绝对路径
+		{"unix://", "", "", false},
+	}
+	for _, tc := range cases {
+		host, sock, err := parseTarget(tc.target)
+		if (err == nil) != tc.ok || host != tc.host || sock != tc.sock {
+			t.Fatalf("parseTarget(%q): %q, %q, %v", tc.target, host, sock, err)
+		}
+	}
+
+	if err := checkTargets(&MountArgs{Targets: []string{"http://10.0.0.1", "unix://relative.sock"}}); err == nil {
+		t.Fatal("checkTargets should reject relative unix sockets")
+	}
+}
+
+func TestUnixTarget(t *testing.T) {
+
+	sock := filepath.Join(t.TempDir(), "qbolt.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Host + req.URL.Path))
+	}))
+	ts.Listener.Close()
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	targets, err := newTargets(&MountArgs{TargetFSHost: "unix://" + sock})
+	if err != nil {
+		t.Fatal("newTargets:", err)
+	}
+	tg := targets[0]
+	resp, err := (&http.Client{Transport: tg.tr}).Post(tg.host+"/v1/statfs", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal("statfs:", err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != "unix/v1/statfs" {
+		t.Fatal("reply:", string(b))
+	}
+}
+
+// ---------------------------------------------------------------------------
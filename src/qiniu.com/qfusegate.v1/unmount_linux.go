@@ -0,0 +1,23 @@
+package qfusegate
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+)
+
+// unmountLazy 相当于 umount -l：立即摘除挂载点，仍在使用的文件关闭后才真正断开。
+//
+func unmountLazy(dir string) error {
+
+	cmd := exec.Command("fusermount", "-u", "-z", dir)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(output) > 0 {
+			output = bytes.TrimRight(output, "\n")
+			err = errors.New(err.Error() + ": " + string(output))
+		}
+		return err
+	}
+	return nil
+}
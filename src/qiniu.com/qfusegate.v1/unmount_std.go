@@ -0,0 +1,23 @@
+// +build !linux
+
+package qfusegate
+
+import (
+	"os"
+	"syscall"
+)
+
+// MNT_FORCE，OS X 与 FreeBSD 相同。
+//
+const mntForce = 0x80000
+
+// unmountLazy 在没有 lazy unmount 的系统上退化为 MNT_FORCE。
+//
+func unmountLazy(dir string) error {
+
+	err := syscall.Unmount(dir, mntForce)
+	if err != nil {
+		return &os.PathError{Op: "unmount", Path: dir, Err: err}
+	}
+	return nil
+}